@@ -1,29 +1,59 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/tls"
+	"errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
 
-	"github.com/krispingal/l7lb/internal/domain"
 	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/infrastructure/handoff"
+	"github.com/krispingal/l7lb/internal/infrastructure/proxyprotocol"
+	"github.com/krispingal/l7lb/internal/infrastructure/tlsconfig"
 	"github.com/krispingal/l7lb/internal/interfaces/httphandler"
 	"github.com/krispingal/l7lb/internal/usecases"
 	"github.com/krispingal/l7lb/internal/usecases/loadbalancing"
 	"github.com/krispingal/l7lb/internal/usecases/ratelimiting"
+	"go.uber.org/zap"
 )
 
+const (
+	defaultDrainTimeout   = 30 * time.Second
+	defaultUpgradeTimeout = 30 * time.Second
+)
+
+// shutdowner is a server that stops accepting connections and waits for the active ones to go idle
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
 func main() {
 	infrastructure.InitLogger()
 	logger := infrastructure.Logger
 	sugar := infrastructure.Logger.Sugar()
 
-	go func() {
-		sugar.Info(http.ListenAndServe("localhost:6060", nil))
-	}()
+	// On an upgrade the listening sockets and backend health are taken over from the previous process
+	sockets, err := handoff.Inherit()
+	if err != nil {
+		sugar.Fatalf("Error taking over from the previous process: %v", err)
+	}
+
+	if debugListener, err := sockets.Listen("localhost:6060"); err != nil {
+		sugar.Info(err)
+	} else {
+		go func() {
+			sugar.Info(http.Serve(debugListener, nil))
+		}()
+	}
 
 	config, err := infrastructure.LoadConfig("config")
 	if err != nil {
@@ -45,57 +75,253 @@ func main() {
 		sugar.Fatalf("Invalid time duration provided for healthchecker frequency: %v, %v", err1, err2)
 	}
 
+	shutdownConfig := config.LoadBalancer.Shutdown
+	drainTimeout := defaultDrainTimeout
+	if shutdownConfig.DrainTimeout != "" {
+		if drainTimeout, err = time.ParseDuration(shutdownConfig.DrainTimeout); err != nil {
+			sugar.Fatalf("Invalid shutdown drain_timeout: %v", err)
+		}
+	}
+	var readinessDelay time.Duration
+	if shutdownConfig.ReadinessDelay != "" {
+		if readinessDelay, err = time.ParseDuration(shutdownConfig.ReadinessDelay); err != nil {
+			sugar.Fatalf("Invalid shutdown readiness_delay: %v", err)
+		}
+	}
+	upgradeTimeout := defaultUpgradeTimeout
+	if shutdownConfig.UpgradeTimeout != "" {
+		if upgradeTimeout, err = time.ParseDuration(shutdownConfig.UpgradeTimeout); err != nil {
+			sugar.Fatalf("Invalid shutdown upgrade_timeout: %v", err)
+		}
+	}
+	// SIGTERM and SIGINT start draining, the health checker and load balancers stop once requests drained
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
 	registry := infrastructure.NewBackendRegistry()
 	hc := usecases.NewHealthChecker(hc_healthy_freq, hc_unhealthy_freq, registry, pooledClient, logger)
 
-	loadBalancers := loadbalancing.CreateLoadBalancers(config, registry, hc, logger)
+	routes, err := loadbalancing.CreateRoutes(workers, config, registry, hc, logger)
+	if err != nil {
+		sugar.Fatalf("Error creating routes: %v", err)
+	}
+
+	// Backends healthy in the previous process take traffic before their first check here
+	hc.Restore(sockets.Healthy())
+	hc.Start(workers)
+
+	// Pool weights can be changed without a restart to ramp traffic between pools
+	err = infrastructure.WatchConfig("config", func(updated *infrastructure.Config, err error) {
+		if err != nil {
+			sugar.Errorf("Error reloading config: %v", err)
+			return
+		}
+		loadbalancing.UpdatePoolWeights(routes, updated, logger)
+	})
+	if err != nil {
+		sugar.Fatalf("Error watching config: %v", err)
+	}
+
+	// Rate limits with a store are shared by all replicas
+	rateLimitStore, err := ratelimiting.NewRedisStore(config.RateLimitStore)
+	if err != nil {
+		sugar.Fatalf("Error connecting to the rate limit store: %v", err)
+	}
+	routeHandlers, err := httphandler.NewRouteHandlers(routes, config, rateLimitStore, logger)
+	if err != nil {
+		sugar.Fatalf("Error creating route handlers: %v", err)
+	}
+	listeners := httphandler.Listeners(config.LoadBalancer)
+	var certStore *tlsconfig.CertStore
+	var tlsConfig *tls.Config
+	if slices.ContainsFunc(listeners, func(l infrastructure.Listener) bool {
+		return httphandler.ListenerProtocol(l) == httphandler.ProtocolHTTPS
+	}) {
+		certStore, tlsConfig = newTLSConfig(config, logger)
+	}
+	clientIPResolver, err := httphandler.NewClientIPResolver(config.LoadBalancer.TrustedProxies, config.LoadBalancer.ClientIPHeaders)
+	if err != nil {
+		sugar.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	readiness := httphandler.NewReadiness()
+	var servers []shutdowner
 
-	hc.Start()
+	// Every listener runs its own server, with its own protocol, routes and timeouts
+	for _, listenerConfig := range listeners {
+		handlers, err := httphandler.SelectRoutes(routeHandlers, listenerConfig.Routes)
+		if err != nil {
+			sugar.Fatalf("Error creating listener %s: %v", listenerConfig.Address, err)
+		}
+		if httphandler.ListenerProtocol(listenerConfig) == httphandler.ProtocolHTTPS {
+			for path, routeHandler := range handlers {
+				handlers[path] = httphandler.NewServerNameMiddleware(certStore, path, routeHandler)
+			}
+		}
+		router := httphandler.NewPathRouterExactPath(handlers)
+		handler := httphandler.NewClientIPMiddleware(clientIPResolver, httphandler.NewClientCertHeadersMiddleware(config.LoadBalancer.ClientAuth, router))
+		if shutdownConfig.ReadinessPath != "" {
+			handler = httphandler.NewReadinessMiddleware(readiness, shutdownConfig.ReadinessPath, handler)
+		}
+		if certStore != nil && httphandler.ListenerProtocol(listenerConfig) != httphandler.ProtocolHTTPS {
+			handler = certStore.ACMEHTTPHandler(handler) // HTTP-01 challenges, ahead of access lists and draining
+		}
+		server, err := httphandler.NewServer(listenerConfig, handler, tlsConfig)
+		if err != nil {
+			sugar.Fatalf("Error creating listener %s: %v", listenerConfig.Address, err)
+		}
+		if listenerConfig.HTTP3 {
+			// HTTP/3 on the same port over UDP, advertised in the responses of the TCP listener
+			http3Server, err := httphandler.NewHTTP3Server(listenerConfig, server)
+			if err != nil {
+				sugar.Fatalf("Error creating listener %s: %v", listenerConfig.Address, err)
+			}
+			server.Handler = httphandler.NewAltSvcMiddleware(http3Server, server.Handler)
+			packetConn, err := sockets.ListenPacket(listenerConfig.Address)
+			if err != nil {
+				sugar.Fatalf("Error listening on %s: %v", listenerConfig.Address, err)
+			}
+			servers = append(servers, http3Server)
+			go func() {
+				if err := http3Server.Serve(packetConn); !errors.Is(err, http.ErrServerClosed) {
+					sugar.Fatal(err)
+				}
+			}()
+		}
 
-	router := httphandler.NewPathRouterExactPathWithLB(loadBalancers)
-	var rateLimiter domain.RateLimiter
-	switch config.RateLimiter.Type {
-	case "none":
-		rateLimiter = ratelimiting.NoOpRateLimiter{}
-	case "fixed_window":
-		windowDuration, err := time.ParseDuration(config.RateLimiter.Window)
+		listener, err := sockets.Listen(listenerConfig.Address)
 		if err != nil {
-			sugar.Fatalf("Invalid fixed window ratelimiter window duration: %v", err)
+			sugar.Fatalf("Error listening on %s: %v", listenerConfig.Address, err)
+		}
+		// An L4 proxy in front of the load balancer may pass the client's address in a PROXY header
+		listener, err = proxyprotocol.NewListener(listener, config.LoadBalancer.ProxyProtocol, config.LoadBalancer.ProxyProtocolTrusted, infrastructure.MetricsMap("proxyprotocol"))
+		if err != nil {
+			sugar.Fatalf("Error creating PROXY protocol listener: %v", err)
+		}
+		servers = append(servers, server)
+		go func() {
+			if err := httphandler.Serve(server, listener); !errors.Is(err, http.ErrServerClosed) {
+				sugar.Fatal(err)
+			}
+		}()
+		sugar.Infof("Load Balancer started at %s (%s)", listenerConfig.Address, httphandler.ListenerProtocol(listenerConfig))
+	}
+	if acmeConfig := config.LoadBalancer.ACME; certStore != nil && acmeConfig != nil && acmeConfig.HTTPAddress != "" &&
+		!slices.ContainsFunc(listeners, func(l infrastructure.Listener) bool { return l.Address == acmeConfig.HTTPAddress }) {
+		// HTTP-01 challenges where no listener serves plain HTTP, other requests are redirected to HTTPS
+		acmeListenerConfig := infrastructure.Listener{Address: acmeConfig.HTTPAddress, Protocol: httphandler.ProtocolHTTP}
+		server, err := httphandler.NewServer(acmeListenerConfig, certStore.ACMEHTTPHandler(nil), nil)
+		if err != nil {
+			sugar.Fatalf("Error creating listener %s: %v", acmeConfig.HTTPAddress, err)
+		}
+		listener, err := sockets.Listen(acmeConfig.HTTPAddress)
+		if err != nil {
+			sugar.Fatalf("Error listening on %s: %v", acmeConfig.HTTPAddress, err)
+		}
+		servers = append(servers, server)
+		go func() {
+			if err := httphandler.Serve(server, listener); !errors.Is(err, http.ErrServerClosed) {
+				sugar.Fatal(err)
+			}
+		}()
+	}
+
+	// The previous process drains once this one serves
+	if err := sockets.Ready(); err != nil {
+		sugar.Errorf("Error telling the previous process to drain: %v", err)
+	}
+	if shutdownConfig.PIDFile != "" {
+		if err := os.WriteFile(shutdownConfig.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			sugar.Errorf("Error writing the pid file: %v", err)
 		}
-		// fixed window rate limiter
-		rateLimiter = ratelimiting.NewFixedWindowRateLimiter(config.RateLimiter.Limit, windowDuration)
-	default:
-		sugar.Fatalf("Invalid rate limiter type: %s", config.RateLimiter.Type)
 	}
 
-	// Generate a session ticket key for session resumption
-	sessionTicketKey := [32]byte{}
-	if _, err := rand.Read(sessionTicketKey[:]); err != nil {
-		sugar.Fatalf("failed to generate a session ticket key: %v", err)
+	// SIGUSR2 starts the binary again with the listening sockets, a failed upgrade keeps this process serving
+	upgraded := false
+	for !upgraded && signals.Err() == nil {
+		select {
+		case <-upgrades:
+			sugar.Info("Upgrading, starting the new process")
+			if err := sockets.Upgrade(hc.HealthyBackends(), upgradeTimeout); err != nil {
+				sugar.Errorf("Upgrade failed, still serving: %v", err)
+				continue
+			}
+			upgraded = true
+		case <-signals.Done():
+		}
+	}
+	signal.Stop(upgrades)
+	stopSignals() // a second signal exits right away
+	if upgraded {
+		// The new process accepts on the same sockets, readiness stays up
+		sugar.Info("Upgraded, draining")
+	} else {
+		sugar.Info("Shutting down, failing readiness checks")
+		readiness.Drain()
+		time.Sleep(readinessDelay)
 	}
 
-	// TLSConfig with optimized settings for security and performance
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,           // Allows TLS 1.2 fallback
-		MaxVersion: tls.VersionTLS13,           // Prefer TLS 1.3 for security and performance
-		NextProtos: []string{"h2", "http/1.1"}, // Enable HTTP/2
+	// Listeners close, and in-flight requests get the drain timeout to complete
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(drainCtx); err != nil {
+				sugar.Warnf("Closing connections still active after the drain timeout: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	stopWorkers()
+	if certStore != nil {
+		certStore.Close()
+	}
+	if rateLimitStore != nil {
+		rateLimitStore.Close()
+	}
+	sugar.Info("Load Balancer stopped")
+}
 
-		SessionTicketsDisabled: false,
-		SessionTicketKey:       sessionTicketKey,
+// newTLSConfig loads the certificates and creates the TLS config shared by the HTTPS listeners
+func newTLSConfig(config *infrastructure.Config, logger *zap.Logger) (*tlsconfig.CertStore, *tls.Config) {
+	sugar := logger.Sugar()
+	certStore, err := tlsconfig.NewCertStore(config.LoadBalancer, infrastructure.MetricsMap("certificates"), logger)
+	if err != nil {
+		sugar.Fatalf("Error loading certificates: %v", err)
+	}
+	// Rotated certificates are served to new handshakes without a restart
+	if err := certStore.Watch(); err != nil {
+		sugar.Fatalf("Error watching certificates: %v", err)
+	}
 
-		// Specify secure and performant cipher suites for TLS 1.2 (if needed)
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-		},
+	// Versions, cipher suites, curves and ALPN of the configured policy, intermediate by default
+	tlsConfig, err := tlsconfig.NewServerConfig(config.LoadBalancer.TLS)
+	if err != nil {
+		sugar.Fatalf("Error creating TLS config: %v", err)
 	}
+	tlsConfig.GetCertificate = certStore.GetCertificate // select the certificate by SNI
 
-	server := &http.Server{
-		Addr:      config.LoadBalancer.Address,
-		Handler:   httphandler.NewMiddleware(rateLimiter, router, logger),
-		TLSConfig: tlsConfig,
+	// Session tickets are encrypted with shared keys so replicas resume each other's sessions, otherwise
+	// every replica rotates keys of its own
+	if keyFile := config.LoadBalancer.TLS.SessionTicketKeyFile; keyFile != "" {
+		if _, err := tlsconfig.WatchSessionTicketKeys(tlsConfig, keyFile, logger); err != nil {
+			sugar.Fatalf("Error loading session ticket keys: %v", err)
+		}
 	}
 
-	sugar.Infof("Load Balancer started at %s", config.LoadBalancer.Address)
-	sugar.Fatal(server.ListenAndServeTLS(config.LoadBalancer.CertFile, config.LoadBalancer.KeyFile))
+	// Client certificates are verified in the mode of the server name, routes may require them
+	if err := certStore.ConfigureClientAuth(tlsConfig, config.LoadBalancer.ClientAuth); err != nil {
+		sugar.Fatalf("Error configuring client certificates: %v", err)
+	}
+	if config.LoadBalancer.ACME != nil {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, tlsconfig.ACMEProto) // TLS-ALPN-01 challenges
+	}
+	return certStore, tlsConfig
 }
@@ -8,9 +8,10 @@ var (
 )
 
 type Backend struct {
-	Id     uint64
-	URL    string
-	Health string
+	Id            uint64
+	URL           string
+	Health        string
+	ProxyProtocol bool // connections start with a PROXY header, health checks send a LOCAL one
 }
 
 func NewBackend(url string, health string) *Backend {
@@ -0,0 +1,16 @@
+package domain
+
+import "context"
+
+type clientIPContextKey struct{}
+
+// WithClientIP records the resolved IP of the client that sent a request, which may sit behind proxies
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey{}, ip)
+}
+
+// ClientIP returns the resolved client IP of the request context, if any
+func ClientIP(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(clientIPContextKey{}).(string)
+	return ip, ok
+}
@@ -1,9 +1,38 @@
 package domain
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type RateLimiter interface {
-	IsAllowed(ip string) bool           // Allow or reject a request based on IP
-	GetState() map[string]int           // Get the current state of the rate limiter
-	GetRateLimit() (int, time.Duration) // Returns the request limit and the time window
+	IsAllowed(descriptor Descriptor) bool // Allow or reject a request based on its descriptor
+	GetState() map[string]int             // Get the current state of the rate limiter, keyed by descriptor
+	GetRateLimit() (int, time.Duration)   // Returns the request limit and the time window
+	// Returns the requests left for the descriptor, and the time until its quota resets or,
+	// when no requests are left, until the next request is allowed
+	GetQuota(descriptor Descriptor) (int, time.Duration)
+}
+
+// DescriptorEntry is one property of a request that a rate limit is keyed on, e.g. remote_address=10.0.0.1
+type DescriptorEntry struct {
+	Key   string
+	Value string
+}
+
+// Descriptor identifies the counter a request is rate limited against, requests with equal descriptors share a quota
+type Descriptor []DescriptorEntry
+
+// Key returns the descriptor as a string, e.g. "route=/apiA|remote_address=10.0.0.1"
+func (d Descriptor) Key() string {
+	var key strings.Builder
+	for i, entry := range d {
+		if i > 0 {
+			key.WriteByte('|')
+		}
+		key.WriteString(entry.Key)
+		key.WriteByte('=')
+		key.WriteString(entry.Value)
+	}
+	return key.String()
 }
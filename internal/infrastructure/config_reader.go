@@ -3,10 +3,32 @@ package infrastructure
 import (
 	"fmt"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 func LoadConfig(configFile string) (*Config, error) {
+	v, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalConfig(v)
+}
+
+// WatchConfig calls onChange with the re-read config every time the config file is modified
+func WatchConfig(configFile string, onChange func(*Config, error)) error {
+	v, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+	v.OnConfigChange(func(fsnotify.Event) {
+		onChange(unmarshalConfig(v))
+	})
+	v.WatchConfig()
+	return nil
+}
+
+func readConfig(configFile string) (*viper.Viper, error) {
 	v := viper.New()
 	v.SetConfigName(configFile) // name of config file (without extension)
 	v.AddConfigPath("./config")
@@ -17,6 +39,10 @@ func LoadConfig(configFile string) (*Config, error) {
 			return nil, fmt.Errorf("unable to parse config.file: %w", err)
 		}
 	}
+	return v, nil
+}
+
+func unmarshalConfig(v *viper.Viper) (*Config, error) {
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
@@ -2,10 +2,93 @@ package infrastructure
 
 // Route holds the backends for each route
 type Route struct {
-	Path     string
+	Path           string
+	Backends       []Backend       `mapstructure:"backends"`
+	Pools          []Pool          `mapstructure:"pools"`           // weighted backend pools, used instead of backends for traffic splitting
+	OverrideHeader string          `mapstructure:"override_header"` // request header that pins a request to a named pool
+	OverrideCookie string          `mapstructure:"override_cookie"` // cookie that pins a request to a named pool
+	Mirror         *Mirror         `mapstructure:"mirror"`
+	Retry          *RetryPolicy    `mapstructure:"retry"`
+	Hedge          *Hedge          `mapstructure:"hedge"` // opt-in, only applies to idempotent methods
+	Timeouts       *Timeouts       `mapstructure:"timeouts"`
+	Concurrency    *Concurrency    `mapstructure:"concurrency"`    // caps in-flight requests of every pool of the route
+	RateLimits     []RateLimiter   `mapstructure:"rate_limits"`    // replace the default [rateLimiter] for this route
+	AccessControl  *AccessControl  `mapstructure:"access_control"` // applies on top of the global [accessControl]
+	ClientCert     *ClientCertRule `mapstructure:"client_cert"`    // client certificates the route accepts, see loadbalancer.client_auth
+	// Send a PROXY v2 header with the client's address on every backend connection. Backends must expect
+	// it, health checks are sent without one.
+	SendProxyProtocol bool `mapstructure:"send_proxy_protocol"`
+}
+
+// BackendPools returns the pools of the route, a route with plain backends has a single default pool
+func (r Route) BackendPools() []Pool {
+	if len(r.Pools) > 0 {
+		return r.Pools
+	}
+	return []Pool{{Name: DefaultPoolName, Weight: 100, Backends: r.Backends}}
+}
+
+// DefaultPoolName is the name of the pool created for routes that list backends directly
+const DefaultPoolName = "default"
+
+// Pool holds a named group of backends that receives a percentage of a route's traffic
+type Pool struct {
+	Name     string    `mapstructure:"name"`
+	Weight   int       `mapstructure:"weight"`   // percentage of route traffic sent to this pool
+	Strategy string    `mapstructure:"strategy"` // e.g. "round_robin", defaults to round robin
 	Backends []Backend `mapstructure:"backends"`
 }
 
+// Mirror holds the pool that receives a sampled copy of a route's traffic
+type Mirror struct {
+	SampleRate    float64   `mapstructure:"sample_rate"`    // fraction of requests mirrored, between 0 and 1
+	MaxConcurrent int       `mapstructure:"max_concurrent"` // mirrored requests in flight before new copies are dropped
+	Strategy      string    `mapstructure:"strategy"`
+	Backends      []Backend `mapstructure:"backends"`
+}
+
+// RetryPolicy holds the retry behaviour of a route, unset fields use the defaults
+type RetryPolicy struct {
+	MaxAttempts          int      `mapstructure:"max_attempts"`           // total attempts, including the first one
+	RetryOn              []string `mapstructure:"retry_on"`               // e.g. "connect-failure", "reset", "timeout", "5xx", "429", "retriable-status-codes"
+	RetriableStatusCodes []int    `mapstructure:"retriable_status_codes"` // used with "retriable-status-codes"
+	Methods              []string `mapstructure:"methods"`                // methods allowed to retry, idempotent methods by default
+	PerTryTimeout        string   `mapstructure:"per_try_timeout"`
+	BaseInterval         string   `mapstructure:"base_interval"` // base of the exponential backoff
+	MaxInterval          string   `mapstructure:"max_interval"`
+	BudgetPercent        *float64 `mapstructure:"budget_percent"`        // retries allowed as a percentage of active requests, 0 allows only min_retry_concurrency
+	MinRetryConcurrency  int      `mapstructure:"min_retry_concurrency"` // retries always allowed regardless of the budget
+}
+
+// Hedge holds when a second attempt is raced against a slow first attempt of a route
+type Hedge struct {
+	Delay           string  `mapstructure:"delay"`             // time without response headers before hedging, defaults to 100ms
+	Percentile      float64 `mapstructure:"percentile"`        // learn the delay as this percentile of observed latencies, e.g. 0.95
+	MaxHedgePercent float64 `mapstructure:"max_hedge_percent"` // hedged requests allowed as a percentage of requests, defaults to 10
+}
+
+// Timeouts holds the upstream deadlines of a route
+type Timeouts struct {
+	Connect        string `mapstructure:"connect"`         // dialing a backend
+	Request        string `mapstructure:"request"`         // a single backend request, defaults to 10s
+	Idle           string `mapstructure:"idle"`            // idle backend connections are closed after this
+	Overall        string `mapstructure:"overall"`         // the whole request including retries and backoff
+	DeadlineHeader string `mapstructure:"deadline_header"` // client header with a shorter deadline, e.g. "grpc-timeout"
+}
+
+// Concurrency caps the requests a load balancer has in flight, shedding load before backends are overloaded
+type Concurrency struct {
+	MaxInFlight  int    `mapstructure:"max_in_flight"` // fixed limit, or the initial limit when adaptive
+	MaxQueue     int    `mapstructure:"max_queue"`     // requests waiting for a slot, further requests are rejected right away
+	QueueTimeout string `mapstructure:"queue_timeout"` // longest wait for a slot, defaults to 1s
+	// Tune the limit from upstream latency: "aimd" backs off when requests fail or exceed latency_threshold,
+	// "gradient" backs off as latency grows over its long term average. Fixed when empty.
+	Adaptive         string `mapstructure:"adaptive"`
+	MinLimit         int    `mapstructure:"min_limit"`         // defaults to 1
+	MaxLimit         int    `mapstructure:"max_limit"`         // defaults to 1000
+	LatencyThreshold string `mapstructure:"latency_threshold"` // only for aimd
+}
+
 // Backend holds the individual backend server configuration
 type Backend struct {
 	URL    string `mapstructure:"url"`
@@ -14,16 +97,179 @@ type Backend struct {
 
 // RateLimiter defines the structure for rate limiter configuration
 type RateLimiter struct {
-	Type   string `mapstructure:"type"`   // e.g. "none", "sliding_window", "token_bucket"
-	Limit  int    `mapstructure:"limit"`  // request limit for the time window/bucket
-	Window string `mapstructure:"window"` // only for window-based rate limiters
+	Type    string   `mapstructure:"type"`    // e.g. "none", "fixed_window", "sliding_window_log", "sliding_window_counter", "token_bucket"
+	Limit   int      `mapstructure:"limit"`   // request limit for the time window/bucket
+	Window  string   `mapstructure:"window"`  // window of the limit, for token buckets the refill rate is limit per window
+	Burst   int      `mapstructure:"burst"`   // only for token bucket, bucket capacity, defaults to limit
+	Key     []string `mapstructure:"key"`     // descriptor the limit counts by, e.g. ["remote_address"], ["header:X-API-Key"], ["jwt:sub"], ["route", "remote_address"]
+	Methods []string `mapstructure:"methods"` // only limit these methods, all methods when empty
+	Store   string   `mapstructure:"store"`   // "memory" (default) counts per replica, "redis" shares the count through the rateLimitStore
+	// Bounds on the limiter's memory, descriptors beyond max_keys evict the least recently used one
+	// and descriptors idle for key_ttl are dropped. Default to 100000 keys and a TTL of the window.
+	// max_keys is split across up to 64 shards of at least 16 keys, each evicting once it holds its share.
+	MaxKeys    int    `mapstructure:"max_keys"`
+	KeyTTL     string `mapstructure:"key_ttl"`
+	IPv6Prefix int    `mapstructure:"ipv6_prefix"` // client IPv6 addresses are counted per prefix of this length, defaults to 64
+}
+
+// AccessControl admits or refuses requests by client IP range, IPv4 or IPv6 CIDRs or single addresses.
+// Denied ranges take precedence, and once any allowed range is set only allowed clients are admitted.
+type AccessControl struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+	// Files with more ranges, one per line, with "#" comments. They are reloaded when they change,
+	// and a file that fails to load keeps its previous ranges.
+	AllowFile string `mapstructure:"allow_file"`
+	DenyFile  string `mapstructure:"deny_file"`
+}
+
+// RateLimitStore is the Redis-protocol store that replicas share rate limit counts through
+type RateLimitStore struct {
+	Address   string `mapstructure:"address"` // host:port, the store is disabled when empty
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+	DB        int    `mapstructure:"db"`
+	KeyPrefix string `mapstructure:"key_prefix"` // defaults to "l7lb:ratelimit:"
+	Timeout   string `mapstructure:"timeout"`    // per round trip, defaults to 50ms
+	// What limiters do while the store is unreachable: "open" allows requests (default), "closed" rejects
+	// them and "local" counts them per replica.
+	FailureMode string `mapstructure:"failure_mode"`
+	// Requests reserved per round trip and counted locally, trading accuracy across replicas for fewer round
+	// trips. Unused reservations are dropped after batch_ttl. Default to 1 and 1s.
+	BatchSize int    `mapstructure:"batch_size"`
+	BatchTTL  string `mapstructure:"batch_ttl"`
+}
+
+// RateLimitResponse defines the body of requests rejected by a rate limiter
+type RateLimitResponse struct {
+	Format      string `mapstructure:"format"`       // "text", "problem_json" or "custom", defaults to text
+	Body        string `mapstructure:"body"`         // only for custom
+	ContentType string `mapstructure:"content_type"` // only for custom
 }
 
 // LoadBalancer holds the load balancer address
 type LoadBalancer struct {
-	Address  string `mapstructure:"address"`
+	Address  string `mapstructure:"address"`   // of the HTTPS listener when no listeners are listed
+	CertFile string `mapstructure:"cert_file"` // served when no certificates are listed
+	KeyFile  string `mapstructure:"key_file"`
+	// Certificates selected by the server name (SNI) clients ask for
+	Certificates []Certificate `mapstructure:"certificates"`
+	// Directory of more certificates, every "<name>.crt" or "<name>.pem" with a "<name>.key" next to it,
+	// served for their DNS names. Certificates are reloaded when their files change.
+	CertDir           string       `mapstructure:"cert_dir"`
+	CertExpiryWarning string       `mapstructure:"cert_expiry_warning"` // warn about certificates expiring within this, defaults to 720h
+	ACME              *ACME        `mapstructure:"acme"`                // obtain and renew certificates from an ACME CA
+	ClientAuth        ClientAuth   `mapstructure:"client_auth"`
+	TLS               TLSPolicy    `mapstructure:"tls"`
+	OCSP              OCSPStapling `mapstructure:"ocsp"`
+	// CIDRs of proxies in front of the load balancer, e.g. a cloud L4 balancer or CDN. The client IP is only
+	// taken from client_ip_headers of requests sent by a trusted proxy.
+	TrustedProxies  []string `mapstructure:"trusted_proxies"`
+	ClientIPHeaders []string `mapstructure:"client_ip_headers"` // "X-Forwarded-For", "Forwarded" or "X-Real-IP" in order of preference, defaults to X-Forwarded-For
+	// Whether connections start with a PROXY protocol header, "off" (default), "optional" or "required".
+	// Headers are only read from proxy_protocol_trusted CIDRs, which are required when enabled.
+	ProxyProtocol        string   `mapstructure:"proxy_protocol"`
+	ProxyProtocolTrusted []string `mapstructure:"proxy_protocol_trusted"`
+	// Listeners, each with its own protocol, routes and timeouts. Defaults to an HTTPS listener on address.
+	Listeners []Listener `mapstructure:"listeners"`
+	HTTP3     bool       `mapstructure:"http3"` // of the HTTPS listener when no listeners are listed, see Listener
+	Shutdown  Shutdown   `mapstructure:"shutdown"`
+}
+
+// Shutdown drains the listeners on SIGTERM or SIGINT: readiness checks fail first, then the listeners stop
+// accepting connections and in-flight requests get the drain timeout to complete. On SIGUSR2 the binary is
+// started again with the listening sockets, and the old process drains once the new one serves.
+type Shutdown struct {
+	DrainTimeout   string `mapstructure:"drain_timeout"`   // defaults to 30s
+	ReadinessPath  string `mapstructure:"readiness_path"`  // served on every listener, e.g. "/ready"
+	ReadinessDelay string `mapstructure:"readiness_delay"` // between failing readiness and closing the listeners, e.g. "5s"
+	UpgradeTimeout string `mapstructure:"upgrade_timeout"` // for the new process to serve before the upgrade fails, defaults to 30s
+	PIDFile        string `mapstructure:"pid_file"`        // rewritten by the new process, so supervisors follow upgrades
+}
+
+// Listener accepts connections on an address for a subset of the routes
+type Listener struct {
+	Address  string   `mapstructure:"address"`
+	Protocol string   `mapstructure:"protocol"` // "http", "h2c" (HTTP/2 without TLS) or "https" (default)
+	Routes   []string `mapstructure:"routes"`   // routes served on the listener, all routes when empty
+	// Also serve HTTP/3 on the same UDP port, advertised to HTTP/1.1 and HTTP/2 clients by Alt-Svc. HTTPS only.
+	HTTP3 bool `mapstructure:"http3"`
+	// Server timeouts, read_header_timeout defaults to 10s and idle_timeout to 120s, read and write timeouts
+	// are unset by default
+	ReadTimeout       string `mapstructure:"read_timeout"`
+	ReadHeaderTimeout string `mapstructure:"read_header_timeout"`
+	WriteTimeout      string `mapstructure:"write_timeout"`
+	IdleTimeout       string `mapstructure:"idle_timeout"`
+}
+
+// Certificate is a certificate served for the server names it covers
+type Certificate struct {
 	CertFile string `mapstructure:"cert_file"`
 	KeyFile  string `mapstructure:"key_file"`
+	// Server names the certificate is served for, e.g. "api.example.com" or "*.example.com". Default to
+	// the DNS names of the certificate.
+	Names []string `mapstructure:"names"`
+	// Served to clients asking for a name no certificate covers, or for none. The first certificate when
+	// none is the default.
+	Default    bool     `mapstructure:"default"`
+	Routes     []string `mapstructure:"routes"`      // routes reachable through these names, all routes when empty
+	ClientAuth string   `mapstructure:"client_auth"` // client certificate mode of these names, overrides client_auth.mode
+}
+
+// TLSPolicy holds the protocol versions and algorithms the TLS listener accepts. Fields that are set
+// override the preset.
+type TLSPolicy struct {
+	Preset       string   `mapstructure:"preset"`        // "modern" (TLS 1.3 only) or "intermediate" (default, also TLS 1.2)
+	MinVersion   string   `mapstructure:"min_version"`   // "1.2" or "1.3"
+	MaxVersion   string   `mapstructure:"max_version"`   // defaults to "1.3"
+	CipherSuites []string `mapstructure:"cipher_suites"` // TLS 1.2 suites by their Go name, TLS 1.3 suites are not configurable
+	Curves       []string `mapstructure:"curves"`        // "X25519", "P256", "P384" or "P521" in order of preference
+	ALPN         []string `mapstructure:"alpn"`          // defaults to ["h2", "http/1.1"]
+	// Shared session ticket keys, so replicas resume each other's sessions. One base64 or hex encoded
+	// 32 byte key per line, the first encrypts new tickets and all of them decrypt. The file is reloaded when
+	// it changes. Without it every replica rotates its own keys daily.
+	SessionTicketKeyFile string `mapstructure:"session_ticket_key_file"`
+}
+
+// OCSPStapling staples OCSP responses to the served certificates, fetched in the background from the
+// responder named in each certificate. Certificate files must include the issuer after the leaf.
+type OCSPStapling struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	ResponderURL string `mapstructure:"responder_url"` // overrides the responder of every certificate, e.g. a local stand-in
+}
+
+// ClientAuth verifies client certificates on the TLS listener against a CA bundle, and passes the identity
+// of verified clients to backends in headers
+type ClientAuth struct {
+	// "none" (default), "request" verifies certificates clients choose to send, "require" refuses clients
+	// without a valid certificate
+	Mode              string `mapstructure:"mode"`
+	CAFile            string `mapstructure:"ca_file"`
+	SubjectHeader     string `mapstructure:"subject_header"`     // defaults to X-Client-Cert-Subject
+	SANsHeader        string `mapstructure:"sans_header"`        // defaults to X-Client-Cert-SANs
+	FingerprintHeader string `mapstructure:"fingerprint_header"` // SHA-256 of the certificate, defaults to X-Client-Cert-Fingerprint
+}
+
+// ClientCertRule admits requests to a route by their verified client certificate. Patterns may use
+// wildcards, e.g. "CN=*,OU=payments,O=Corp" or "spiffe://corp/ns/payments/*", and any match admits.
+type ClientCertRule struct {
+	Required bool     `mapstructure:"required"` // implied by subjects and sans
+	Subjects []string `mapstructure:"subjects"`
+	SANs     []string `mapstructure:"sans"`
+}
+
+// ACME holds the certificates obtained from an ACME CA such as Let's Encrypt, for the listed domains only
+type ACME struct {
+	Domains      []string `mapstructure:"domains"`
+	Email        string   `mapstructure:"email"`         // contact for expiry and problem notices
+	DirectoryURL string   `mapstructure:"directory_url"` // defaults to Let's Encrypt production
+	CACertFile   string   `mapstructure:"ca_cert_file"`  // trusted for a private CA's directory, e.g. Pebble in tests
+	CacheDir     string   `mapstructure:"cache_dir"`     // account key and certificates, defaults to "acme-cache"
+	RenewBefore  string   `mapstructure:"renew_before"`  // defaults to 720h before expiry
+	// Plain HTTP listener answering HTTP-01 challenges and redirecting everything else to HTTPS, e.g. ":80".
+	// Configured http and h2c listeners answer HTTP-01 challenges too, and take the address over when they
+	// share it. Without either only TLS-ALPN-01 challenges, answered on the TLS listener, are used.
+	HTTPAddress string `mapstructure:"http_address"`
 }
 
 // Healthchecker holds the health checker info
@@ -33,8 +279,12 @@ type HealthChecker struct {
 }
 
 type Config struct {
-	Routes        []Route       `mapstructure:"routes"`
-	RateLimiter   RateLimiter   `mapstructure:"rateLimiter"`
-	LoadBalancer  LoadBalancer  `mapstructure:"loadbalancer"`
-	HealthChecker HealthChecker `mapstructure:"healthchecker"`
+	Routes            []Route           `mapstructure:"routes"`
+	RateLimiter       RateLimiter       `mapstructure:"rateLimiter"` // default limit of every route without its own rate_limits
+	RateLimits        []RateLimiter     `mapstructure:"rateLimits"`  // global limits shared by all routes, a request must pass all of them
+	RateLimitResponse RateLimitResponse `mapstructure:"rateLimitResponse"`
+	RateLimitStore    RateLimitStore    `mapstructure:"rateLimitStore"`
+	AccessControl     AccessControl     `mapstructure:"accessControl"` // applies to all routes
+	LoadBalancer      LoadBalancer      `mapstructure:"loadbalancer"`
+	HealthChecker     HealthChecker     `mapstructure:"healthchecker"`
 }
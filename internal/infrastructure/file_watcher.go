@@ -0,0 +1,55 @@
+package infrastructure
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileSettleDelay is how long a file must go without changes before it is re-read, a file is often written
+// in several steps, e.g. truncated first, and must not be read half written
+const fileSettleDelay = 100 * time.Millisecond
+
+// WatchFile calls onChange every time the file is written or replaced, until the returned watcher is closed.
+// The directory is watched rather than the file, so files replaced by a rename, as editors and deploy tools
+// do, keep being watched.
+func WatchFile(path string, onChange func()) (*fsnotify.Watcher, error) {
+	path = filepath.Clean(path)
+	return watch(filepath.Dir(path), func(event fsnotify.Event) bool {
+		return filepath.Clean(event.Name) == path && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+	}, onChange)
+}
+
+// WatchDir calls onChange every time a file of the directory is written, added, removed or renamed
+func WatchDir(dir string, onChange func()) (*fsnotify.Watcher, error) {
+	return watch(dir, func(event fsnotify.Event) bool { return event.Op != fsnotify.Chmod }, onChange)
+}
+
+// watch calls onChange once matching events of the directory have settled
+func watch(dir string, match func(fsnotify.Event) bool, onChange func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	go func() {
+		settle := time.AfterFunc(time.Hour, onChange)
+		settle.Stop()
+		for event := range watcher.Events {
+			if match(event) {
+				settle.Reset(fileSettleDelay)
+			}
+		}
+		settle.Stop()
+	}()
+	go func() {
+		for range watcher.Errors { // drained so the watcher does not block, events keep flowing after an error
+		}
+	}()
+	return watcher, nil
+}
@@ -0,0 +1,232 @@
+// Package handoff passes the listening sockets and the backend health of a running load balancer to a new
+// process, so a binary upgrade or restart never leaves a moment where no process listens
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// envState carries the handed over state to the new process. Its sockets are inherited as the file
+// descriptors from 3 on in the listed order, followed by the pipe telling the previous process it is ready.
+const envState = "L7LB_HANDOFF"
+
+const firstFD = 3
+
+type state struct {
+	Sockets []string `json:"sockets"` // "tcp <address>" or "udp <address>", by the configured address
+	Healthy []string `json:"healthy"` // URLs of the backends the previous process found healthy
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Sockets opens the listening sockets of the process, taking over those of the previous process on a hot
+// restart, and hands them over to the next one
+type Sockets struct {
+	command []string // started by Upgrade, the running binary's path and arguments by default
+
+	mu        sync.Mutex
+	inherited map[string]*os.File // by socket key, until claimed
+	active    []activeSocket
+	healthy   []string
+	ready     *os.File // nil on a cold start
+}
+
+type activeSocket struct {
+	key    string
+	socket filer
+}
+
+// Inherit takes over the state handed over by the previous process, if any
+func Inherit() (*Sockets, error) {
+	s := &Sockets{command: os.Args, inherited: make(map[string]*os.File)}
+	encoded, ok := os.LookupEnv(envState)
+	if !ok {
+		return s, nil
+	}
+	os.Unsetenv(envState)
+	var handedOver state
+	if err := json.Unmarshal([]byte(encoded), &handedOver); err != nil {
+		return nil, fmt.Errorf("handoff: invalid state: %w", err)
+	}
+	for i, key := range handedOver.Sockets {
+		s.inherited[key] = os.NewFile(uintptr(firstFD+i), key)
+	}
+	s.healthy = handedOver.Healthy
+	s.ready = os.NewFile(uintptr(firstFD+len(handedOver.Sockets)), "ready")
+	return s, nil
+}
+
+// Inherited reports whether the process took over from a previous one
+func (s *Sockets) Inherited() bool {
+	return s.ready != nil
+}
+
+// Healthy returns the URLs of the backends the previous process found healthy
+func (s *Sockets) Healthy() []string {
+	return s.healthy
+}
+
+// Listen returns a TCP listener on the address, the previous process's socket when it had one
+func (s *Sockets) Listen(address string) (net.Listener, error) {
+	key := "tcp " + address
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var listener net.Listener
+	var err error
+	if file, ok := s.inherited[key]; ok {
+		delete(s.inherited, key)
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.active = append(s.active, activeSocket{key: key, socket: listener.(filer)})
+	return listener, nil
+}
+
+// ListenPacket returns a UDP socket on the address, the previous process's socket when it had one
+func (s *Sockets) ListenPacket(address string) (net.PacketConn, error) {
+	key := "udp " + address
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conn net.PacketConn
+	var err error
+	if file, ok := s.inherited[key]; ok {
+		delete(s.inherited, key)
+		conn, err = net.FilePacketConn(file)
+		file.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.active = append(s.active, activeSocket{key: key, socket: conn.(filer)})
+	return conn, nil
+}
+
+// Ready tells the previous process that this one serves, so it drains and exits. Sockets the previous
+// process had but this one does not listen on are closed.
+func (s *Sockets) Ready() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, file := range s.inherited {
+		file.Close()
+		delete(s.inherited, key)
+	}
+	if s.ready == nil {
+		return nil
+	}
+	_, err := s.ready.Write([]byte{1})
+	s.ready.Close()
+	s.ready = nil
+	return err
+}
+
+// Upgrade starts the binary again, from its path so a replaced binary is the one started, and hands it the
+// listening sockets and the healthy backends. It returns once the new process is ready to serve, after which
+// this process should drain and exit, or with an error, in which case this process keeps serving.
+func (s *Sockets) Upgrade(healthy []string, timeout time.Duration) error {
+	path, err := exec.LookPath(s.command[0])
+	if err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	defer readyReader.Close()
+	files, handedOver, err := s.files(healthy)
+	files = append(files, readyWriter)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(handedOver)
+	if err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	// Not os/exec, which switches the descriptors it passes to blocking mode, and with them the sockets
+	// this process still accepts on
+	fds := []uintptr{0, 1, 2}
+	for _, file := range files {
+		fd, err := rawFD(file)
+		if err != nil {
+			return fmt.Errorf("handoff: %w", err)
+		}
+		fds = append(fds, fd)
+	}
+	pid, err := syscall.ForkExec(path, s.command, &syscall.ProcAttr{
+		Env:   append(os.Environ(), envState+"="+string(encoded)),
+		Files: fds,
+	})
+	if err != nil {
+		return fmt.Errorf("handoff: starting the new process: %w", err)
+	}
+	readyWriter.Close() // only the new process holds it now, so the read ends when it exits
+	process, _ := os.FindProcess(pid)
+	exited := make(chan error, 1)
+	go func() {
+		state, err := process.Wait()
+		if err == nil && !state.Success() {
+			err = errors.New(state.String())
+		}
+		exited <- err
+	}()
+
+	readyReader.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		process.Kill()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("handoff: new process exited before it was ready: %w", <-exited)
+		}
+		return fmt.Errorf("handoff: new process not ready: %w", err)
+	}
+	return nil
+}
+
+// files duplicates the active sockets for the new process
+func (s *Sockets) files(healthy []string) ([]*os.File, state, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handedOver := state{Healthy: healthy}
+	var files []*os.File
+	for _, active := range s.active {
+		file, err := active.socket.File()
+		if err != nil {
+			return files, handedOver, fmt.Errorf("handoff: socket %s: %w", active.key, err)
+		}
+		files = append(files, file)
+		handedOver.Sockets = append(handedOver.Sockets, active.key)
+	}
+	return files, handedOver, nil
+}
+
+// rawFD returns the descriptor of the file without the switch to blocking mode of File.Fd
+func rawFD(file *os.File) (uintptr, error) {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd uintptr
+	err = conn.Control(func(raw uintptr) { fd = raw })
+	return fd, err
+}
@@ -0,0 +1,115 @@
+package handoff
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const helperAddress = "127.0.0.1:0"
+
+// TestHelperProcess is the new process started by the upgrade tests. It serves the healthy backends it took
+// over on the inherited socket until asked to quit.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("HANDOFF_HELPER") {
+	case "serve":
+	case "fail":
+		os.Exit(1)
+	default:
+		return
+	}
+	sockets, err := Inherit()
+	if err != nil {
+		os.Exit(2)
+	}
+	listener, err := sockets.Listen(helperAddress)
+	if err != nil {
+		os.Exit(3)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quit" {
+			defer time.AfterFunc(100*time.Millisecond, func() { os.Exit(0) })
+		}
+		w.Write([]byte(strings.Join(sockets.Healthy(), ",")))
+	}))
+	if err := sockets.Ready(); err != nil {
+		os.Exit(4)
+	}
+	time.Sleep(10 * time.Second)
+	os.Exit(5)
+}
+
+func helperSockets(t *testing.T, mode string) *Sockets {
+	t.Helper()
+	t.Setenv("HANDOFF_HELPER", mode)
+	sockets, err := Inherit()
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	sockets.command = []string{os.Args[0], "-test.run=^TestHelperProcess$"}
+	return sockets
+}
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestUpgrade(t *testing.T) {
+	sockets := helperSockets(t, "serve")
+	if sockets.Inherited() {
+		t.Fatalf("Expected a cold start")
+	}
+	listener, err := sockets.Listen(helperAddress)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	url := "http://" + listener.Addr().String()
+
+	if err := sockets.Upgrade([]string{"http://backend-1", "http://backend-2"}, 5*time.Second); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	// This process stops accepting, the new one serves on the same socket with the health handed over
+	listener.Close()
+	if body := get(t, url); body != "http://backend-1,http://backend-2" {
+		t.Errorf("Expected the new process to serve the handed over backends, got %q", body)
+	}
+	get(t, url+"/quit")
+}
+
+func TestUpgrade_NewProcessFails(t *testing.T) {
+	sockets := helperSockets(t, "fail")
+	listener, err := sockets.Listen(helperAddress)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("old"))
+	}))
+
+	if err := sockets.Upgrade(nil, 5*time.Second); err == nil {
+		t.Fatalf("Expected the upgrade to fail when the new process exits")
+	}
+	// The old process keeps serving
+	if body := get(t, "http://"+listener.Addr().String()); body != "old" {
+		t.Errorf("Expected the old process to keep serving, got %q", body)
+	}
+}
+
+func TestInherit_InvalidState(t *testing.T) {
+	t.Setenv(envState, "sockets")
+	if _, err := Inherit(); err == nil {
+		t.Errorf("Expected an invalid state to be rejected")
+	}
+}
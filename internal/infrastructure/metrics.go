@@ -0,0 +1,31 @@
+package infrastructure
+
+import (
+	"expvar"
+	"sync"
+)
+
+var metricsMu sync.Mutex
+
+// MetricsMap returns the published expvar map with the given name, creating it on first use.
+// Metrics are served as JSON at /debug/vars on the debug listener.
+func MetricsMap(name string) *expvar.Map {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
+
+// SubMetricsMap returns the map stored under key in parent, creating it on first use
+func SubMetricsMap(parent *expvar.Map, key string) *expvar.Map {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if v, ok := parent.Get(key).(*expvar.Map); ok {
+		return v
+	}
+	m := new(expvar.Map)
+	parent.Set(key, m)
+	return m
+}
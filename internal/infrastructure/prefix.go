@@ -0,0 +1,19 @@
+package infrastructure
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefix parses a CIDR, or a single address as a prefix of its full length
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	if strings.Contains(cidr, "/") {
+		prefix, err := netip.ParsePrefix(cidr)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
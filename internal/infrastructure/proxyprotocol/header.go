@@ -0,0 +1,211 @@
+// Package proxyprotocol implements the HAProxy PROXY protocol, versions 1 and 2, which L4 proxies use to
+// pass the original client and destination addresses of a TCP connection to the next hop.
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoHeader      = errors.New("proxy protocol: no header")
+	ErrInvalidHeader = errors.New("proxy protocol: invalid header")
+)
+
+const (
+	v1MaxLength = 107 // including the trailing CRLF
+
+	v2CommandLocal = 0x20 // health checks of the proxy itself, the connection's own addresses apply
+	v2CommandProxy = 0x21
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+	v2AddrLenTCP4  = 12
+	v2AddrLenTCP6  = 36
+)
+
+// Header holds the addresses of the original connection. Both are invalid for headers that do not carry
+// addresses, e.g. v1 UNKNOWN or v2 LOCAL, in which case the connection's own addresses apply.
+type Header struct {
+	Version     int
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// ReadHeader reads a v1 or v2 header from the start of a connection. It returns ErrNoHeader, without
+// consuming anything, when the connection does not start with a header.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		if !hasPrefix(r, v1Prefix) {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		if !hasPrefix(r, v2Signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// hasPrefix peeks no further than needed to tell whether the connection starts with the prefix
+func hasPrefix(r *bufio.Reader, prefix []byte) bool {
+	for n := 2; n <= len(prefix); n++ {
+		peeked, err := r.Peek(n)
+		if err != nil || !bytes.Equal(peeked, prefix[:n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readV1 parses e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not terminated", ErrInvalidHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidHeader, line)
+	}
+	var err error
+	if header.Source, err = parseV1Address(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if header.Destination, err = parseV1Address(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	if header.Source.Addr().Is4() != (fields[1] == "TCP4") || header.Destination.Addr().Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: v1 addresses do not match %s", ErrInvalidHeader, fields[1])
+	}
+	return header, nil
+}
+
+func parseV1Address(ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// readV2 parses the binary header: signature, version and command, family, length, addresses and TLVs
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	command, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	header := &Header{Version: 2}
+	switch command {
+	case v2CommandLocal:
+		return header, nil
+	case v2CommandProxy:
+	default:
+		return nil, fmt.Errorf("%w: unsupported v2 command %#x", ErrInvalidHeader, command)
+	}
+	switch family {
+	case v2FamilyTCP4:
+		if length < v2AddrLenTCP4 {
+			return nil, fmt.Errorf("%w: short v2 IPv4 addresses", ErrInvalidHeader)
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:10]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[4:8])), binary.BigEndian.Uint16(payload[10:12]))
+	case v2FamilyTCP6:
+		if length < v2AddrLenTCP6 {
+			return nil, fmt.Errorf("%w: short v2 IPv6 addresses", ErrInvalidHeader)
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:34]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[16:32])), binary.BigEndian.Uint16(payload[34:36]))
+	default:
+		// UDP and unix sockets are not proxied by an HTTP load balancer, keep the connection's own addresses
+	}
+	return header, nil // TLVs after the addresses are skipped
+}
+
+// AppendV2 appends a v2 PROXY header for a TCP connection from source to destination. Mixed families are sent
+// as IPv6, with the IPv4 address mapped.
+func AppendV2(buf []byte, source, destination netip.AddrPort) []byte {
+	buf = append(buf, v2Signature...)
+	src, dst := source.Addr().Unmap(), destination.Addr().Unmap()
+	if !src.IsValid() || !dst.IsValid() {
+		return append(buf, v2CommandLocal, 0, 0, 0)
+	}
+	if src.Is4() && dst.Is4() {
+		buf = append(buf, v2CommandProxy, v2FamilyTCP4)
+		buf = binary.BigEndian.AppendUint16(buf, v2AddrLenTCP4)
+		buf = append(buf, src.AsSlice()...)
+		buf = append(buf, dst.AsSlice()...)
+	} else {
+		buf = append(buf, v2CommandProxy, v2FamilyTCP6)
+		buf = binary.BigEndian.AppendUint16(buf, v2AddrLenTCP6)
+		src16, dst16 := src.As16(), dst.As16()
+		buf = append(buf, src16[:]...)
+		buf = append(buf, dst16[:]...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, source.Port())
+	return binary.BigEndian.AppendUint16(buf, destination.Port())
+}
+
+// AppendV1 appends a v1 PROXY header for a TCP connection from source to destination
+func AppendV1(buf []byte, source, destination netip.AddrPort) []byte {
+	src, dst := source.Addr().Unmap(), destination.Addr().Unmap()
+	if !src.IsValid() || !dst.IsValid() || src.Is4() != dst.Is4() {
+		return append(buf, "PROXY UNKNOWN\r\n"...)
+	}
+	family := "TCP4"
+	if src.Is6() {
+		family = "TCP6"
+	}
+	return fmt.Appendf(buf, "PROXY %s %s %s %d %d\r\n", family, src, dst, source.Port(), destination.Port())
+}
+
+// addrPort converts a TCP address to an AddrPort
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
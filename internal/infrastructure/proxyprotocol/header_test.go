@@ -0,0 +1,87 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestHeader_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		source, dst string
+	}{
+		{"ipv4", "192.0.2.1:56324", "198.51.100.1:443"},
+		{"ipv6", "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+	}
+	for _, tt := range tests {
+		source, dst := netip.MustParseAddrPort(tt.source), netip.MustParseAddrPort(tt.dst)
+		for version, header := range map[int][]byte{1: AppendV1(nil, source, dst), 2: AppendV2(nil, source, dst)} {
+			reader := bufio.NewReader(bytes.NewReader(append(header, "GET / HTTP/1.1\r\n"...)))
+			got, err := ReadHeader(reader)
+			if err != nil {
+				t.Fatalf("%s v%d: did not expect an error, got %v", tt.name, version, err)
+			}
+			if got.Version != version || got.Source != source || got.Destination != dst {
+				t.Errorf("%s v%d: unexpected header %+v", tt.name, version, got)
+			}
+			if rest, _ := reader.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s v%d: expected the request after the header, got %q", tt.name, version, rest)
+			}
+		}
+	}
+}
+
+func TestHeader_MixedFamiliesAsIPv6(t *testing.T) {
+	source, dst := netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("[2001:db8::2]:443")
+	got, err := ReadHeader(bufio.NewReader(bytes.NewReader(AppendV2(nil, source, dst))))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if got.Source.Addr().Unmap() != source.Addr() || got.Destination != dst {
+		t.Errorf("Unexpected header %+v", got)
+	}
+}
+
+func TestHeader_WithoutAddresses(t *testing.T) {
+	for _, raw := range []string{"PROXY UNKNOWN\r\n", string(AppendV2(nil, netip.AddrPort{}, netip.AddrPort{}))} {
+		got, err := ReadHeader(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Fatalf("Did not expect an error for %q, got %v", raw, err)
+		}
+		if got.Source.IsValid() || got.Destination.IsValid() {
+			t.Errorf("Expected no addresses for %q, got %+v", raw, got)
+		}
+	}
+}
+
+func TestReadHeader_NoHeader(t *testing.T) {
+	for _, raw := range []string{"GET / HTTP/1.1\r\n", "PRI * HTTP/2.0\r\n", "\r\n\r\nnot a signature"} {
+		reader := bufio.NewReader(strings.NewReader(raw))
+		if _, err := ReadHeader(reader); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("Expected ErrNoHeader for %q, got %v", raw, err)
+		}
+		if rest, _ := reader.ReadString(0); rest != raw {
+			t.Errorf("Expected nothing to be consumed, got %q", rest)
+		}
+	}
+}
+
+func TestReadHeader_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 99999\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY " + strings.Repeat("A", 200) + "\r\n",
+		string(v2Signature) + "\x22\x11\x00\x0c" + strings.Repeat("\x00", 12),
+		string(v2Signature) + "\x21\x11\x00\x04" + strings.Repeat("\x00", 4),
+	} {
+		if _, err := ReadHeader(bufio.NewReader(strings.NewReader(raw))); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Expected ErrInvalidHeader for %q, got %v", raw, err)
+		}
+	}
+}
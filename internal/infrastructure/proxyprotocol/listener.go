@@ -0,0 +1,187 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Whether the listener expects PROXY headers
+const (
+	ModeOff      = "off"      // connections are used as is
+	ModeOptional = "optional" // connections may start with a header
+	ModeRequired = "required" // connections without a header are closed
+)
+
+const defaultHeaderTimeout = 5 * time.Second
+
+// Listener accepts connections that start with a PROXY header, and reports the addresses of the header as
+// the connection's addresses. Headers are read on their own goroutine, so a client that is slow to send
+// its header does not hold up accepting other connections.
+type Listener struct {
+	net.Listener
+	required      bool
+	trusted       []netip.Prefix // sources allowed to send headers
+	headerTimeout time.Duration
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	metrics *expvar.Map
+}
+
+// NewListener wraps the listener, trusting the sources in the CIDRs to send PROXY headers. Headers of
+// other sources are not parsed, they reach the HTTP server as is and fail there. Trusted sources are
+// required, a header from any source would let every client pick its own address.
+func NewListener(inner net.Listener, mode string, trustedCIDRs []string, metrics *expvar.Map) (net.Listener, error) {
+	switch mode {
+	case "", ModeOff:
+		return inner, nil
+	case ModeOptional, ModeRequired:
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol mode: %s", mode)
+	}
+	l := &Listener{
+		Listener:      inner,
+		required:      mode == ModeRequired,
+		headerTimeout: defaultHeaderTimeout,
+		conns:         make(chan net.Conn),
+		errs:          make(chan error),
+		done:          make(chan struct{}),
+		metrics:       metrics,
+	}
+	for _, cidr := range trustedCIDRs {
+		prefix, err := infrastructure.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol trusted source %q: %w", cidr, err)
+		}
+		l.trusted = append(l.trusted, prefix)
+	}
+	if len(l.trusted) == 0 {
+		return nil, fmt.Errorf("proxy protocol %s requires trusted sources", mode)
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the header of a new connection and hands the connection to Accept
+func (l *Listener) handshake(conn net.Conn) {
+	proxied, err := l.readHeader(conn)
+	if err != nil {
+		l.metrics.Add("rejected", 1)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- proxied:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *Listener) readHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	proxied := &Conn{Conn: conn, reader: reader}
+	if !l.trustedSource(conn.RemoteAddr()) {
+		if l.required {
+			return nil, fmt.Errorf("proxy protocol: untrusted source %s", conn.RemoteAddr())
+		}
+		return proxied, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(l.headerTimeout))
+	header, err := ReadHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	switch {
+	case errors.Is(err, ErrNoHeader) && !l.required:
+		return proxied, nil
+	case err != nil:
+		return nil, err
+	}
+	l.metrics.Add(fmt.Sprintf("v%d", header.Version), 1)
+	if header.Source.IsValid() {
+		proxied.remoteAddr = net.TCPAddrFromAddrPort(header.Source)
+		proxied.localAddr = net.TCPAddrFromAddrPort(header.Destination)
+	}
+	return proxied, nil
+}
+
+func (l *Listener) trustedSource(addr net.Addr) bool {
+	source := addrPort(addr).Addr().Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection whose header was read
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Conn is a connection whose addresses may have been taken from its PROXY header
+type Conn struct {
+	net.Conn
+	reader                *bufio.Reader // holds bytes read past the header
+	remoteAddr, localAddr net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the original client address, or the peer address without a header
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the original destination address, or the local address without a header
+func (c *Conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
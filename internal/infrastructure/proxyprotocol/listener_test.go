@@ -0,0 +1,126 @@
+package proxyprotocol
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// dialWith connects to the listener, sends the payload and returns the accepted connection
+func dialWith(t *testing.T, l net.Listener, payload []byte) (net.Conn, error) {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Write(payload)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		return conn, nil
+	case <-time.After(200 * time.Millisecond):
+		return nil, io.EOF
+	}
+}
+
+func newTestListener(t *testing.T, mode string, trusted []string) (net.Listener, *expvar.Map) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	metrics := new(expvar.Map)
+	l, err := NewListener(inner, mode, trusted, metrics)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, metrics
+}
+
+func TestListener_Required(t *testing.T) {
+	l, metrics := newTestListener(t, ModeRequired, []string{"127.0.0.1"})
+	source, dst := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")
+
+	conn, err := dialWith(t, l, append(AppendV2(nil, source, dst), "hello"...))
+	if err != nil {
+		t.Fatalf("Expected the connection to be accepted")
+	}
+	if conn.RemoteAddr().String() != source.String() || conn.LocalAddr().String() != dst.String() {
+		t.Errorf("Expected the header's addresses, got %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected the payload after the header, got %q, %v", buf, err)
+	}
+
+	if _, err := dialWith(t, l, []byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Errorf("Expected a connection without a header to be rejected")
+	}
+	if metrics.Get("v2").String() != "1" || metrics.Get("rejected").String() != "1" {
+		t.Errorf("Unexpected metrics %s", metrics)
+	}
+}
+
+func TestListener_Optional(t *testing.T) {
+	l, _ := newTestListener(t, ModeOptional, []string{"127.0.0.0/8"})
+	conn, err := dialWith(t, l, []byte("GET / HTTP/1.1\r\n"))
+	if err != nil {
+		t.Fatalf("Expected a connection without a header to be accepted")
+	}
+	if addr := conn.RemoteAddr().(*net.TCPAddr); !addr.IP.IsLoopback() {
+		t.Errorf("Expected the peer address, got %s", addr)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "GET" {
+		t.Errorf("Expected the request to be intact, got %q, %v", buf, err)
+	}
+}
+
+func TestListener_UntrustedSource(t *testing.T) {
+	header := AppendV1(nil, netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("198.51.100.1:443"))
+
+	// Optional: the header of an untrusted source is not parsed
+	l, _ := newTestListener(t, ModeOptional, []string{"10.0.0.0/8"})
+	conn, err := dialWith(t, l, header)
+	if err != nil {
+		t.Fatalf("Expected the connection to be accepted")
+	}
+	if conn.RemoteAddr().String() == "192.0.2.1:1234" {
+		t.Errorf("Did not expect an untrusted source to set the client address")
+	}
+
+	// Required: untrusted sources are rejected
+	l, _ = newTestListener(t, ModeRequired, []string{"10.0.0.0/8"})
+	if _, err := dialWith(t, l, header); err == nil {
+		t.Errorf("Expected an untrusted source to be rejected")
+	}
+}
+
+func TestNewListener_Invalid(t *testing.T) {
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer inner.Close()
+	if l, err := NewListener(inner, ModeOff, nil, nil); err != nil || l != inner {
+		t.Errorf("Expected off to return the listener as is")
+	}
+	if _, err := NewListener(inner, "always", nil, nil); err == nil {
+		t.Errorf("Expected an invalid mode to be rejected")
+	}
+	if _, err := NewListener(inner, ModeRequired, []string{"10.0.0.0/33"}, nil); err == nil {
+		t.Errorf("Expected an invalid CIDR to be rejected")
+	}
+	if _, err := NewListener(inner, ModeOptional, nil, nil); err == nil {
+		t.Errorf("Expected headers without trusted sources to be rejected")
+	}
+}
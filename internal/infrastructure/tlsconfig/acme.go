@@ -0,0 +1,77 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultACMECacheDir = "acme-cache"
+
+// ACMEProto is the ALPN protocol of TLS-ALPN-01 challenges, listeners must offer it for them to succeed
+const ACMEProto = acme.ALPNProto
+
+// newACMEManager creates the manager obtaining certificates for the configured domains. Certificates are
+// obtained on the first handshake for a domain and renewed in the background, and both the account key and
+// the certificates are kept in the cache directory across restarts.
+func newACMEManager(config *infrastructure.ACME) (*autocert.Manager, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("acme: no domains configured")
+	}
+	cacheDir := config.CacheDir
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     &acme.Client{DirectoryURL: config.DirectoryURL},
+	}
+	if config.RenewBefore != "" {
+		renewBefore, err := time.ParseDuration(config.RenewBefore)
+		if err != nil {
+			return nil, fmt.Errorf("acme: invalid renew_before: %w", err)
+		}
+		manager.RenewBefore = renewBefore
+	}
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("acme: no certificates in %s", config.CACertFile)
+		}
+		manager.Client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	}
+	return manager, nil
+}
+
+// usesACME reports whether the handshake is for the ACME manager: a TLS-ALPN-01 challenge, or a managed domain
+func (cs *CertStore) usesACME(hello *tls.ClientHelloInfo) bool {
+	if cs.acme == nil {
+		return false
+	}
+	return slices.Contains(hello.SupportedProtos, ACMEProto) || slices.Contains(cs.acmeDomains, normalizeName(hello.ServerName))
+}
+
+// ACMEHTTPHandler answers HTTP-01 challenges and hands other requests to the fallback, or redirects them to
+// HTTPS when the fallback is nil. Without ACME it returns the fallback.
+func (cs *CertStore) ACMEHTTPHandler(fallback http.Handler) http.Handler {
+	if cs.acme == nil {
+		return fallback
+	}
+	return cs.acme.HTTPHandler(fallback)
+}
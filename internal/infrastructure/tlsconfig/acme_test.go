@@ -0,0 +1,143 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+// cacheACMECertificate stores a certificate for the domain in the ACME cache, as if it had been obtained earlier
+func cacheACMECertificate(t *testing.T, cacheDir string, domain string) {
+	t.Helper()
+	dir := t.TempDir()
+	key := ecdsaKey(t)
+	files := infrastructure.Certificate{CertFile: filepath.Join(dir, "c.crt"), KeyFile: filepath.Join(dir, "c.key")}
+	writeCertificateFiles(t, files, key, time.Now().Add(90*24*time.Hour), domain)
+	keyDER, _ := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	certPEM, _ := os.ReadFile(files.CertFile)
+	os.MkdirAll(cacheDir, 0o700)
+	os.WriteFile(filepath.Join(cacheDir, domain), append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), certPEM...), 0o600)
+}
+
+func TestCertStore_ACMEDomains(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	cacheACMECertificate(t, cacheDir, "acme.example.com")
+	static := writeCertificate(t, t.TempDir(), ecdsaKey(t), "static.example.com")
+	store, err := NewCertStore(infrastructure.LoadBalancer{
+		Certificates: []infrastructure.Certificate{static},
+		// The directory is never contacted, the certificate is served from the cache
+		ACME: &infrastructure.ACME{Domains: []string{"acme.example.com"}, CacheDir: cacheDir, DirectoryURL: "https://127.0.0.1:1/dir"},
+	}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	serverConfig := &tls.Config{GetCertificate: store.GetCertificate, NextProtos: []string{"h2", ACMEProto}}
+
+	for _, name := range []string{"acme.example.com", "static.example.com", "other.example.com"} {
+		want := name
+		if name == "other.example.com" {
+			want = "static.example.com" // names outside the ACME domains get the default certificate
+		}
+		got, err := handshake(t, serverConfig, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: did not expect an error, got %v", name, err)
+		}
+		if got.Subject.CommonName != want {
+			t.Errorf("%s: expected the certificate of %s, got %s", name, want, got.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertStore_ACMEHTTPHandler(t *testing.T) {
+	store, err := NewCertStore(infrastructure.LoadBalancer{
+		ACME: &infrastructure.ACME{Domains: []string{"acme.example.com"}, CacheDir: t.TempDir()},
+	}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	store.ACMEHTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://acme.example.com/apiA?x=1", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://acme.example.com/apiA?x=1" {
+		t.Errorf("Expected a redirect to HTTPS, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// On an http listener other requests reach its routes, challenges do not
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for path, want := range map[string]bool{"/apiA": true, "/.well-known/acme-challenge/token": false} {
+		w = httptest.NewRecorder()
+		store.ACMEHTTPHandler(fallback).ServeHTTP(w, httptest.NewRequest("GET", "http://acme.example.com"+path, nil))
+		if got := w.Code == http.StatusTeapot; got != want {
+			t.Errorf("%s: expected the routes to serve it to be %v, got status %d", path, want, w.Code)
+		}
+	}
+
+	if _, err := NewCertStore(infrastructure.LoadBalancer{ACME: &infrastructure.ACME{}}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected ACME without domains to be rejected")
+	}
+}
+
+// TestCertStore_ACMEPebble obtains a certificate from a local Pebble ACME server. Run Pebble with
+// PEBBLE_VA_ALWAYS_VALID=1, or with its TLS-ALPN-01 port pointed at PEBBLE_TLS_ADDRESS, and set
+// PEBBLE_DIRECTORY_URL and PEBBLE_CA_CERT, e.g. https://localhost:14000/dir and Pebble's test/certs/pebble.minica.pem.
+func TestCertStore_ACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL is not set")
+	}
+	address := os.Getenv("PEBBLE_TLS_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:5001"
+	}
+	store, err := NewCertStore(infrastructure.LoadBalancer{
+		ACME: &infrastructure.ACME{
+			Domains:      []string{"l7lb.test"},
+			DirectoryURL: directoryURL,
+			CACertFile:   os.Getenv("PEBBLE_CA_CERT"),
+			CacheDir:     t.TempDir(),
+		},
+	}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	listener, err := tls.Listen("tcp", address, &tls.Config{GetCertificate: store.GetCertificate, NextProtos: []string{"h2", ACMEProto}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", listener.Addr().String(), &tls.Config{ServerName: "l7lb.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname("l7lb.test"); err != nil || leaf.Issuer.String() == leaf.Subject.String() {
+		t.Errorf("Expected a certificate issued by Pebble for l7lb.test, got %s issued by %s", leaf.Subject, leaf.Issuer)
+	}
+}
@@ -0,0 +1,354 @@
+// Package tlsconfig builds the TLS configuration of the load balancer's listeners
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var ErrNoCertificate = errors.New("no certificate for server name")
+
+const (
+	defaultExpiryWarning = 30 * 24 * time.Hour
+	expiryCheckInterval  = 12 * time.Hour
+)
+
+// CertStore selects the certificate of a handshake by the server name (SNI) the client asks for. Reloads
+// swap in a whole new index, so a handshake sees either the old or the new certificates, and connections
+// that completed their handshake keep the certificate they were served.
+type CertStore struct {
+	configs       []infrastructure.Certificate
+	dir           string
+	expiryWarning time.Duration
+
+	acme        *autocert.Manager // optional, serves the ACME domains
+	acmeDomains []string
+	ocsp        *ocspStapler // optional, staples OCSP responses to the loaded certificates
+
+	index    atomic.Pointer[certIndex]
+	reload   sync.Mutex
+	watchers []io.Closer
+	done     chan struct{}
+	metrics  *expvar.Map
+	logger   *zap.Logger
+}
+
+// certIndex maps server names to the certificates covering them. A name may be covered by several
+// certificates, e.g. an ECDSA and an RSA one, and the first one the client supports is served.
+type certIndex struct {
+	exact     map[string]*certEntry
+	wildcard  map[string]*certEntry // keyed by the parent domain of "*.example.com", i.e. "example.com"
+	fallback  *certEntry
+	restricts bool                        // some names are tied to routes
+	loaded    map[string]*tls.Certificate // by certificate file
+}
+
+type certEntry struct {
+	certificates []*tls.Certificate
+	routes       []string // routes reachable through the name, all routes when empty
+	clientAuth   string   // client certificate mode of the name, the listener's mode when empty
+}
+
+// NewCertStore loads the certificates of the config. Without any listed certificates, directory or ACME
+// domains, the legacy cert_file and key_file pair is served for every name.
+func NewCertStore(config infrastructure.LoadBalancer, metrics *expvar.Map, logger *zap.Logger) (*CertStore, error) {
+	cs := &CertStore{
+		configs:       config.Certificates,
+		dir:           config.CertDir,
+		expiryWarning: defaultExpiryWarning,
+		done:          make(chan struct{}),
+		metrics:       metrics,
+		logger:        logger,
+	}
+	if config.ACME != nil {
+		manager, err := newACMEManager(config.ACME)
+		if err != nil {
+			return nil, err
+		}
+		cs.acme = manager
+		for _, domain := range config.ACME.Domains {
+			cs.acmeDomains = append(cs.acmeDomains, normalizeName(domain))
+		}
+	}
+	if config.OCSP.Enabled {
+		cs.ocsp = newOCSPStapler(config.OCSP, logger)
+	}
+	if len(cs.configs) == 0 && cs.dir == "" && cs.acme == nil {
+		if config.CertFile == "" {
+			return nil, errors.New("no certificate configured")
+		}
+		cs.configs = []infrastructure.Certificate{{CertFile: config.CertFile, KeyFile: config.KeyFile, Default: true}}
+	}
+	if config.CertExpiryWarning != "" {
+		warning, err := time.ParseDuration(config.CertExpiryWarning)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert_expiry_warning: %w", err)
+		}
+		cs.expiryWarning = warning
+	}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Watch reloads the certificates when their files, or the certificate directory, change, keeps warning
+// about certificates close to expiry and keeps their OCSP staples fresh, until the store is closed
+func (cs *CertStore) Watch() error {
+	for _, config := range cs.configs {
+		for _, file := range []string{config.CertFile, config.KeyFile} {
+			watcher, err := infrastructure.WatchFile(file, cs.reloadFiles)
+			if err != nil {
+				return err
+			}
+			cs.watchers = append(cs.watchers, watcher)
+		}
+	}
+	if cs.dir != "" {
+		watcher, err := infrastructure.WatchDir(cs.dir, cs.reloadFiles)
+		if err != nil {
+			return err
+		}
+		cs.watchers = append(cs.watchers, watcher)
+	}
+	if cs.ocsp != nil {
+		go cs.ocsp.run(cs.done)
+	}
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cs.checkExpiry()
+			case <-cs.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the certificates
+func (cs *CertStore) Close() error {
+	close(cs.done)
+	for _, watcher := range cs.watchers {
+		watcher.Close()
+	}
+	return nil
+}
+
+func (cs *CertStore) reloadFiles() {
+	if err := cs.load(); err != nil {
+		cs.logger.Error("Failed to reload certificates, serving the previous certificates", zap.Error(err))
+	}
+}
+
+// load reads every certificate and swaps in the new index once all of them loaded
+func (cs *CertStore) load() error {
+	cs.reload.Lock()
+	defer cs.reload.Unlock()
+	configs := cs.configs
+	if cs.dir != "" {
+		dirConfigs, err := dirCertificates(cs.dir)
+		if err != nil {
+			return err
+		}
+		configs = append(slices.Clip(configs), dirConfigs...)
+	}
+	index, err := newCertIndex(configs)
+	if err != nil {
+		return err
+	}
+	previous := cs.index.Swap(index)
+	for file, certificate := range index.loaded {
+		if previous == nil || previous.loaded[file] == nil || !previous.loaded[file].Leaf.Equal(certificate.Leaf) {
+			cs.logger.Info("Loaded certificate", zap.String("file", file), zap.Strings("names", certificate.Leaf.DNSNames),
+				zap.Time("not_after", certificate.Leaf.NotAfter))
+		}
+	}
+	if cs.ocsp != nil {
+		cs.ocsp.update(index.loaded)
+	}
+	cs.publishExpiry(index)
+	cs.checkExpiry()
+	return nil
+}
+
+// dirCertificates lists the certificate and key pairs of the directory
+func dirCertificates(dir string) ([]infrastructure.Certificate, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("certificate directory: %w", err)
+	}
+	var configs []infrastructure.Certificate
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		keyFile := filepath.Join(dir, strings.TrimSuffix(file.Name(), ext)+".key")
+		if _, err := os.Stat(keyFile); err != nil {
+			continue // e.g. a CA bundle
+		}
+		configs = append(configs, infrastructure.Certificate{CertFile: filepath.Join(dir, file.Name()), KeyFile: keyFile})
+	}
+	return configs, nil
+}
+
+func newCertIndex(configs []infrastructure.Certificate) (*certIndex, error) {
+	index := &certIndex{exact: make(map[string]*certEntry), wildcard: make(map[string]*certEntry), loaded: make(map[string]*tls.Certificate)}
+	for i, config := range configs {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", config.CertFile, err)
+		}
+		index.loaded[config.CertFile] = &certificate
+		names := config.Names
+		if len(names) == 0 {
+			names = certificateNames(&certificate)
+		}
+		if _, err := clientAuthType(config.ClientAuth); err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", config.CertFile, err)
+		}
+		for _, name := range names {
+			if err := index.add(name, &certificate, config); err != nil {
+				return nil, fmt.Errorf("certificate %s: %w", config.CertFile, err)
+			}
+		}
+		if config.Default || (i == 0 && !slices.ContainsFunc(configs, func(c infrastructure.Certificate) bool { return c.Default })) {
+			if index.fallback != nil {
+				return nil, errors.New("more than one default certificate")
+			}
+			index.fallback = &certEntry{certificates: []*tls.Certificate{&certificate}, routes: config.Routes, clientAuth: config.ClientAuth}
+		}
+		index.restricts = index.restricts || len(config.Routes) > 0
+	}
+	return index, nil
+}
+
+// publishExpiry exposes the expiry of every loaded certificate, keyed by its file
+func (cs *CertStore) publishExpiry(index *certIndex) {
+	var removed []string
+	cs.metrics.Do(func(kv expvar.KeyValue) {
+		if index.loaded[kv.Key] == nil {
+			removed = append(removed, kv.Key)
+		}
+	})
+	for _, file := range removed {
+		cs.metrics.Delete(file)
+	}
+	for file, certificate := range index.loaded {
+		notAfter := certificate.Leaf.NotAfter
+		cs.metrics.Set(file, expvar.Func(func() any {
+			return map[string]any{
+				"not_after":          notAfter.Format(time.RFC3339),
+				"expires_in_seconds": int64(time.Until(notAfter).Seconds()),
+			}
+		}))
+	}
+}
+
+// checkExpiry warns about certificates that expire within the warning threshold
+func (cs *CertStore) checkExpiry() {
+	for file, certificate := range cs.index.Load().loaded {
+		if remaining := time.Until(certificate.Leaf.NotAfter); remaining < cs.expiryWarning {
+			cs.logger.Warn("Certificate expires soon", zap.String("file", file), zap.Strings("names", certificate.Leaf.DNSNames),
+				zap.Time("not_after", certificate.Leaf.NotAfter), zap.Duration("remaining", remaining))
+		}
+	}
+}
+
+// certificateNames returns the DNS names of the certificate, or its common name for certificates without any
+func certificateNames(certificate *tls.Certificate) []string {
+	if certificate.Leaf == nil {
+		return nil
+	}
+	if len(certificate.Leaf.DNSNames) > 0 {
+		return certificate.Leaf.DNSNames
+	}
+	if cn := certificate.Leaf.Subject.CommonName; cn != "" {
+		return []string{cn}
+	}
+	return nil
+}
+
+func (index *certIndex) add(name string, certificate *tls.Certificate, config infrastructure.Certificate) error {
+	name = normalizeName(name)
+	entries := index.exact
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		name, entries = parent, index.wildcard
+	}
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("invalid server name %q", name)
+	}
+	entry, ok := entries[name]
+	if !ok {
+		entry = &certEntry{routes: config.Routes, clientAuth: config.ClientAuth}
+		entries[name] = entry
+	} else if !slices.Equal(entry.routes, config.Routes) || entry.clientAuth != config.ClientAuth {
+		return fmt.Errorf("server name %s is tied to different routes or client_auth by another certificate", name)
+	}
+	entry.certificates = append(entry.certificates, certificate)
+	return nil
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// lookup returns the entry of the server name: an exact match, then a wildcard covering its first label,
+// then the default. Wildcards cover a single label, as in certificates.
+func (index *certIndex) lookup(serverName string) *certEntry {
+	name := normalizeName(serverName)
+	if entry, ok := index.exact[name]; ok {
+		return entry
+	}
+	if _, parent, found := strings.Cut(name, "."); found {
+		if entry, ok := index.wildcard[parent]; ok {
+			return entry
+		}
+	}
+	return index.fallback
+}
+
+// GetCertificate is the tls.Config callback serving the certificate of the client's server name
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cs.usesACME(hello) {
+		return cs.acme.GetCertificate(hello)
+	}
+	entry := cs.index.Load().lookup(hello.ServerName)
+	if entry == nil {
+		return nil, fmt.Errorf("%w %q", ErrNoCertificate, hello.ServerName)
+	}
+	for _, certificate := range entry.certificates {
+		if hello.SupportsCertificate(certificate) == nil {
+			return cs.ocsp.staple(certificate), nil
+		}
+	}
+	return cs.ocsp.staple(entry.certificates[0]), nil // let the handshake fail with the client's own error
+}
+
+// RouteAllowed reports whether the route may be reached through the server name of a connection
+func (cs *CertStore) RouteAllowed(serverName string, route string) bool {
+	index := cs.index.Load()
+	if !index.restricts {
+		return true
+	}
+	entry := index.lookup(serverName)
+	return entry == nil || len(entry.routes) == 0 || slices.Contains(entry.routes, route)
+}
@@ -0,0 +1,308 @@
+package tlsconfig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"expvar"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// writeCertificate writes a self-signed certificate for the names to dir and returns its config
+func writeCertificate(t *testing.T, dir string, key crypto.Signer, names ...string) infrastructure.Certificate {
+	t.Helper()
+	serial := big.NewInt(time.Now().UnixNano())
+	base := filepath.Join(dir, names[0]+"-"+serial.String())
+	certificate := infrastructure.Certificate{CertFile: base + ".crt", KeyFile: base + ".key"}
+	writeCertificateFiles(t, certificate, key, time.Now().Add(24*time.Hour), names...)
+	return certificate
+}
+
+// writeCertificateFiles writes a self-signed certificate valid until notAfter to the files of the config
+func writeCertificateFiles(t *testing.T, certificate infrastructure.Certificate, key crypto.Signer, notAfter time.Time, names ...string) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	os.WriteFile(certificate.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(certificate.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+func ecdsaKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key
+}
+
+// handshake connects a client asking for the server name and returns the certificate it was served
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, serverConfig)
+		server.Handshake()
+		server.Close()
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+// handshakeWithData is handshake followed by a byte from the server, with TLS 1.3 the server only reports
+// rejected client certificates after the client's handshake completed
+func handshakeWithData(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, serverConfig)
+		if server.Handshake() == nil {
+			server.Write([]byte{1})
+		}
+		server.Close()
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestCertStore_SelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	api := writeCertificate(t, dir, ecdsaKey(t), "api.example.com")
+	wildcard := writeCertificate(t, dir, ecdsaKey(t), "*.example.com")
+	fallback := writeCertificate(t, dir, ecdsaKey(t), "default.example.org")
+	fallback.Default = true
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{api, wildcard, fallback}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+
+	tests := []struct {
+		serverName, want string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.Example.com.", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"a.b.example.com", "default.example.org"}, // wildcards cover a single label
+		{"example.com", "default.example.org"},
+		{"", "default.example.org"},
+	}
+	for _, tt := range tests {
+		got, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatalf("%q: did not expect an error, got %v", tt.serverName, err)
+		}
+		if got.Leaf.Subject.CommonName != tt.want {
+			t.Errorf("%q: expected the certificate of %s, got %s", tt.serverName, tt.want, got.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertStore_PrefersSupportedKeyType(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	withRSA := writeCertificate(t, dir, rsaKey, "api.example.com")
+	withECDSA := writeCertificate(t, dir, ecdsaKey(t), "api.example.com")
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{withECDSA, withRSA}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	serverConfig := &tls.Config{GetCertificate: store.GetCertificate}
+
+	// A TLS 1.2 client without ECDSA suites gets the RSA certificate
+	got, err := handshake(t, serverConfig, &tls.Config{
+		ServerName:         "api.example.com",
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if _, ok := got.PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("Expected the RSA certificate, got %T", got.PublicKey)
+	}
+	got, err = handshake(t, serverConfig, &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if _, ok := got.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected the ECDSA certificate, got %T", got.PublicKey)
+	}
+}
+
+func TestCertStore_RouteAllowed(t *testing.T) {
+	dir := t.TempDir()
+	admin := writeCertificate(t, dir, ecdsaKey(t), "admin.example.com")
+	admin.Routes = []string{"/admin"}
+	public := writeCertificate(t, dir, ecdsaKey(t), "www.example.com")
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{public, admin}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if !store.RouteAllowed("admin.example.com", "/admin") || store.RouteAllowed("admin.example.com", "/apiA") {
+		t.Errorf("Expected admin.example.com to only reach /admin")
+	}
+	if !store.RouteAllowed("www.example.com", "/admin") || !store.RouteAllowed("unknown.example.com", "/apiA") {
+		t.Errorf("Expected names without routes to reach every route")
+	}
+}
+
+func TestNewCertStore_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	first := writeCertificate(t, dir, ecdsaKey(t), "a.example.com")
+	second := writeCertificate(t, dir, ecdsaKey(t), "b.example.com")
+	first.Default, second.Default = true, true
+	if _, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{first, second}}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected two default certificates to be rejected")
+	}
+	bad := writeCertificate(t, dir, ecdsaKey(t), "c.example.com")
+	bad.Names = []string{"a.*.example.com"}
+	if _, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{bad}}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected an invalid server name to be rejected")
+	}
+	if _, err := NewCertStore(infrastructure.LoadBalancer{CertFile: filepath.Join(dir, "missing.pem")}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected a missing certificate to be rejected")
+	}
+	if _, err := NewCertStore(infrastructure.LoadBalancer{}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected a config without certificates to be rejected")
+	}
+}
+
+// servedCommonName returns the common name of the certificate served for the server name
+func servedCommonName(t *testing.T, store *CertStore, serverName string) string {
+	t.Helper()
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return ""
+	}
+	return certificate.Leaf.Subject.CommonName
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertStore_ReloadsRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	key := ecdsaKey(t)
+	certificate := writeCertificate(t, dir, key, "api.example.com")
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{certificate}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if err := store.Watch(); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer store.Close()
+	before, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+
+	writeCertificateFiles(t, certificate, key, time.Now().Add(90*24*time.Hour), "api.example.com")
+	waitFor(t, func() bool {
+		after, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+		return !after.Leaf.Equal(before.Leaf)
+	})
+
+	// A half written rotation, a certificate with the old key, keeps serving the previous certificate
+	served, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	writeCertificateFiles(t, infrastructure.Certificate{CertFile: certificate.CertFile, KeyFile: filepath.Join(dir, "unused.key")}, ecdsaKey(t), time.Now().Add(time.Hour), "api.example.com")
+	time.Sleep(300 * time.Millisecond)
+	if current, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"}); current != served {
+		t.Errorf("Expected the previous certificate to be kept")
+	}
+}
+
+func TestCertStore_Directory(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificateFiles(t, infrastructure.Certificate{CertFile: filepath.Join(dir, "a.crt"), KeyFile: filepath.Join(dir, "a.key")}, ecdsaKey(t), time.Now().Add(time.Hour), "a.example.com")
+	os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("not paired with a key"), 0o644)
+	store, err := NewCertStore(infrastructure.LoadBalancer{CertDir: dir}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if err := store.Watch(); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer store.Close()
+	if name := servedCommonName(t, store, "a.example.com"); name != "a.example.com" {
+		t.Fatalf("Expected the certificate of the directory, got %q", name)
+	}
+
+	writeCertificateFiles(t, infrastructure.Certificate{CertFile: filepath.Join(dir, "b.pem"), KeyFile: filepath.Join(dir, "b.key")}, ecdsaKey(t), time.Now().Add(time.Hour), "b.example.com")
+	waitFor(t, func() bool { return servedCommonName(t, store, "b.example.com") == "b.example.com" })
+}
+
+func TestCertStore_Expiry(t *testing.T) {
+	dir := t.TempDir()
+	soon := writeCertificate(t, dir, ecdsaKey(t), "soon.example.com") // expires in a day
+	later := infrastructure.Certificate{CertFile: filepath.Join(dir, "later.crt"), KeyFile: filepath.Join(dir, "later.key")}
+	writeCertificateFiles(t, later, ecdsaKey(t), time.Now().Add(365*24*time.Hour), "later.example.com")
+
+	core, logs := observer.New(zap.WarnLevel)
+	metrics := new(expvar.Map)
+	_, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{soon, later}, CertExpiryWarning: "168h"}, metrics, zap.New(core))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	warnings := logs.FilterMessage("Certificate expires soon").All()
+	if len(warnings) != 1 || warnings[0].ContextMap()["file"] != soon.CertFile {
+		t.Errorf("Expected a warning about the certificate expiring soon only, got %v", warnings)
+	}
+	expiry, ok := metrics.Get(later.CertFile).(expvar.Func)
+	if !ok {
+		t.Fatalf("Expected the expiry of %s to be published", later.CertFile)
+	}
+	if seconds := expiry.Value().(map[string]any)["expires_in_seconds"].(int64); seconds < 364*24*3600 {
+		t.Errorf("Unexpected expires_in_seconds %d", seconds)
+	}
+	if _, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{soon}, CertExpiryWarning: "soon"}, metrics, zap.New(core)); err == nil {
+		t.Errorf("Expected an invalid expiry warning to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Client certificate modes
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request" // certificates are verified when clients send one
+	ClientAuthRequire = "require" // clients without a valid certificate fail the handshake
+)
+
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("invalid client_auth mode: %s", mode)
+	}
+}
+
+// ConfigureClientAuth makes the listener's config verify client certificates against the CA bundle, in the
+// mode of the server name the client asks for. Certificates of names without a mode of their own use the
+// listener's mode.
+func (cs *CertStore) ConfigureClientAuth(tlsConfig *tls.Config, config infrastructure.ClientAuth) error {
+	mode, err := clientAuthType(config.Mode)
+	if err != nil {
+		return err
+	}
+	overrides := cs.index.Load().clientAuthOverrides()
+	if mode == tls.NoClientCert && !overrides {
+		return nil
+	}
+	if config.CAFile == "" {
+		return errors.New("client_auth requires a ca_file")
+	}
+	pem, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return fmt.Errorf("client_auth: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("client_auth: no certificates in %s", config.CAFile)
+	}
+	tlsConfig.ClientAuth = mode
+	tlsConfig.ClientCAs = pool
+	if overrides {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			entry := cs.index.Load().lookup(hello.ServerName)
+			if entry == nil || entry.clientAuth == "" {
+				return nil, nil
+			}
+			nameMode, _ := clientAuthType(entry.clientAuth)
+			if nameMode == tlsConfig.ClientAuth {
+				return nil, nil
+			}
+			nameConfig := tlsConfig.Clone()
+			nameConfig.ClientAuth = nameMode
+			return nameConfig, nil
+		}
+	}
+	return nil
+}
+
+// clientAuthOverrides reports whether any server name has a client certificate mode of its own
+func (index *certIndex) clientAuthOverrides() bool {
+	entries := []*certEntry{index.fallback}
+	for _, entry := range index.exact {
+		entries = append(entries, entry)
+	}
+	for _, entry := range index.wildcard {
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		if entry != nil && entry.clientAuth != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package tlsconfig
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"expvar"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+// newTestCA writes a CA certificate to dir and returns it with its key
+func newTestCA(t *testing.T, dir string) (*x509.Certificate, crypto.Signer, string) {
+	t.Helper()
+	key := ecdsaKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, "ca.pem")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	return ca, key, file
+}
+
+// clientCertificate issues a client certificate signed by the CA
+func clientCertificate(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, commonName string) tls.Certificate {
+	t.Helper()
+	key := ecdsaKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConfigureClientAuth_PerServerName(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile := newTestCA(t, dir)
+	public := writeCertificate(t, dir, ecdsaKey(t), "www.example.com")
+	internal := writeCertificate(t, dir, ecdsaKey(t), "internal.example.com")
+	internal.ClientAuth = ClientAuthRequire
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{public, internal}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	serverConfig := &tls.Config{GetCertificate: store.GetCertificate}
+	if err := store.ConfigureClientAuth(serverConfig, infrastructure.ClientAuth{Mode: ClientAuthRequest, CAFile: caFile}); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	valid := clientCertificate(t, ca, caKey, "payments")
+	otherCA, otherKey, _ := newTestCA(t, t.TempDir())
+	forged := clientCertificate(t, otherCA, otherKey, "payments") // issued by a CA of the same name
+
+	tests := []struct {
+		serverName  string
+		certificate *tls.Certificate
+		ok          bool
+	}{
+		{"www.example.com", nil, true},
+		{"www.example.com", &valid, true},
+		{"www.example.com", &forged, false}, // certificates that are sent are verified
+		{"internal.example.com", nil, false},
+		{"internal.example.com", &valid, true},
+	}
+	for _, tt := range tests {
+		clientConfig := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+		if tt.certificate != nil {
+			clientConfig.Certificates = []tls.Certificate{*tt.certificate}
+		}
+		_, err := handshakeWithData(t, serverConfig, clientConfig)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s with certificate %v: expected ok %v, got %v", tt.serverName, tt.certificate != nil, tt.ok, err)
+		}
+	}
+}
+
+func TestConfigureClientAuth_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{writeCertificate(t, dir, ecdsaKey(t), "www.example.com")}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if err := store.ConfigureClientAuth(&tls.Config{}, infrastructure.ClientAuth{Mode: ClientAuthRequire}); err == nil {
+		t.Errorf("Expected a mode without a CA bundle to be rejected")
+	}
+	if err := store.ConfigureClientAuth(&tls.Config{}, infrastructure.ClientAuth{Mode: "always"}); err == nil {
+		t.Errorf("Expected an invalid mode to be rejected")
+	}
+	if err := store.ConfigureClientAuth(&tls.Config{}, infrastructure.ClientAuth{}); err != nil {
+		t.Errorf("Expected no client certificates to need no CA bundle, got %v", err)
+	}
+	bad := writeCertificate(t, dir, ecdsaKey(t), "bad.example.com")
+	bad.ClientAuth = "always"
+	if _, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{bad}}, new(expvar.Map), zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected an invalid mode of a certificate to be rejected")
+	}
+}
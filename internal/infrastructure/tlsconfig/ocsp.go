@@ -0,0 +1,253 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspCheckInterval   = time.Minute
+	ocspRetryInterval   = 5 * time.Minute // after a failed fetch
+	ocspDefaultValidity = time.Hour       // refresh interval of responses without a NextUpdate
+	ocspTimeout         = 10 * time.Second
+	ocspMaxResponseSize = 1 << 20
+)
+
+// ocspStapler keeps an OCSP response stapled to every loaded certificate, so clients checking revocation
+// need not ask the CA's responder on every new connection. Responses are refreshed halfway to their
+// NextUpdate, and the last good response is stapled until it expires while the responder is unreachable.
+type ocspStapler struct {
+	responderURL  string // overrides the responder of the certificates
+	client        *http.Client
+	checkInterval time.Duration
+	retryInterval time.Duration
+
+	mu           sync.Mutex
+	certificates map[string]*tls.Certificate // by certificate file, those with an issuer and a responder
+	responses    map[[32]byte]*ocspResponse  // by leaf fingerprint, so reloads of the same certificate keep them
+	stapled      atomic.Pointer[map[*tls.Certificate]*tls.Certificate]
+	wake         chan struct{}
+	logger       *zap.Logger
+}
+
+type ocspResponse struct {
+	raw         []byte // last good response, nil until one is fetched
+	thisUpdate  time.Time
+	nextUpdate  time.Time
+	lastAttempt time.Time
+}
+
+func newOCSPStapler(config infrastructure.OCSPStapling, logger *zap.Logger) *ocspStapler {
+	s := &ocspStapler{
+		responderURL:  config.ResponderURL,
+		client:        &http.Client{Timeout: ocspTimeout},
+		checkInterval: ocspCheckInterval,
+		retryInterval: ocspRetryInterval,
+		responses:     make(map[[32]byte]*ocspResponse),
+		wake:          make(chan struct{}, 1),
+		logger:        logger,
+	}
+	s.stapled.Store(&map[*tls.Certificate]*tls.Certificate{})
+	return s
+}
+
+// staple returns the certificate with its OCSP response, or the certificate itself while it has none
+func (s *ocspStapler) staple(certificate *tls.Certificate) *tls.Certificate {
+	if s == nil {
+		return certificate
+	}
+	if stapled, ok := (*s.stapled.Load())[certificate]; ok {
+		return stapled
+	}
+	return certificate
+}
+
+// update replaces the certificates to staple after a reload, and fetches responses for new ones
+func (s *ocspStapler) update(loaded map[string]*tls.Certificate) {
+	certificates := make(map[string]*tls.Certificate)
+	current := make(map[[32]byte]bool)
+	for file, certificate := range loaded {
+		if _, _, err := s.source(certificate); err != nil {
+			s.logger.Warn("Not stapling OCSP responses", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		certificates[file] = certificate
+		current[leafFingerprint(certificate)] = true
+	}
+	s.mu.Lock()
+	s.certificates = certificates
+	for fingerprint := range s.responses {
+		if !current[fingerprint] {
+			delete(s.responses, fingerprint)
+		}
+	}
+	s.publish()
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the responses that are due until done is closed
+func (s *ocspStapler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+	s.refresh()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		case <-done:
+			return
+		}
+		s.refresh()
+	}
+}
+
+func (s *ocspStapler) refresh() {
+	s.mu.Lock()
+	certificates := s.certificates
+	s.mu.Unlock()
+	for file, certificate := range certificates {
+		fingerprint := leafFingerprint(certificate)
+		s.mu.Lock()
+		previous := s.responses[fingerprint]
+		s.mu.Unlock()
+		now := time.Now()
+		if !s.due(previous, now) {
+			continue
+		}
+		next := &ocspResponse{lastAttempt: now}
+		parsed, raw, err := s.fetch(certificate)
+		switch {
+		case err == nil:
+			next.raw, next.thisUpdate, next.nextUpdate = raw, parsed.ThisUpdate, parsed.NextUpdate
+		case errors.Is(err, errRevoked):
+			s.logger.Error("Certificate is revoked, not stapling its OCSP response", zap.String("file", file))
+		case previous != nil && previous.raw != nil:
+			next.raw, next.thisUpdate, next.nextUpdate = previous.raw, previous.thisUpdate, previous.nextUpdate
+			s.logger.Warn("Failed to refresh OCSP response, stapling the last good response", zap.String("file", file),
+				zap.Time("next_update", previous.nextUpdate), zap.Error(err))
+		default:
+			s.logger.Warn("Failed to fetch OCSP response", zap.String("file", file), zap.Error(err))
+		}
+		s.mu.Lock()
+		if s.certificates[file] == certificate {
+			s.responses[fingerprint] = next
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.publish()
+	s.mu.Unlock()
+}
+
+// due reports whether the response should be fetched again: halfway through its validity, and not sooner
+// than the retry interval after the previous attempt
+func (s *ocspStapler) due(response *ocspResponse, now time.Time) bool {
+	if response == nil {
+		return true
+	}
+	if now.Sub(response.lastAttempt) < s.retryInterval {
+		return false
+	}
+	if response.raw == nil {
+		return true
+	}
+	refreshAt := response.thisUpdate.Add(ocspDefaultValidity)
+	if !response.nextUpdate.IsZero() {
+		refreshAt = response.thisUpdate.Add(response.nextUpdate.Sub(response.thisUpdate) / 2)
+	}
+	return !now.Before(refreshAt)
+}
+
+// publish swaps in the stapled copies of the certificates, leaving out expired responses. The loaded
+// certificates are shared with handshakes in progress and never modified. Must hold mu.
+func (s *ocspStapler) publish() {
+	now := time.Now()
+	stapled := make(map[*tls.Certificate]*tls.Certificate)
+	for _, certificate := range s.certificates {
+		response := s.responses[leafFingerprint(certificate)]
+		if response == nil || response.raw == nil || (!response.nextUpdate.IsZero() && now.After(response.nextUpdate)) {
+			continue
+		}
+		copied := *certificate
+		copied.OCSPStaple = response.raw
+		stapled[certificate] = &copied
+	}
+	s.stapled.Store(&stapled)
+}
+
+var errRevoked = errors.New("certificate is revoked")
+
+// source returns the issuer of the certificate, from its chain, and the responder to ask
+func (s *ocspStapler) source(certificate *tls.Certificate) (*x509.Certificate, string, error) {
+	if len(certificate.Certificate) < 2 {
+		return nil, "", errors.New("no issuer certificate in the chain")
+	}
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("issuer certificate: %w", err)
+	}
+	if s.responderURL != "" {
+		return issuer, s.responderURL, nil
+	}
+	if len(certificate.Leaf.OCSPServer) == 0 {
+		return nil, "", errors.New("no OCSP responder in the certificate")
+	}
+	return issuer, certificate.Leaf.OCSPServer[0], nil
+}
+
+func (s *ocspStapler) fetch(certificate *tls.Certificate) (*ocsp.Response, []byte, error) {
+	issuer, responder, err := s.source(certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := ocsp.CreateRequest(certificate.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP request: %w", err)
+	}
+	response, err := s.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP responder: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder: status %d", response.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(response.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP responder: %w", err)
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, certificate.Leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP response: %w", err)
+	}
+	switch {
+	case parsed.Status == ocsp.Revoked:
+		return nil, nil, errRevoked
+	case parsed.Status != ocsp.Good:
+		return nil, nil, errors.New("OCSP response: unknown certificate status")
+	case !parsed.NextUpdate.IsZero() && time.Now().After(parsed.NextUpdate):
+		return nil, nil, errors.New("OCSP response: expired")
+	}
+	return parsed, raw, nil
+}
+
+func leafFingerprint(certificate *tls.Certificate) [32]byte {
+	return sha256.Sum256(certificate.Certificate[0])
+}
@@ -0,0 +1,201 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"expvar"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testResponder is a local stand-in for a CA's OCSP responder
+type testResponder struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+
+	mu       sync.Mutex
+	status   int  // ocsp.Good or ocsp.Revoked
+	failing  bool // answers 503
+	requests int
+}
+
+func newTestResponder(t *testing.T, ca *x509.Certificate, caKey crypto.Signer) (*testResponder, *httptest.Server) {
+	t.Helper()
+	responder := &testResponder{ca: ca, caKey: caKey, status: ocsp.Good}
+	server := httptest.NewServer(responder)
+	t.Cleanup(server.Close)
+	return responder, server
+}
+
+func (tr *testResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.requests++
+	if tr.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Already halfway through its validity, so every check refreshes it
+	template := ocsp.Response{
+		Status:       tr.status,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour).Truncate(time.Second),
+		NextUpdate:   time.Now().Add(time.Hour),
+		RevokedAt:    time.Now().Add(-time.Minute),
+	}
+	response, err := ocsp.CreateResponse(tr.ca, tr.ca, template, tr.caKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+func (tr *testResponder) set(status int, failing bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.status, tr.failing = status, failing
+}
+
+// writeIssuedCertificate writes a certificate issued by the CA, followed by the CA in the chain
+func writeIssuedCertificate(t *testing.T, dir string, ca *x509.Certificate, caKey crypto.Signer, responder string, name string) infrastructure.Certificate {
+	t.Helper()
+	key := ecdsaKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if responder != "" {
+		template.OCSPServer = []string{responder}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	certificate := infrastructure.Certificate{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	os.WriteFile(certificate.CertFile, chain, 0o644)
+	os.WriteFile(certificate.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certificate
+}
+
+func staple(store *CertStore, serverName string) []byte {
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return nil
+	}
+	return certificate.OCSPStaple
+}
+
+func TestCertStore_StaplesOCSPResponse(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := newTestCA(t, dir)
+	_, server := newTestResponder(t, ca, caKey)
+	certificate := writeIssuedCertificate(t, dir, ca, caKey, server.URL, "api.example.com")
+	config := infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{certificate}, OCSP: infrastructure.OCSPStapling{Enabled: true}}
+	store, err := NewCertStore(config, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if err := store.Watch(); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer store.Close()
+	waitFor(t, func() bool { return staple(store, "api.example.com") != nil })
+
+	var stapled []byte
+	clientConfig := &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true, VerifyConnection: func(state tls.ConnectionState) error {
+		stapled = state.OCSPResponse
+		return nil
+	}}
+	if _, err := handshake(t, &tls.Config{GetCertificate: store.GetCertificate}, clientConfig); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	response, err := ocsp.ParseResponse(stapled, ca)
+	if err != nil {
+		t.Fatalf("Expected a valid stapled response, got %v", err)
+	}
+	if response.Status != ocsp.Good {
+		t.Errorf("Expected a good status, got %d", response.Status)
+	}
+}
+
+func TestOCSPStapler_Refresh(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := newTestCA(t, dir)
+	responder, server := newTestResponder(t, ca, caKey)
+	// The responder override serves certificates that do not name one
+	certificate := writeIssuedCertificate(t, dir, ca, caKey, "", "api.example.com")
+	selfSigned := writeCertificate(t, dir, ecdsaKey(t), "self.example.com")
+	config := infrastructure.LoadBalancer{
+		Certificates: []infrastructure.Certificate{certificate, selfSigned},
+		OCSP:         infrastructure.OCSPStapling{Enabled: true, ResponderURL: server.URL},
+	}
+	store, err := NewCertStore(config, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	store.ocsp.retryInterval = 0
+
+	store.ocsp.refresh()
+	first := staple(store, "api.example.com")
+	if first == nil {
+		t.Fatalf("Expected a stapled response")
+	}
+	if staple(store, "self.example.com") != nil {
+		t.Errorf("Expected no response for a certificate without an issuer")
+	}
+
+	time.Sleep(time.Second) // responses are accurate to the second
+	store.ocsp.refresh()
+	refreshed := staple(store, "api.example.com")
+	if refreshed == nil || bytes.Equal(refreshed, first) {
+		t.Errorf("Expected the response to be refreshed halfway to its next update")
+	}
+
+	responder.set(ocsp.Good, true)
+	store.ocsp.refresh()
+	if !bytes.Equal(staple(store, "api.example.com"), refreshed) {
+		t.Errorf("Expected the last good response to be kept while the responder is down")
+	}
+
+	responder.set(ocsp.Revoked, false)
+	store.ocsp.refresh()
+	if staple(store, "api.example.com") != nil {
+		t.Errorf("Expected no response to be stapled for a revoked certificate")
+	}
+	responder.mu.Lock()
+	defer responder.mu.Unlock()
+	if responder.requests != 4 {
+		t.Errorf("Expected 4 requests to the responder, got %d", responder.requests)
+	}
+}
@@ -0,0 +1,134 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// TLS policy presets, after Mozilla's server side TLS recommendations
+const (
+	PresetModern       = "modern"
+	PresetIntermediate = "intermediate"
+)
+
+var defaultALPN = []string{"h2", "http/1.1"}
+
+type preset struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+var presets = map[string]preset{
+	PresetModern: {
+		minVersion: tls.VersionTLS13,
+		curves:     []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	PresetIntermediate: {
+		minVersion: tls.VersionTLS12,
+		// ECDSA and RSA variants of every suite, so both kinds of certificates work with TLS 1.2 clients
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		curves: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+}
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// NewServerConfig creates the listener's TLS config from the policy's preset and overrides. Certificates
+// and client authentication are configured on the result.
+func NewServerConfig(policy infrastructure.TLSPolicy) (*tls.Config, error) {
+	name := policy.Preset
+	if name == "" {
+		name = PresetIntermediate
+	}
+	base, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid TLS preset: %s", policy.Preset)
+	}
+	config := &tls.Config{
+		MinVersion:       base.minVersion,
+		MaxVersion:       tls.VersionTLS13,
+		CipherSuites:     slices.Clone(base.cipherSuites),
+		CurvePreferences: slices.Clone(base.curves),
+		NextProtos:       slices.Clone(defaultALPN),
+	}
+	var err error
+	if policy.MinVersion != "" {
+		if config.MinVersion, err = parseVersion(policy.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MaxVersion != "" {
+		if config.MaxVersion, err = parseVersion(policy.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("TLS min_version %s is above max_version %s", tls.VersionName(config.MinVersion), tls.VersionName(config.MaxVersion))
+	}
+	if len(policy.CipherSuites) > 0 {
+		if config.CipherSuites, err = parseCipherSuites(policy.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if len(policy.Curves) > 0 {
+		config.CurvePreferences = nil
+		for _, name := range policy.Curves {
+			curve, ok := curves[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]
+			if !ok {
+				return nil, fmt.Errorf("unsupported curve: %s", name)
+			}
+			config.CurvePreferences = append(config.CurvePreferences, curve)
+		}
+	}
+	if len(policy.ALPN) > 0 {
+		config.NextProtos = slices.Clone(policy.ALPN)
+	}
+	return config, nil
+}
+
+func parseVersion(version string) (uint16, error) {
+	parsed, ok := versions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %s, expected 1.2 or 1.3", version)
+	}
+	return parsed, nil
+}
+
+// parseCipherSuites looks up TLS 1.2 suites by name, suites with known weaknesses are refused
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		i := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite: %s", name)
+		}
+		suite := tls.CipherSuites()[i]
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %s is not configurable, TLS 1.3 suites are always enabled", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
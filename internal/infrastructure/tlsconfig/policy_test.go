@@ -0,0 +1,77 @@
+package tlsconfig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"expvar"
+	"slices"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestNewServerConfig_Presets(t *testing.T) {
+	config, err := NewServerConfig(infrastructure.TLSPolicy{})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || !slices.Contains(config.CipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		t.Errorf("Expected the intermediate preset by default, got min version %x and suites %v", config.MinVersion, config.CipherSuites)
+	}
+	if !slices.Equal(config.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("Unexpected default ALPN %v", config.NextProtos)
+	}
+
+	config, err = NewServerConfig(infrastructure.TLSPolicy{
+		Preset:       PresetModern,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"P-256", "x25519"},
+		ALPN:         []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || !slices.Equal(config.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}) {
+		t.Errorf("Expected the overrides to apply, got min version %x and suites %v", config.MinVersion, config.CipherSuites)
+	}
+	if !slices.Equal(config.CurvePreferences, []tls.CurveID{tls.CurveP256, tls.X25519}) || !slices.Equal(config.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("Unexpected curves %v or ALPN %v", config.CurvePreferences, config.NextProtos)
+	}
+}
+
+func TestNewServerConfig_Invalid(t *testing.T) {
+	for _, policy := range []infrastructure.TLSPolicy{
+		{Preset: "old"},
+		{MinVersion: "1.0"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{Curves: []string{"P224"}},
+	} {
+		if _, err := NewServerConfig(policy); err == nil {
+			t.Errorf("Expected %+v to be rejected", policy)
+		}
+	}
+}
+
+func TestNewServerConfig_ECDSAOnTLS12(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for _, certificate := range []infrastructure.Certificate{
+		writeCertificate(t, dir, ecdsaKey(t), "ecdsa.example.com"),
+		writeCertificate(t, dir, rsaKey, "rsa.example.com"),
+	} {
+		store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{certificate}}, new(expvar.Map), zaptest.NewLogger(t))
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		serverConfig, _ := NewServerConfig(infrastructure.TLSPolicy{})
+		serverConfig.GetCertificate = store.GetCertificate
+		if _, err := handshake(t, serverConfig, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err != nil {
+			t.Errorf("%s: expected a TLS 1.2 handshake, got %v", certificate.CertFile, err)
+		}
+	}
+}
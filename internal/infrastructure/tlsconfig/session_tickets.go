@@ -0,0 +1,79 @@
+package tlsconfig
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap"
+)
+
+const sessionTicketKeyLength = 32
+
+// WatchSessionTicketKeys sets the session ticket keys of the config from the shared key file and updates
+// them whenever the file changes. Rotating the file, by adding a new first key and keeping the previous keys
+// for the lifetime of their tickets, rotates the keys of every replica without breaking resumption.
+func WatchSessionTicketKeys(config *tls.Config, file string, logger *zap.Logger) (io.Closer, error) {
+	keys, err := readSessionTicketKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	config.SetSessionTicketKeys(keys)
+	return infrastructure.WatchFile(file, func() {
+		keys, err := readSessionTicketKeys(file)
+		if err != nil {
+			logger.Error("Failed to reload session ticket keys, keeping the previous keys", zap.Error(err))
+			return
+		}
+		config.SetSessionTicketKeys(keys)
+		logger.Info("Reloaded session ticket keys", zap.Int("keys", len(keys)))
+	})
+}
+
+// readSessionTicketKeys reads one base64 or hex encoded key per line, with "#" comments
+func readSessionTicketKeys(file string) ([][32]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("session ticket keys: %w", err)
+	}
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		encoded, _, _ := strings.Cut(scanner.Text(), "#")
+		if encoded = strings.TrimSpace(encoded); encoded == "" {
+			continue
+		}
+		key, err := decodeSessionTicketKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("session ticket keys %s:%d: %w", file, line, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("session ticket keys: no keys in %s", file)
+	}
+	return keys, nil
+}
+
+func decodeSessionTicketKey(encoded string) ([32]byte, error) {
+	var key [32]byte
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		if decoded, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return key, errors.New("key is neither hex nor base64 encoded")
+		}
+	}
+	if len(decoded) != sessionTicketKeyLength {
+		return key, fmt.Errorf("key is %d bytes, expected %d", len(decoded), sessionTicketKeyLength)
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
@@ -0,0 +1,103 @@
+package tlsconfig
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func sessionTicketKey(t *testing.T) []byte {
+	key := make([]byte, sessionTicketKeyLength)
+	rand.Read(key)
+	return key
+}
+
+// resumes reports whether a client that got a ticket from the first server resumes its session on the second
+func resumes(t *testing.T, first, second *tls.Config) bool {
+	t.Helper()
+	clientConfig := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1), MaxVersion: tls.VersionTLS12}
+	for _, serverConfig := range []*tls.Config{first, second} {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			server := tls.Server(serverConn, serverConfig)
+			io.Copy(io.Discard, server) // until the client's close_notify
+			server.Close()
+		}()
+		client := tls.Client(clientConn, clientConfig)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		resumed := client.ConnectionState().DidResume
+		client.Close()
+		if serverConfig == second {
+			return resumed
+		}
+	}
+	return false
+}
+
+func TestWatchSessionTicketKeys_SharedAcrossReplicas(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCertStore(infrastructure.LoadBalancer{Certificates: []infrastructure.Certificate{writeCertificate(t, dir, ecdsaKey(t), "www.example.com")}}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	newReplica := func() *tls.Config {
+		config, _ := NewServerConfig(infrastructure.TLSPolicy{})
+		config.GetCertificate = store.GetCertificate
+		return config
+	}
+	if resumes(t, newReplica(), newReplica()) {
+		t.Fatalf("Did not expect replicas with their own keys to resume each other's sessions")
+	}
+
+	keyFile := filepath.Join(dir, "tickets.key")
+	oldKey, newKey := sessionTicketKey(t), sessionTicketKey(t)
+	os.WriteFile(keyFile, []byte("# current key first\n"+hex.EncodeToString(oldKey)+"\n"), 0o600)
+	first, second := newReplica(), newReplica()
+	for _, config := range []*tls.Config{first, second} {
+		watcher, err := WatchSessionTicketKeys(config, keyFile, zaptest.NewLogger(t))
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		defer watcher.Close()
+	}
+	if !resumes(t, first, second) {
+		t.Errorf("Expected replicas sharing the key file to resume each other's sessions")
+	}
+
+	// Rotation: the new key encrypts, the old key still decrypts tickets issued before the rotation
+	rotated := newReplica()
+	os.WriteFile(filepath.Join(dir, "rotated.key"), []byte(base64.StdEncoding.EncodeToString(newKey)+"\n"+hex.EncodeToString(oldKey)+"\n"), 0o600)
+	if _, err := WatchSessionTicketKeys(rotated, filepath.Join(dir, "rotated.key"), zaptest.NewLogger(t)); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if !resumes(t, first, rotated) {
+		t.Errorf("Expected tickets of the old key to resume after the rotation")
+	}
+}
+
+func TestReadSessionTicketKeys_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty":   "# no keys\n",
+		"short":   hex.EncodeToString(make([]byte, 16)),
+		"garbage": "not a key!",
+	} {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(content), 0o600)
+		if _, err := readSessionTicketKeys(file); err == nil {
+			t.Errorf("%s: expected the key file to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package httphandler
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap"
+)
+
+// AccessList admits or refuses clients by IP range. Ranges from files are reloaded when the files change,
+// lookups read the current ranges without locking.
+type AccessList struct {
+	config  infrastructure.AccessControl
+	ranges  atomic.Pointer[accessRanges]
+	reload  sync.Mutex // serializes reloads of the two files
+	metrics *expvar.Map
+	logger  *zap.Logger
+}
+
+type accessRanges struct {
+	allow, deny *prefixTrie
+	allowAll    bool // no allowed ranges are configured, every client that is not denied is admitted
+}
+
+// NewAccessList loads the ranges of the config and watches its files. It returns nil when the config has
+// no ranges and no files, so routes without access control pay nothing.
+func NewAccessList(config infrastructure.AccessControl, metrics *expvar.Map, logger *zap.Logger) (*AccessList, error) {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 && config.AllowFile == "" && config.DenyFile == "" {
+		return nil, nil
+	}
+	al := &AccessList{config: config, metrics: metrics, logger: logger}
+	if err := al.load(); err != nil {
+		return nil, err
+	}
+	for _, file := range []string{config.AllowFile, config.DenyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := infrastructure.WatchFile(file, al.reloadFile); err != nil {
+			return nil, err
+		}
+	}
+	return al, nil
+}
+
+func (al *AccessList) reloadFile() {
+	if err := al.load(); err != nil {
+		al.logger.Error("Failed to reload access control ranges, keeping the previous ranges", zap.Error(err))
+		return
+	}
+	al.logger.Info("Reloaded access control ranges")
+}
+
+// load builds the tries from the inline ranges and the files, and swaps them in once both files parsed
+func (al *AccessList) load() error {
+	al.reload.Lock()
+	defer al.reload.Unlock()
+	allow, err := readRanges(al.config.Allow, al.config.AllowFile)
+	if err != nil {
+		return fmt.Errorf("allowed ranges: %w", err)
+	}
+	deny, err := readRanges(al.config.Deny, al.config.DenyFile)
+	if err != nil {
+		return fmt.Errorf("denied ranges: %w", err)
+	}
+	// An allow_file without ranges admits no one, rather than everyone
+	ranges := &accessRanges{allow: newPrefixTrie(), deny: newPrefixTrie(), allowAll: len(al.config.Allow) == 0 && al.config.AllowFile == ""}
+	for _, prefix := range allow {
+		ranges.allow.insert(prefix)
+	}
+	for _, prefix := range deny {
+		ranges.deny.insert(prefix)
+	}
+	al.ranges.Store(ranges)
+	return nil
+}
+
+// readRanges parses the inline ranges followed by the ranges of the file, if any
+func readRanges(inline []string, file string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range inline {
+		prefix, err := infrastructure.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if file == "" {
+		return prefixes, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		cidr, _, _ := strings.Cut(scanner.Text(), "#")
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := infrastructure.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid range %q: %w", file, line, cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether the client IP is admitted, a client whose IP is unknown only passes lists
+// without allowed ranges
+func (al *AccessList) Allowed(clientIP string) bool {
+	ranges := al.ranges.Load()
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return ranges.allowAll
+	}
+	if ranges.deny.contains(ip) {
+		return false
+	}
+	return ranges.allowAll || ranges.allow.contains(ip)
+}
+
+// NewAccessControlMiddleware refuses requests with 403 unless every list admits the client IP. It runs
+// ahead of rate limits, so refused clients do not use up anyone's quota.
+func NewAccessControlMiddleware(lists []*AccessList, next http.Handler, logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := getClientIP(r)
+		for _, list := range lists {
+			if !list.Allowed(clientIP) {
+				list.metrics.Add("denied", 1)
+				logger.Debug("Access denied", zap.String("client_ip", clientIP), zap.String("route", matchedRoute(r)))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,158 @@
+package httphandler
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/loadbalancing"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAccessList_Allowed(t *testing.T) {
+	list, err := NewAccessList(infrastructure.AccessControl{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.6.6.0/24"},
+	}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.1.1", true},
+		{"10.6.6.6", false}, // denied ranges take precedence
+		{"203.0.113.7", false},
+		{"2001:db8::1", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := list.Allowed(tt.ip); got != tt.want {
+			t.Errorf("Allowed(%q): expected %v, got %v", tt.ip, tt.want, got)
+		}
+	}
+
+	denyOnly, _ := NewAccessList(infrastructure.AccessControl{Deny: []string{"203.0.113.0/24"}}, new(expvar.Map), zaptest.NewLogger(t))
+	if !denyOnly.Allowed("198.51.100.1") || denyOnly.Allowed("203.0.113.7") {
+		t.Errorf("Expected a deny list to only refuse its ranges")
+	}
+}
+
+func TestNewAccessList_Invalid(t *testing.T) {
+	if list, err := NewAccessList(infrastructure.AccessControl{}, nil, zaptest.NewLogger(t)); list != nil || err != nil {
+		t.Errorf("Expected no list without ranges")
+	}
+	if _, err := NewAccessList(infrastructure.AccessControl{Deny: []string{"10.0.0.0/40"}}, nil, zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected an invalid range to be rejected")
+	}
+	if _, err := NewAccessList(infrastructure.AccessControl{AllowFile: "missing.txt"}, nil, zaptest.NewLogger(t)); err == nil {
+		t.Errorf("Expected a missing file to be rejected")
+	}
+}
+
+func TestAccessList_EmptyAllowFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allow.txt")
+	os.WriteFile(file, []byte("# corporate ranges, none yet\n"), 0o644)
+	list, err := NewAccessList(infrastructure.AccessControl{AllowFile: file}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if list.Allowed("198.51.100.1") || list.Allowed("") {
+		t.Errorf("Expected an allow file without ranges to admit no one")
+	}
+}
+
+func TestAccessList_ReloadsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(file, []byte("# known bad ranges\n203.0.113.0/24\n"), 0o644)
+	list, err := NewAccessList(infrastructure.AccessControl{DenyFile: file}, new(expvar.Map), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if list.Allowed("203.0.113.7") || !list.Allowed("198.51.100.1") {
+		t.Fatalf("Expected the ranges of the file to apply")
+	}
+
+	os.WriteFile(file, []byte("198.51.100.0/24 # moved\n"), 0o644)
+	waitFor(t, func() bool { return list.Allowed("203.0.113.7") && !list.Allowed("198.51.100.1") })
+
+	// A broken file keeps the previous ranges
+	os.WriteFile(file, []byte("not-a-range\n"), 0o644)
+	time.Sleep(300 * time.Millisecond)
+	if list.Allowed("198.51.100.1") {
+		t.Errorf("Expected the previous ranges to be kept")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouteHandlers_AccessControl(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	config := &infrastructure.Config{
+		RateLimiter:   infrastructure.RateLimiter{Type: "none"},
+		AccessControl: infrastructure.AccessControl{Deny: []string{"203.0.113.0/24"}},
+		Routes: []infrastructure.Route{
+			{Path: "/apiA"},
+			{Path: "/admin", AccessControl: &infrastructure.AccessControl{Allow: []string{"10.0.0.0/8"}}},
+		},
+	}
+	routes := map[string]*loadbalancing.Route{
+		"/apiA":  loadbalancing.NewRoute(nil, "", "", logger),
+		"/admin": loadbalancing.NewRoute(nil, "", "", logger),
+	}
+	handlers, err := NewRouteHandlers(routes, config, nil, logger)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	router := NewPathRouterExactPath(handlers)
+	metrics := infrastructure.SubMetricsMap(infrastructure.MetricsMap("access_control"), "/admin")
+	deniedBefore := counterValue(metrics, "denied")
+	send := func(path, remoteAddr string) int {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		path, remoteAddr string
+		forbidden        bool
+	}{
+		{"/apiA", "198.51.100.1:1234", false},
+		{"/apiA", "203.0.113.7:1234", true},
+		{"/admin", "10.0.0.1:1234", false},
+		{"/admin", "198.51.100.1:1234", true},
+	}
+	for _, tt := range tests {
+		if code := send(tt.path, tt.remoteAddr); (code == http.StatusForbidden) != tt.forbidden {
+			t.Errorf("%s from %s: unexpected status %d", tt.path, tt.remoteAddr, code)
+		}
+	}
+	if denied := counterValue(metrics, "denied") - deniedBefore; denied != 1 {
+		t.Errorf("Expected the denied request to be counted, got %d", denied)
+	}
+}
+
+// counterValue reads a counter of the published metrics, which outlive a single test run
+func counterValue(metrics *expvar.Map, key string) int64 {
+	if counter, ok := metrics.Get(key).(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
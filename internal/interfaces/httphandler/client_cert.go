@@ -0,0 +1,126 @@
+package httphandler
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Default headers carrying the verified client certificate identity to backends
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertSANs        = "X-Client-Cert-SANs"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// verifiedClientCert returns the client certificate of the request if the TLS handshake verified it
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// clientCertSANs lists the subject alternative names of the certificate: DNS names, emails, URIs and IPs
+func clientCertSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// NewClientCertHeadersMiddleware passes the identity of verified client certificates to backends. The
+// headers are always replaced, so clients cannot claim an identity by sending them.
+func NewClientCertHeadersMiddleware(config infrastructure.ClientAuth, next http.Handler) http.Handler {
+	subjectHeader := headerOrDefault(config.SubjectHeader, HeaderClientCertSubject)
+	sansHeader := headerOrDefault(config.SANsHeader, HeaderClientCertSANs)
+	fingerprintHeader := headerOrDefault(config.FingerprintHeader, HeaderClientCertFingerprint)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(subjectHeader)
+		r.Header.Del(sansHeader)
+		r.Header.Del(fingerprintHeader)
+		if cert := verifiedClientCert(r); cert != nil {
+			fingerprint := sha256.Sum256(cert.Raw)
+			r.Header.Set(subjectHeader, cert.Subject.String())
+			r.Header.Set(sansHeader, strings.Join(clientCertSANs(cert), ", "))
+			r.Header.Set(fingerprintHeader, hex.EncodeToString(fingerprint[:]))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func headerOrDefault(header string, fallback string) string {
+	if header == "" {
+		return fallback
+	}
+	return http.CanonicalHeaderKey(header)
+}
+
+// ClientCertRule admits requests by their verified client certificate
+type ClientCertRule struct {
+	subjects []string
+	sans     []string
+}
+
+func NewClientCertRule(config *infrastructure.ClientCertRule) (*ClientCertRule, error) {
+	if config == nil || (!config.Required && len(config.Subjects) == 0 && len(config.SANs) == 0) {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string{}, config.Subjects...), config.SANs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid client certificate pattern %q: %w", pattern, err)
+		}
+	}
+	return &ClientCertRule{subjects: config.Subjects, sans: config.SANs}, nil
+}
+
+// Allows reports whether the certificate is admitted, any verified certificate is when no patterns are set
+func (rule *ClientCertRule) Allows(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	if len(rule.subjects) == 0 && len(rule.sans) == 0 {
+		return true
+	}
+	if matchesAny(rule.subjects, cert.Subject.String()) {
+		return true
+	}
+	for _, san := range clientCertSANs(cert) {
+		if matchesAny(rule.sans, san) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClientCertMiddleware refuses requests with 403 unless their verified client certificate is admitted by
+// the rule. The listener must verify client certificates, see client_auth.
+func NewClientCertMiddleware(rule *ClientCertRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rule.Allows(verifiedClientCert(r)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
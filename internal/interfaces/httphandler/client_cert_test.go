@@ -0,0 +1,88 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// withClientCert returns a request whose TLS handshake verified a client certificate of the subject and URI
+func withClientCert(subject pkix.Name, uri string) *http.Request {
+	req := httptest.NewRequest("GET", "https://localhost/apiA", nil)
+	cert := &x509.Certificate{Raw: []byte(subject.CommonName), Subject: subject, DNSNames: []string{"client.corp"}}
+	if uri != "" {
+		parsed, _ := url.Parse(uri)
+		cert.URIs = []*url.URL{parsed}
+	}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestClientCertHeadersMiddleware(t *testing.T) {
+	var got *http.Request
+	handler := NewClientCertHeadersMiddleware(infrastructure.ClientAuth{SubjectHeader: "x-ssl-client-dn"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	req := withClientCert(pkix.Name{CommonName: "payments", Organization: []string{"Corp"}}, "spiffe://corp/ns/payments/sa/api")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if subject := got.Header.Get("X-Ssl-Client-Dn"); subject != "CN=payments,O=Corp" {
+		t.Errorf("Unexpected subject header %q", subject)
+	}
+	if sans := got.Header.Get(HeaderClientCertSANs); sans != "client.corp, spiffe://corp/ns/payments/sa/api" {
+		t.Errorf("Unexpected SANs header %q", sans)
+	}
+	if fingerprint := got.Header.Get(HeaderClientCertFingerprint); len(fingerprint) != 64 {
+		t.Errorf("Expected a SHA-256 fingerprint, got %q", fingerprint)
+	}
+
+	// Clients without a verified certificate cannot claim an identity
+	req = httptest.NewRequest("GET", "https://localhost/apiA", nil)
+	req.Header.Set("X-SSL-Client-DN", "CN=admin")
+	req.Header.Set(HeaderClientCertFingerprint, "00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Header.Get("X-Ssl-Client-Dn") != "" || got.Header.Get(HeaderClientCertFingerprint) != "" {
+		t.Errorf("Expected the identity headers of the client to be dropped")
+	}
+}
+
+func TestClientCertMiddleware(t *testing.T) {
+	rule, err := NewClientCertRule(&infrastructure.ClientCertRule{
+		Subjects: []string{"CN=*,O=Corp"},
+		SANs:     []string{"spiffe://corp/ns/payments/*/*"},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	handler := NewClientCertMiddleware(rule, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"subject match", withClientCert(pkix.Name{CommonName: "billing", Organization: []string{"Corp"}}, ""), http.StatusOK},
+		{"san match", withClientCert(pkix.Name{CommonName: "api"}, "spiffe://corp/ns/payments/sa/api"), http.StatusOK},
+		{"no match", withClientCert(pkix.Name{CommonName: "api"}, "spiffe://corp/ns/billing/sa/api"), http.StatusForbidden},
+		{"no certificate", httptest.NewRequest("GET", "https://localhost/apiA", nil), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tt.req)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+
+	if rule, _ := NewClientCertRule(&infrastructure.ClientCertRule{}); rule != nil {
+		t.Errorf("Expected no rule when nothing is required")
+	}
+	if _, err := NewClientCertRule(&infrastructure.ClientCertRule{SANs: []string{"[bad"}}); err == nil {
+		t.Errorf("Expected an invalid pattern to be rejected")
+	}
+}
@@ -0,0 +1,192 @@
+package httphandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Headers proxies put the client IP in
+const (
+	HeaderXForwardedFor   = "X-Forwarded-For"
+	HeaderForwarded       = "Forwarded"
+	HeaderXRealIP         = "X-Real-IP"
+	HeaderXForwardedProto = "X-Forwarded-Proto"
+)
+
+// ClientIPResolver finds the IP of the client behind the proxies the load balancer trusts
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+	headers        []string // canonical header names, in order of preference
+}
+
+// NewClientIPResolver creates a resolver trusting the proxies in the CIDRs, or single addresses, to report
+// the client IP in the headers. Without trusted proxies the client IP is the connection's peer.
+func NewClientIPResolver(trustedProxies []string, headers []string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{}
+	for _, cidr := range trustedProxies {
+		prefix, err := infrastructure.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, prefix)
+	}
+	if len(headers) == 0 {
+		headers = []string{HeaderXForwardedFor}
+	}
+	for _, header := range headers {
+		header = http.CanonicalHeaderKey(header)
+		switch header {
+		case HeaderXForwardedFor, HeaderForwarded, http.CanonicalHeaderKey(HeaderXRealIP):
+			resolver.headers = append(resolver.headers, header)
+		default:
+			return nil, fmt.Errorf("unsupported client IP header: %s", header)
+		}
+	}
+	return resolver, nil
+}
+
+func (cr *ClientIPResolver) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range cr.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client IP of the request. Headers are only believed when the peer is a trusted proxy,
+// and forwarding chains are read from the right, skipping trusted proxies, since every hop appends to them
+// and only the hops added by trusted proxies cannot be spoofed by the client.
+func (cr *ClientIPResolver) Resolve(r *http.Request) string {
+	peer, ok := peerAddr(r)
+	if !ok {
+		return ""
+	}
+	if !cr.trusted(peer) {
+		return peer.String()
+	}
+	for _, header := range cr.headers {
+		var ip netip.Addr
+		switch header {
+		case HeaderXForwardedFor:
+			ip, ok = cr.rightmostUntrusted(forwardedForHops(r.Header.Values(HeaderXForwardedFor)))
+		case HeaderForwarded:
+			ip, ok = cr.rightmostUntrusted(forwardedHops(r.Header.Values(HeaderForwarded)))
+		default:
+			ip, ok = parseHop(r.Header.Get(HeaderXRealIP))
+		}
+		if ok {
+			return ip.String()
+		}
+	}
+	return peer.String()
+}
+
+// rightmostUntrusted returns the nearest hop that is not a trusted proxy, or the farthest hop when the
+// whole chain is trusted. It gives up on a hop that is not an IP, e.g. "unknown" or an obfuscated identifier.
+func (cr *ClientIPResolver) rightmostUntrusted(hops []string) (netip.Addr, bool) {
+	var farthest netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseHop(hops[i])
+		if !ok {
+			return netip.Addr{}, false
+		}
+		if !cr.trusted(ip) {
+			return ip, true
+		}
+		farthest = ip
+	}
+	return farthest, farthest.IsValid()
+}
+
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return parseHop(r.RemoteAddr)
+}
+
+// parseHop parses an address as found in forwarding headers, optionally bracketed and with a port
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+// forwardedForHops splits X-Forwarded-For headers into hops, the header may be repeated
+func forwardedForHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return hops
+}
+
+// forwardedHops returns the for= parameters of RFC 7239 Forwarded headers, e.g.
+// Forwarded: for=192.0.2.60;proto=https, for="[2001:db8::17]:4711"
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// NewClientIPMiddleware resolves the client IP once per request, records it in the request context for rate
+// limits and logs, and rewrites the forwarding headers sent to backends. Forwarding headers of untrusted
+// peers are dropped, as the client may have forged them.
+func NewClientIPMiddleware(resolver *ClientIPResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := resolver.Resolve(r)
+		peer, ok := peerAddr(r)
+		trusted := ok && resolver.trusted(peer)
+		if !trusted {
+			r.Header.Del(HeaderXForwardedFor)
+			r.Header.Del(HeaderForwarded)
+			r.Header.Del(HeaderXRealIP)
+			r.Header.Del(HeaderXForwardedProto)
+		}
+		if ok {
+			forwardedFor := peer.String()
+			if prior := r.Header.Values(HeaderXForwardedFor); len(prior) > 0 {
+				forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+			}
+			r.Header.Set(HeaderXForwardedFor, forwardedFor)
+		}
+		if clientIP != "" {
+			r.Header.Set(HeaderXRealIP, clientIP)
+			r = r.WithContext(domain.WithClientIP(r.Context(), clientIP))
+		}
+		if r.Header.Get(HeaderXForwardedProto) == "" { // a trusted proxy may have terminated TLS already
+			proto := "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+			r.Header.Set(HeaderXForwardedProto, proto)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+func TestClientIPResolver_Resolve(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "2001:db8:ffff::/48"}, []string{"x-forwarded-for", "Forwarded", "X-Real-IP"})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer without headers", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"rightmost untrusted hop", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		{"whole chain trusted", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "10.3.3.3, 10.1.1.1"}, "10.3.3.3"},
+		{"garbage hop falls through", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "not-an-ip", "X-Real-IP": "198.51.100.9"}, "198.51.100.9"},
+		{"forwarded header", "10.0.0.2:1234", map[string]string{"Forwarded": `for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded header skips trusted", "10.0.0.2:1234", map[string]string{"Forwarded": `for=192.0.2.60, for="[2001:db8:ffff::1]"`}, "192.0.2.60"},
+		{"x-real-ip", "10.0.0.2:1234", map[string]string{"X-Real-IP": "198.51.100.9"}, "198.51.100.9"},
+		{"ipv4 mapped peer", "[::ffff:10.0.0.2]:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for header, value := range tt.headers {
+			req.Header.Set(header, value)
+		}
+		if got := resolver.Resolve(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNewClientIPResolver_Invalid(t *testing.T) {
+	if _, err := NewClientIPResolver([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Errorf("Expected an invalid CIDR to be rejected")
+	}
+	if _, err := NewClientIPResolver(nil, []string{"CF-Connecting-IP"}); err == nil {
+		t.Errorf("Expected an unsupported header to be rejected")
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	resolver, _ := NewClientIPResolver([]string{"10.0.0.0/8"}, nil)
+	var got *http.Request
+	handler := NewClientIPMiddleware(resolver, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	// Behind a trusted proxy the chain is kept and the proxy appended
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if ip, _ := domain.ClientIP(got.Context()); ip != "198.51.100.1" {
+		t.Errorf("Expected the client IP in the context, got %q", ip)
+	}
+	if xff := got.Header.Get("X-Forwarded-For"); xff != "198.51.100.1, 10.0.0.2" {
+		t.Errorf("Unexpected X-Forwarded-For %q", xff)
+	}
+	if proto := got.Header.Get("X-Forwarded-Proto"); proto != "https" {
+		t.Errorf("Expected the trusted proxy's X-Forwarded-Proto to be kept, got %q", proto)
+	}
+	if getClientIP(got) != "198.51.100.1" {
+		t.Errorf("Expected rate limits to use the resolved client IP, got %s", getClientIP(got))
+	}
+
+	// Headers of an untrusted peer are forged as far as we know
+	req = httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if xff := got.Header.Get("X-Forwarded-For"); xff != "203.0.113.7" {
+		t.Errorf("Expected forged X-Forwarded-For to be replaced, got %q", xff)
+	}
+	if realIP := got.Header.Get("X-Real-IP"); realIP != "203.0.113.7" {
+		t.Errorf("Expected forged X-Real-IP to be replaced, got %q", realIP)
+	}
+	if proto := got.Header.Get("X-Forwarded-Proto"); proto != "http" {
+		t.Errorf("Expected X-Forwarded-Proto of the connection, got %q", proto)
+	}
+}
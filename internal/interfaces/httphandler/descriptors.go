@@ -0,0 +1,164 @@
+package httphandler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+// Descriptor entry keys, a rate limit key is a list of them, e.g. ["route", "remote_address"]
+const (
+	DescriptorRemoteAddress = "remote_address" // client IP
+	DescriptorRoute         = "route"          // matched route path
+	DescriptorHeaderPrefix  = "header:"        // value of a request header, e.g. "header:X-API-Key"
+	DescriptorCookiePrefix  = "cookie:"        // value of a cookie, e.g. "cookie:session"
+	DescriptorJWTPrefix     = "jwt:"           // claim of the bearer token, e.g. "jwt:sub", see jwtClaim
+)
+
+// DefaultIPv6Prefix is the prefix length client IPv6 addresses are aggregated to, a /64 is usually
+// handed to a single subscriber who can rotate through its addresses at will
+const DefaultIPv6Prefix = 64
+
+var errMissingClientIP = errors.New("could not determine client IP")
+
+// descriptorAction extracts one entry of a descriptor, it reports false when the request lacks the property
+type descriptorAction func(r *http.Request) (domain.DescriptorEntry, bool, error)
+
+// DescriptorExtractor builds the rate limit descriptor of a request from a list of keys
+type DescriptorExtractor struct {
+	actions    []descriptorAction
+	ipv6Prefix int
+}
+
+// NewDescriptorExtractor creates an extractor for the keys, defaulting to the client IP
+func NewDescriptorExtractor(keys []string) (*DescriptorExtractor, error) {
+	if len(keys) == 0 {
+		keys = []string{DescriptorRemoteAddress}
+	}
+	extractor := &DescriptorExtractor{ipv6Prefix: DefaultIPv6Prefix}
+	for _, key := range keys {
+		action, err := extractor.newDescriptorAction(key)
+		if err != nil {
+			return nil, err
+		}
+		extractor.actions = append(extractor.actions, action)
+	}
+	return extractor, nil
+}
+
+// WithIPv6Prefix sets the prefix length client IPv6 addresses are counted by, 128 counts every address
+func (e *DescriptorExtractor) WithIPv6Prefix(bits int) *DescriptorExtractor {
+	if bits > 0 && bits <= 128 {
+		e.ipv6Prefix = bits
+	}
+	return e
+}
+
+func (e *DescriptorExtractor) newDescriptorAction(key string) (descriptorAction, error) {
+	switch {
+	case key == DescriptorRemoteAddress:
+		return func(r *http.Request) (domain.DescriptorEntry, bool, error) {
+			ip := getClientIP(r)
+			if ip == "" {
+				return domain.DescriptorEntry{}, false, errMissingClientIP
+			}
+			return domain.DescriptorEntry{Key: key, Value: e.aggregate(ip)}, true, nil
+		}, nil
+	case key == DescriptorRoute:
+		return func(r *http.Request) (domain.DescriptorEntry, bool, error) {
+			return domain.DescriptorEntry{Key: key, Value: matchedRoute(r)}, true, nil
+		}, nil
+	case strings.HasPrefix(key, DescriptorHeaderPrefix) && len(key) > len(DescriptorHeaderPrefix):
+		header := strings.TrimPrefix(key, DescriptorHeaderPrefix)
+		return func(r *http.Request) (domain.DescriptorEntry, bool, error) {
+			value := r.Header.Get(header)
+			return domain.DescriptorEntry{Key: key, Value: value}, value != "", nil
+		}, nil
+	case strings.HasPrefix(key, DescriptorCookiePrefix) && len(key) > len(DescriptorCookiePrefix):
+		name := strings.TrimPrefix(key, DescriptorCookiePrefix)
+		return func(r *http.Request) (domain.DescriptorEntry, bool, error) {
+			cookie, err := r.Cookie(name)
+			if err != nil || cookie.Value == "" {
+				return domain.DescriptorEntry{}, false, nil
+			}
+			return domain.DescriptorEntry{Key: key, Value: cookie.Value}, true, nil
+		}, nil
+	case strings.HasPrefix(key, DescriptorJWTPrefix) && len(key) > len(DescriptorJWTPrefix):
+		claim := strings.TrimPrefix(key, DescriptorJWTPrefix)
+		return func(r *http.Request) (domain.DescriptorEntry, bool, error) {
+			value, ok := jwtClaim(r, claim)
+			return domain.DescriptorEntry{Key: key, Value: value}, ok, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key: %s", key)
+	}
+}
+
+// jwtClaim reads a string or number claim from the payload of the request's bearer token. The signature is
+// not verified, the load balancer only counts by the claim, so a client forging tokens gets a quota per
+// forged value: authenticate tokens in front of the load balancer, or combine the claim with other keys.
+func jwtClaim(r *http.Request, claim string) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", false
+	}
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	raw, ok := claims[claim]
+	if !ok {
+		return "", false
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, value != ""
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String(), true
+	}
+	return "", false
+}
+
+// Extract builds the descriptor of the request. It reports false when the request lacks one of the
+// properties, e.g. a missing API key header, in which case the limit does not apply to it.
+func (e *DescriptorExtractor) Extract(r *http.Request) (domain.Descriptor, bool, error) {
+	descriptor := make(domain.Descriptor, 0, len(e.actions))
+	for _, action := range e.actions {
+		entry, ok, err := action(r)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		descriptor = append(descriptor, entry)
+	}
+	return descriptor, true, nil
+}
+
+// aggregate masks IPv6 addresses to the configured prefix, so a client cannot escape its limit by
+// rotating through the addresses of its network. IPv4 addresses are used as is.
+func (e *DescriptorExtractor) aggregate(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || addr.Is4In6() || e.ipv6Prefix == 128 {
+		return ip
+	}
+	prefix, err := addr.WithZone("").Prefix(e.ipv6Prefix)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
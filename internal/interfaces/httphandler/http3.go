@@ -0,0 +1,35 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewHTTP3Server creates the QUIC server of an HTTPS listener. It serves the handler of the listener's
+// server with the same TLS config, so certificates, client authentication and the middleware are shared.
+func NewHTTP3Server(config infrastructure.Listener, server *http.Server) (*http3.Server, error) {
+	if ListenerProtocol(config) != ProtocolHTTPS {
+		return nil, fmt.Errorf("listener %s: http3 requires the https protocol", config.Address)
+	}
+	return &http3.Server{
+		Addr:           config.Address,
+		Handler:        server.Handler,
+		TLSConfig:      server.TLSConfig,
+		IdleTimeout:    server.IdleTimeout,
+		MaxHeaderBytes: server.MaxHeaderBytes,
+	}, nil
+}
+
+// NewAltSvcMiddleware advertises the HTTP/3 server in the Alt-Svc header of HTTP/1.1 and HTTP/2 responses,
+// so clients switch to QUIC on their next connection
+func NewAltSvcMiddleware(server *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			server.SetQUICHeaders(w.Header()) // fails only before the server listens
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,114 @@
+package httphandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// localhostTLS returns a server config with a self-signed certificate for 127.0.0.1, and a pool trusting it
+func localhostTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+func TestHTTP3Server(t *testing.T) {
+	tlsConfig, roots := localhostTLS(t)
+	config := infrastructure.Listener{Address: "127.0.0.1:0", Protocol: ProtocolHTTPS, HTTP3: true}
+	server, err := NewServer(config, protoHandler, tlsConfig)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	http3Server, err := NewHTTP3Server(config, server)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	server.Handler = NewAltSvcMiddleware(http3Server, server.Handler)
+
+	// The QUIC listener shares the port of the TCP listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	packetConn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go Serve(server, listener)
+	go http3Server.Serve(packetConn)
+	defer server.Close()
+	defer http3Server.Close()
+
+	// Advertised once the QUIC listener is up
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	want := fmt.Sprintf(`h3=":%d"`, port)
+	waitFor(t, func() bool {
+		resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		resp.Body.Close()
+		return resp.ProtoMajor == 2 && strings.HasPrefix(resp.Header.Get("Alt-Svc"), want)
+	})
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer transport.Close()
+	resp, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("Expected HTTP/3.0, got %s", body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("Expected HTTP/3 responses not to advertise HTTP/3, got %q", resp.Header.Get("Alt-Svc"))
+	}
+}
+
+func TestNewHTTP3Server_RequiresHTTPS(t *testing.T) {
+	config := infrastructure.Listener{Protocol: ProtocolH2C, HTTP3: true}
+	server, err := NewServer(config, protoHandler, nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if _, err := NewHTTP3Server(config, server); err == nil {
+		t.Errorf("Expected http3 on an h2c listener to be rejected")
+	}
+}
@@ -1,14 +1,21 @@
 package httphandler
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 
 	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/ratelimiting"
 	"go.uber.org/zap"
 )
 
+// getClientIP returns the client IP resolved by the client IP middleware, or the connection's peer
 func getClientIP(r *http.Request) string {
+	if ip, ok := domain.ClientIP(r.Context()); ok {
+		return ip
+	}
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return ""
@@ -16,17 +23,82 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
-func NewMiddleware(limiter domain.RateLimiter, next http.Handler, logger *zap.Logger) http.Handler {
+// RateLimitRule applies a rate limiter to requests, counting them per descriptor
+type RateLimitRule struct {
+	Limiter    domain.RateLimiter
+	Descriptor *DescriptorExtractor
+	Methods    map[string]bool // methods the rule applies to, all methods when empty
+}
+
+func NewRateLimitRule(limiter domain.RateLimiter, keys []string, methods []string) (RateLimitRule, error) {
+	extractor, err := NewDescriptorExtractor(keys)
+	if err != nil {
+		return RateLimitRule{}, err
+	}
+	rule := RateLimitRule{Limiter: limiter, Descriptor: extractor, Methods: make(map[string]bool)}
+	for _, method := range methods {
+		rule.Methods[method] = true
+	}
+	return rule, nil
+}
+
+// NewRateLimitRules creates a rule with its own limiter for every rate limiter config. Limiters counting in
+// the store are namespaced by scope and their position in the list.
+func NewRateLimitRules(configs []infrastructure.RateLimiter, store *ratelimiting.RedisStore, scope string) ([]RateLimitRule, error) {
+	var rules []RateLimitRule
+	for i, config := range configs {
+		limiter, err := ratelimiting.NewStoreRateLimiter(config, store, fmt.Sprintf("%s:%d", scope, i))
+		if err != nil {
+			return nil, err
+		}
+		if config.IPv6Prefix < 0 || config.IPv6Prefix > 128 {
+			return nil, fmt.Errorf("%s rate limiter: invalid ipv6_prefix %d", config.Type, config.IPv6Prefix)
+		}
+		rule, err := NewRateLimitRule(limiter, config.Key, config.Methods)
+		if err != nil {
+			return nil, fmt.Errorf("%s rate limiter: %w", config.Type, err)
+		}
+		rule.Descriptor.WithIPv6Prefix(config.IPv6Prefix)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule RateLimitRule) appliesTo(r *http.Request) bool {
+	return len(rule.Methods) == 0 || rule.Methods[r.Method]
+}
+
+// NewMiddleware rejects requests that exceed any of the rate limit rules, and tells clients
+// about the quota closest to being exhausted
+func NewMiddleware(rules []RateLimitRule, response *RateLimitResponse, next http.Handler, logger *zap.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientIP := getClientIP(r)
-		if clientIP == "" {
-			logger.Error("Could not determine client IP from req", zap.Any("request_header", r.Header))
-			http.Error(w, "Could not determine client IP", http.StatusInternalServerError)
-			return
+		var closest rateLimitQuota
+		limited := false
+		for _, rule := range rules {
+			if !rule.appliesTo(r) {
+				continue
+			}
+			descriptor, ok, err := rule.Descriptor.Extract(r)
+			if err != nil {
+				logger.Error("Could not determine client IP from req", zap.String("remote_addr", r.RemoteAddr), zap.Any("request_header", r.Header))
+				http.Error(w, "Could not determine client IP", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				continue
+			}
+			allowed := rule.Limiter.IsAllowed(descriptor)
+			quota, ok := newRateLimitQuota(rule.Limiter, descriptor)
+			if !allowed {
+				response.reject(w, r, quota)
+				return
+			}
+			if ok && (!limited || quota.remaining < closest.remaining) {
+				closest, limited = quota, true
+			}
 		}
-		if !limiter.IsAllowed(clientIP) {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
+		if limited {
+			response.writeHeaders(w, closest)
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -0,0 +1,141 @@
+package httphandler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/ratelimiting"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDescriptorExtractor_Composite(t *testing.T) {
+	extractor, err := NewDescriptorExtractor([]string{DescriptorRoute, DescriptorRemoteAddress, "header:X-API-Key"})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	req := httptest.NewRequest("GET", "http://localhost/apiA/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-API-Key", "tenant-a")
+
+	descriptor, ok, err := extractor.Extract(req)
+	if err != nil || !ok {
+		t.Fatalf("Expected a descriptor, got ok=%v err=%v", ok, err)
+	}
+	if key := descriptor.Key(); key != "route=/apiA|remote_address=10.0.0.1|header:X-API-Key=tenant-a" {
+		t.Errorf("Unexpected descriptor key %s", key)
+	}
+
+	req.Header.Del("X-API-Key")
+	if _, ok, _ := extractor.Extract(req); ok {
+		t.Errorf("Expected no descriptor for a request without an API key")
+	}
+}
+
+func TestDescriptorExtractor_IPv6Prefix(t *testing.T) {
+	extractor, _ := NewDescriptorExtractor(nil)
+	key := func(remoteAddr string) string {
+		req := httptest.NewRequest("GET", "http://localhost/apiA/", nil)
+		req.RemoteAddr = remoteAddr
+		descriptor, _, _ := extractor.Extract(req)
+		return descriptor.Key()
+	}
+
+	if a, b := key("[2001:db8:1:2::1]:1234"), key("[2001:db8:1:2:ffff::9]:1234"); a != b {
+		t.Errorf("Expected addresses of the same /64 to share a descriptor, got %s and %s", a, b)
+	}
+	if a, b := key("[2001:db8:1:2::1]:1234"), key("[2001:db8:1:3::1]:1234"); a == b {
+		t.Errorf("Expected addresses of different /64s to have different descriptors")
+	}
+	if got := key("10.0.0.1:1234"); got != "remote_address=10.0.0.1" {
+		t.Errorf("Expected IPv4 addresses to be used as is, got %s", got)
+	}
+
+	extractor.WithIPv6Prefix(128)
+	if a, b := key("[2001:db8::1]:1234"), key("[2001:db8::2]:1234"); a == b {
+		t.Errorf("Expected a /128 prefix to count every address")
+	}
+}
+
+func TestDescriptorExtractor_JWTClaim(t *testing.T) {
+	extractor, err := NewDescriptorExtractor([]string{"jwt:sub", "jwt:org"})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	token := func(payload string) string {
+		return "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+	}
+	tests := []struct {
+		authorization, want string
+	}{
+		{token(`{"sub":"alice","org":42}`), "jwt:sub=alice|jwt:org=42"},
+		{token(`{"sub":"alice"}`), ""},    // missing claim
+		{token(`{"sub":{},"org":1}`), ""}, // not a string or number
+		{"Bearer not-a-token", ""},
+		{"Basic YWxpY2U6c2VjcmV0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		descriptor, ok, err := extractor.Extract(req)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		if got := descriptor.Key(); ok != (tt.want != "") || (ok && got != tt.want) {
+			t.Errorf("Authorization %q: expected descriptor %q, got %q (ok=%v)", tt.authorization, tt.want, got, ok)
+		}
+	}
+}
+
+func TestDescriptorExtractor_UnknownKey(t *testing.T) {
+	if _, err := NewDescriptorExtractor([]string{"header:"}); err == nil {
+		t.Errorf("Expected a header key without a name to be rejected")
+	}
+	if _, err := NewDescriptorExtractor([]string{"jwt:"}); err == nil {
+		t.Errorf("Expected a jwt key without a claim to be rejected")
+	}
+	if _, err := NewDescriptorExtractor([]string{"query:page"}); err == nil {
+		t.Errorf("Expected an unknown key to be rejected")
+	}
+}
+
+func TestMiddleware_AppliesAllRules(t *testing.T) {
+	perKey, _ := NewRateLimitRule(ratelimiting.NewFixedWindowRateLimiter(2, time.Minute), []string{"header:X-API-Key"}, nil)
+	perIP, _ := NewRateLimitRule(ratelimiting.NewFixedWindowRateLimiter(2, time.Minute), nil, nil)
+	response, _ := NewRateLimitResponse(infrastructure.RateLimitResponse{})
+	handler := NewMiddleware([]RateLimitRule{perKey, perIP}, response, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), zaptest.NewLogger(t))
+
+	send := func(apiKey string, ip string) int {
+		req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+		req.RemoteAddr = ip + ":1234"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// One tenant spreading across IPs is limited by its API key
+	if send("tenant-a", "10.0.0.1") != http.StatusOK || send("tenant-a", "10.0.0.2") != http.StatusOK {
+		t.Fatalf("Expected the first two requests of the tenant to be allowed")
+	}
+	if code := send("tenant-a", "10.0.0.3"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the tenant to be limited across IPs, got %d", code)
+	}
+	// Tenants behind one NAT have separate quotas until the per IP limit applies
+	if code := send("tenant-b", "10.0.0.1"); code != http.StatusOK {
+		t.Errorf("Expected another tenant on the same IP to be allowed, got %d", code)
+	}
+	if code := send("", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the per IP limit to apply to requests without an API key, got %d", code)
+	}
+}
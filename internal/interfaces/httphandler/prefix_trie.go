@@ -0,0 +1,68 @@
+package httphandler
+
+import "net/netip"
+
+// prefixTrie is a binary trie of IP prefixes. A lookup walks at most one node per address bit, however
+// many prefixes the trie holds. IPv4 and IPv6 prefixes are kept apart, so ::/0 does not match IPv4 clients.
+type prefixTrie struct {
+	roots [2]*trieNode // IPv4, IPv6
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool // a prefix ends here, every address below is contained
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{roots: [2]*trieNode{{}, {}}}
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix) {
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	prefix = netip.PrefixFrom(addr, bits).Masked()
+	node := t.root(prefix.Addr())
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			return // already covered by a shorter prefix
+		}
+		bit := bytes[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*trieNode{} // longer prefixes below are redundant now
+}
+
+// contains reports whether any prefix of the trie contains the address
+func (t *prefixTrie) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return false
+	}
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(bytes)*8 {
+			return false
+		}
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+func (t *prefixTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return t.roots[0]
+	}
+	return t.roots[1]
+}
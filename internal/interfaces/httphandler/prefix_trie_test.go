@@ -0,0 +1,68 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrie_Contains(t *testing.T) {
+	trie := newPrefixTrie()
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7/32", "2001:db8::/32", "::ffff:198.51.100.0/120"} {
+		trie.insert(netip.MustParsePrefix(cidr))
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.255", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:10.0.0.1", true}, // IPv4-mapped clients match IPv4 ranges
+		{"198.51.100.9", true},    // IPv4-mapped ranges match IPv4 clients
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		if got := trie.contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("contains(%s): expected %v, got %v", tt.ip, tt.want, got)
+		}
+	}
+}
+
+func TestPrefixTrie_FamiliesApart(t *testing.T) {
+	trie := newPrefixTrie()
+	trie.insert(netip.MustParsePrefix("::/0"))
+	if trie.contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("Did not expect ::/0 to contain IPv4 addresses")
+	}
+	trie.insert(netip.MustParsePrefix("0.0.0.0/0"))
+	if !trie.contains(netip.MustParseAddr("192.0.2.1")) || !trie.contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Errorf("Expected the default routes to contain every address")
+	}
+}
+
+func TestPrefixTrie_ShorterPrefixCoversLonger(t *testing.T) {
+	trie := newPrefixTrie()
+	trie.insert(netip.MustParsePrefix("10.1.0.0/16"))
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"))
+	trie.insert(netip.MustParsePrefix("10.2.3.0/24"))
+	if !trie.contains(netip.MustParseAddr("10.200.0.1")) {
+		t.Errorf("Expected the shorter prefix to apply")
+	}
+}
+
+func BenchmarkPrefixTrie_Contains(b *testing.B) {
+	trie := newPrefixTrie()
+	for i := 0; i < 100_000; i++ {
+		trie.insert(netip.MustParsePrefix(fmt.Sprintf("%d.%d.%d.0/24", 1+i>>16, i>>8&0xff, i&0xff)))
+	}
+	ip := netip.MustParseAddr("1.200.3.4")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.contains(ip)
+	}
+}
@@ -0,0 +1,99 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Formats of the rate limit rejection body
+const (
+	RateLimitResponseText        = "text"         // plain text message
+	RateLimitResponseProblemJSON = "problem_json" // RFC 9457 problem details
+	RateLimitResponseCustom      = "custom"       // configured body and content type
+)
+
+// RateLimitResponse writes the rate limit headers, and the body of rejected requests
+type RateLimitResponse struct {
+	format      string
+	body        string
+	contentType string
+}
+
+func NewRateLimitResponse(config infrastructure.RateLimitResponse) (*RateLimitResponse, error) {
+	response := &RateLimitResponse{format: config.Format, body: config.Body, contentType: config.ContentType}
+	switch config.Format {
+	case "":
+		response.format = RateLimitResponseText
+	case RateLimitResponseText, RateLimitResponseProblemJSON:
+	case RateLimitResponseCustom:
+		if response.contentType == "" {
+			response.contentType = "text/plain; charset=utf-8"
+		}
+	default:
+		return nil, fmt.Errorf("unknown rate limit response format: %s", config.Format)
+	}
+	return response, nil
+}
+
+// rateLimitQuota is the state of one rate limit for a request
+type rateLimitQuota struct {
+	limit     int
+	window    time.Duration
+	remaining int
+	reset     time.Duration
+}
+
+func newRateLimitQuota(limiter domain.RateLimiter, descriptor domain.Descriptor) (rateLimitQuota, bool) {
+	limit, window := limiter.GetRateLimit()
+	if limit <= 0 {
+		return rateLimitQuota{}, false // limiters that do not limit, e.g. none
+	}
+	remaining, reset := limiter.GetQuota(descriptor)
+	return rateLimitQuota{limit: limit, window: window, remaining: remaining, reset: reset}, true
+}
+
+// writeHeaders sets the IETF RateLimit headers of the quota closest to being exhausted
+func (rr *RateLimitResponse) writeHeaders(w http.ResponseWriter, quota rateLimitQuota) {
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(quota.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(quota.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(quota.reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", quota.limit, ceilSeconds(quota.window)))
+}
+
+// reject answers a request that exceeded the quota with 429 and when to retry
+func (rr *RateLimitResponse) reject(w http.ResponseWriter, r *http.Request, quota rateLimitQuota) {
+	rr.writeHeaders(w, quota)
+	retryAfter := max(ceilSeconds(quota.reset), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	switch rr.format {
+	case RateLimitResponseProblemJSON:
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":     "about:blank",
+			"title":    http.StatusText(http.StatusTooManyRequests),
+			"status":   http.StatusTooManyRequests,
+			"detail":   fmt.Sprintf("Rate limit of %d requests per %v exceeded, retry after %d seconds", quota.limit, quota.window, retryAfter),
+			"instance": r.URL.Path,
+		})
+	case RateLimitResponseCustom:
+		w.Header().Set("Content-Type", rr.contentType)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(rr.body))
+	default:
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,100 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/ratelimiting"
+	"go.uber.org/zap/zaptest"
+)
+
+func newLimitedHandler(t *testing.T, config infrastructure.RateLimitResponse) http.Handler {
+	rule, _ := NewRateLimitRule(ratelimiting.NewSlidingWindowLogRateLimiter(2, time.Minute), nil, nil)
+	response, err := NewRateLimitResponse(config)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	return NewMiddleware([]RateLimitRule{rule}, response, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), zaptest.NewLogger(t))
+}
+
+func serve(handler http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitResponse_Headers(t *testing.T) {
+	handler := newLimitedHandler(t, infrastructure.RateLimitResponse{})
+
+	w := serve(handler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to be allowed, got %d", w.Code)
+	}
+	expected := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "1",
+		"RateLimit-Reset":     "60",
+		"RateLimit-Policy":    "2;w=60",
+	}
+	for header, value := range expected {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("Expected %s to be %q, got %q", header, value, got)
+		}
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Errorf("Did not expect Retry-After on an allowed request")
+	}
+
+	serve(handler)
+	w = serve(handler)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the third request to be rejected, got %d", w.Code)
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected no remaining requests and a retry after 60s, got %q and %q",
+			w.Header().Get("RateLimit-Remaining"), w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitResponse_ProblemJSON(t *testing.T) {
+	handler := newLimitedHandler(t, infrastructure.RateLimitResponse{Format: RateLimitResponseProblemJSON})
+	serve(handler)
+	serve(handler)
+	w := serve(handler)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Expected a problem details content type, got %q", ct)
+	}
+	var problem map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Expected a JSON body, got %q", w.Body.String())
+	}
+	if problem["status"] != float64(http.StatusTooManyRequests) || problem["instance"] != "/apiA" {
+		t.Errorf("Unexpected problem details %v", problem)
+	}
+}
+
+func TestRateLimitResponse_Custom(t *testing.T) {
+	handler := newLimitedHandler(t, infrastructure.RateLimitResponse{Format: RateLimitResponseCustom, Body: `{"error":"slow down"}`, ContentType: "application/json"})
+	serve(handler)
+	serve(handler)
+	w := serve(handler)
+
+	if w.Body.String() != `{"error":"slow down"}` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the custom body, got %q (%s)", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+}
+
+func TestNewRateLimitResponse_UnknownFormat(t *testing.T) {
+	if _, err := NewRateLimitResponse(infrastructure.RateLimitResponse{Format: "xml"}); err == nil {
+		t.Errorf("Expected an unknown format to be rejected")
+	}
+}
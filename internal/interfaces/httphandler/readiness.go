@@ -0,0 +1,41 @@
+package httphandler
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tells upstream balancers probing the load balancer whether to keep sending it traffic. It
+// fails once shutdown begins, so they stop before the listeners close.
+type Readiness struct {
+	draining atomic.Bool
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// Drain fails the readiness checks from now on
+func (readiness *Readiness) Drain() {
+	readiness.draining.Store(true)
+}
+
+func (readiness *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if readiness.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// NewReadinessMiddleware answers requests for the path with the readiness, ahead of routing and the
+// routes' middleware
+func NewReadinessMiddleware(readiness *Readiness, path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			readiness.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
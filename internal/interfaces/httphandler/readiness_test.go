@@ -0,0 +1,28 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadinessMiddleware(t *testing.T) {
+	readiness := NewReadiness()
+	handler := NewReadinessMiddleware(readiness, "/ready", protoHandler)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+path, nil))
+		return w.Code
+	}
+	if code := get("/ready"); code != http.StatusOK {
+		t.Errorf("Expected ready before draining, got %d", code)
+	}
+	readiness.Drain()
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", code)
+	}
+	if code := get("/apiA"); code != http.StatusOK {
+		t.Errorf("Expected other requests to be served while draining, got %d", code)
+	}
+}
@@ -0,0 +1,75 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/loadbalancing"
+	"github.com/krispingal/l7lb/internal/usecases/ratelimiting"
+	"go.uber.org/zap"
+)
+
+// NewRouteHandlers wraps every route's load balancing in the middleware configured for it.
+// Access control runs first, a request must be admitted by both the global and the route's access list, then
+// the route's client certificate rule.
+// Rate limits run after routing: the global limits are shared by all routes, while every route gets its own
+// instances of either its rate_limits or the default limit. Limits with a redis store are also shared by
+// all replicas, the store is nil when none is configured.
+func NewRouteHandlers(routes map[string]*loadbalancing.Route, config *infrastructure.Config, store *ratelimiting.RedisStore, logger *zap.Logger) (map[string]http.Handler, error) {
+	globalRules, err := NewRateLimitRules(config.RateLimits, store, "global")
+	if err != nil {
+		return nil, fmt.Errorf("global rate limits: %w", err)
+	}
+	rateLimitResponse, err := NewRateLimitResponse(config.RateLimitResponse)
+	if err != nil {
+		return nil, err
+	}
+	accessMetrics := infrastructure.MetricsMap("access_control")
+	globalAccess, err := NewAccessList(config.AccessControl, infrastructure.SubMetricsMap(accessMetrics, "global"), logger)
+	if err != nil {
+		return nil, fmt.Errorf("global access control: %w", err)
+	}
+	handlers := make(map[string]http.Handler, len(routes))
+	for _, routeConfig := range config.Routes {
+		route, ok := routes[routeConfig.Path]
+		if !ok {
+			continue
+		}
+		routeLimits := routeConfig.RateLimits
+		if len(routeLimits) == 0 {
+			routeLimits = []infrastructure.RateLimiter{config.RateLimiter}
+		}
+		routeRules, err := NewRateLimitRules(routeLimits, store, "route:"+routeConfig.Path)
+		if err != nil {
+			return nil, fmt.Errorf("route %s rate limits: %w", routeConfig.Path, err)
+		}
+		rules := append(append([]RateLimitRule{}, globalRules...), routeRules...)
+		handler := NewMiddleware(rules, rateLimitResponse, http.HandlerFunc(route.RouteRequest), logger)
+		clientCertRule, err := NewClientCertRule(routeConfig.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeConfig.Path, err)
+		}
+		if clientCertRule != nil {
+			handler = NewClientCertMiddleware(clientCertRule, handler)
+		}
+		var accessLists []*AccessList
+		if globalAccess != nil {
+			accessLists = append(accessLists, globalAccess)
+		}
+		if routeConfig.AccessControl != nil {
+			routeAccess, err := NewAccessList(*routeConfig.AccessControl, infrastructure.SubMetricsMap(accessMetrics, routeConfig.Path), logger)
+			if err != nil {
+				return nil, fmt.Errorf("route %s access control: %w", routeConfig.Path, err)
+			}
+			if routeAccess != nil {
+				accessLists = append(accessLists, routeAccess)
+			}
+		}
+		if len(accessLists) > 0 {
+			handler = NewAccessControlMiddleware(accessLists, handler, logger)
+		}
+		handlers[routeConfig.Path] = handler
+	}
+	return handlers, nil
+}
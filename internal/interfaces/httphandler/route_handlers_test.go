@@ -0,0 +1,60 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/usecases/loadbalancing"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRouteHandlers_RateLimitsPerRouteAndMethod(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	config := &infrastructure.Config{
+		RateLimiter: infrastructure.RateLimiter{Type: "fixed_window", Limit: 1, Window: "1m"},
+		Routes: []infrastructure.Route{
+			{Path: "/apiA"},
+			{Path: "/apiB", RateLimits: []infrastructure.RateLimiter{
+				{Type: "fixed_window", Limit: 1, Window: "1m", Methods: []string{"POST"}},
+			}},
+		},
+	}
+	// Routes without pools answer 503, which is enough to tell them apart from rate limited requests
+	routes := map[string]*loadbalancing.Route{
+		"/apiA": loadbalancing.NewRoute(nil, "", "", logger),
+		"/apiB": loadbalancing.NewRoute(nil, "", "", logger),
+	}
+	handlers, err := NewRouteHandlers(routes, config, nil, logger)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	router := NewPathRouterExactPath(handlers)
+	send := func(method string, path string) int {
+		req := httptest.NewRequest(method, "http://localhost"+path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if send("GET", "/apiA") == http.StatusTooManyRequests {
+		t.Fatalf("Expected the first request to /apiA to be allowed")
+	}
+	if code := send("GET", "/apiA"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the default limit to apply to /apiA, got %d", code)
+	}
+	// /apiB has its own counters and only limits POST
+	for i := 0; i < 3; i++ {
+		if code := send("GET", "/apiB"); code == http.StatusTooManyRequests {
+			t.Fatalf("Expected GET requests to /apiB to be unlimited")
+		}
+	}
+	if send("POST", "/apiB") == http.StatusTooManyRequests {
+		t.Fatalf("Expected the first POST to /apiB to be allowed")
+	}
+	if code := send("POST", "/apiB"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second POST to /apiB to be limited, got %d", code)
+	}
+}
@@ -1,31 +1,49 @@
 package httphandler
 
 import (
+	"context"
 	"net/http"
 	"strings"
-
-	"github.com/krispingal/l7lb/internal/usecases/loadbalancing"
 )
 
-func NewPathRouterWithLB(routes map[string]*loadbalancing.LoadBalancer) http.Handler {
+type routeContextKey struct{}
+
+// withRoute records the route the request was matched to
+func withRoute(r *http.Request, path string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey{}, path))
+}
+
+// matchedRoute returns the route the request was matched to, or its normalized path before routing
+func matchedRoute(r *http.Request) string {
+	if path, ok := r.Context().Value(routeContextKey{}).(string); ok {
+		return path
+	}
+	return routePath(r)
+}
+
+func NewPathRouter(routes map[string]http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for path, lb := range routes {
+		for path, handler := range routes {
 			if strings.HasPrefix(r.URL.Path, path) {
-				lb.RouteRequest(w, r)
+				handler.ServeHTTP(w, withRoute(r, path))
 				return
 			}
 		}
 	})
 }
 
-func NewPathRouterExactPathWithLB(routes map[string]*loadbalancing.LoadBalancer) http.Handler {
+func NewPathRouterExactPath(routes map[string]http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Normalize the path by trimming trailing slashes
-		path := strings.TrimSuffix(r.URL.Path, "/")
-		if lb, exists := routes[path]; exists {
-			lb.RouteRequest(w, r)
+		path := routePath(r)
+		if handler, exists := routes[path]; exists {
+			handler.ServeHTTP(w, withRoute(r, path))
 		} else {
 			http.NotFound(w, r)
 		}
 	})
 }
+
+// routePath returns the path a request is routed by, normalized by trimming trailing slashes
+func routePath(r *http.Request) string {
+	return strings.TrimSuffix(r.URL.Path, "/")
+}
@@ -0,0 +1,121 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Protocols a listener serves
+const (
+	ProtocolHTTP  = "http"
+	ProtocolH2C   = "h2c" // HTTP/2 without TLS, by prior knowledge or upgrade, next to HTTP/1.1
+	ProtocolHTTPS = "https"
+)
+
+// Timeouts of listeners that do not set their own. Read and write timeouts are left unset so they do not cut
+// off long uploads and streamed responses, the routes' timeouts bound requests instead.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// Listeners returns the configured listeners, or a single HTTPS listener on the load balancer's address
+func Listeners(config infrastructure.LoadBalancer) []infrastructure.Listener {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []infrastructure.Listener{{Address: config.Address, Protocol: ProtocolHTTPS, HTTP3: config.HTTP3}}
+}
+
+// ListenerProtocol returns the protocol of the listener, HTTPS when unset
+func ListenerProtocol(config infrastructure.Listener) string {
+	if config.Protocol == "" {
+		return ProtocolHTTPS
+	}
+	return config.Protocol
+}
+
+// NewServer creates the server of a listener, serving the handler over the listener's protocol with its
+// timeouts. HTTPS listeners require the TLS config, others ignore it.
+func NewServer(config infrastructure.Listener, handler http.Handler, tlsConfig *tls.Config) (*http.Server, error) {
+	server := &http.Server{
+		Addr:              config.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	timeouts := []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"read_timeout", config.ReadTimeout, &server.ReadTimeout},
+		{"read_header_timeout", config.ReadHeaderTimeout, &server.ReadHeaderTimeout},
+		{"write_timeout", config.WriteTimeout, &server.WriteTimeout},
+		{"idle_timeout", config.IdleTimeout, &server.IdleTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(timeout.value)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: invalid %s: %w", config.Address, timeout.name, err)
+		}
+		*timeout.target = duration
+	}
+	switch ListenerProtocol(config) {
+	case ProtocolHTTP:
+	case ProtocolH2C:
+		server.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: server.IdleTimeout})
+	case ProtocolHTTPS:
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("listener %s: no TLS config", config.Address)
+		}
+		// HTTP/2 and HTTP/1.1 are negotiated next to the configured protocols, the config is shared so
+		// it is only written when one is missing
+		for _, proto := range []string{"h2", "http/1.1"} {
+			if !slices.Contains(tlsConfig.NextProtos, proto) {
+				tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+			}
+		}
+		server.TLSConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("listener %s: invalid protocol %q, expected http, h2c or https", config.Address, config.Protocol)
+	}
+	return server, nil
+}
+
+// Serve serves connections of the listener, terminating TLS first on HTTPS servers. Handshakes use the TLS
+// config itself rather than the copy ServeTLS would take, so reloaded session ticket keys reach them.
+func Serve(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.Serve(tls.NewListener(listener, server.TLSConfig))
+	}
+	return server.Serve(listener)
+}
+
+// SelectRoutes returns a copy of the handlers of the listed routes, or of all of them when none are listed
+func SelectRoutes(handlers map[string]http.Handler, routes []string) (map[string]http.Handler, error) {
+	if len(routes) == 0 {
+		return maps.Clone(handlers), nil
+	}
+	selected := make(map[string]http.Handler, len(routes))
+	for _, route := range routes {
+		handler, ok := handlers[route]
+		if !ok {
+			return nil, fmt.Errorf("unknown route %q", route)
+		}
+		selected[route] = handler
+	}
+	return selected, nil
+}
@@ -0,0 +1,20 @@
+package httphandler
+
+import (
+	"net/http"
+
+	"github.com/krispingal/l7lb/internal/infrastructure/tlsconfig"
+)
+
+// NewServerNameMiddleware refuses requests for routes that are not tied to the server name (SNI) of their
+// TLS connection with 421, asking the client to retry on a connection for the right name. HTTP/2 clients
+// reuse a connection for every name its certificate covers, so this is checked per request.
+func NewServerNameMiddleware(certs *tlsconfig.CertStore, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && !certs.RouteAllowed(r.TLS.ServerName, route) {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
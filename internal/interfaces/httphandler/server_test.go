@@ -0,0 +1,184 @@
+package httphandler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/krispingal/l7lb/internal/infrastructure/tlsconfig"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/http2"
+)
+
+// serveListener serves the listener's server on a local port and returns its address
+func serveListener(t *testing.T, config infrastructure.Listener, handler http.Handler) string {
+	t.Helper()
+	server, err := NewServer(config, handler, nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go Serve(server, listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Proto)
+})
+
+func TestNewServer_Protocols(t *testing.T) {
+	address := serveListener(t, infrastructure.Listener{Protocol: ProtocolHTTP}, protoHandler)
+	resp, err := http.Get("http://" + address)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 on an http listener, got %s", body)
+	}
+
+	address = serveListener(t, infrastructure.Listener{Protocol: ProtocolH2C}, protoHandler)
+	// HTTP/2 with prior knowledge, over plain TCP
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err = client.Get("http://" + address)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 on an h2c listener, got %s", body)
+	}
+}
+
+func TestNewServer_Timeouts(t *testing.T) {
+	server, err := NewServer(infrastructure.Listener{Protocol: ProtocolHTTP, ReadTimeout: "5s", WriteTimeout: "30s"}, protoHandler, nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if server.ReadTimeout != 5*time.Second || server.WriteTimeout != 30*time.Second {
+		t.Errorf("Expected the configured read and write timeouts, got %v and %v", server.ReadTimeout, server.WriteTimeout)
+	}
+	if server.ReadHeaderTimeout != defaultReadHeaderTimeout || server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Expected the default header and idle timeouts, got %v and %v", server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+
+	// A client sending its headers slower than the header timeout is disconnected
+	address := serveListener(t, infrastructure.Listener{Protocol: ProtocolHTTP, ReadHeaderTimeout: "100ms"}, protoHandler)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1024)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed after the header timeout, got %v", err)
+	}
+}
+
+func TestNewServer_Invalid(t *testing.T) {
+	invalid := []infrastructure.Listener{
+		{Protocol: "ftp"},
+		{Protocol: ProtocolHTTP, IdleTimeout: "forever"},
+		{Protocol: ProtocolHTTPS}, // without a TLS config
+	}
+	for _, config := range invalid {
+		if _, err := NewServer(config, protoHandler, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestSelectRoutes(t *testing.T) {
+	handlers := map[string]http.Handler{"/apiA": protoHandler, "/apiB": protoHandler}
+	selected, err := SelectRoutes(handlers, []string{"/apiB"})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if len(selected) != 1 || selected["/apiB"] == nil {
+		t.Errorf("Expected only /apiB, got %v", selected)
+	}
+	if all, _ := SelectRoutes(handlers, nil); len(all) != 2 {
+		t.Errorf("Expected every route without a subset, got %v", all)
+	}
+	if _, err := SelectRoutes(handlers, []string{"/missing"}); err == nil {
+		t.Errorf("Expected an unknown route to be rejected")
+	}
+}
+
+func TestServe_ReloadsSessionTicketKeys(t *testing.T) {
+	ticketKey := func() []byte {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key
+	}
+	oldKey, newKey := ticketKey(), ticketKey()
+	serveTLS := func(tlsConfig *tls.Config) string {
+		server, err := NewServer(infrastructure.Listener{Protocol: ProtocolHTTPS}, protoHandler, tlsConfig)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %v", err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		go Serve(server, listener)
+		t.Cleanup(func() { server.Close() })
+		return listener.Addr().String()
+	}
+
+	// The listener reloading the key file, and a replica already on the new key
+	keyFile := filepath.Join(t.TempDir(), "tickets.key")
+	os.WriteFile(keyFile, []byte(hex.EncodeToString(oldKey)+"\n"), 0o600)
+	reloading, _ := localhostTLS(t)
+	watcher, err := tlsconfig.WatchSessionTicketKeys(reloading, keyFile, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	defer watcher.Close()
+	replica, _ := localhostTLS(t)
+	var key [32]byte
+	copy(key[:], newKey)
+	replica.SetSessionTicketKeys([][32]byte{key})
+	reloadingAddress, replicaAddress := serveTLS(reloading), serveTLS(replica)
+
+	// resumes reports whether a ticket of the reloading listener resumes the session on the replica
+	resumes := func() bool {
+		clientConfig := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1), MaxVersion: tls.VersionTLS12}
+		var resumed bool
+		for _, address := range []string{reloadingAddress, replicaAddress} {
+			conn, err := tls.Dial("tcp", address, clientConfig)
+			if err != nil {
+				t.Fatalf("Did not expect an error, got %v", err)
+			}
+			resumed = conn.ConnectionState().DidResume
+			conn.Close()
+		}
+		return resumed
+	}
+	if resumes() {
+		t.Fatalf("Did not expect tickets of the old key to resume on the replica")
+	}
+	os.WriteFile(keyFile, []byte(hex.EncodeToString(newKey)+"\n"+hex.EncodeToString(oldKey)+"\n"), 0o600)
+	waitFor(t, resumes)
+}
@@ -1,41 +1,75 @@
 package usecases
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure/proxyprotocol"
 	"go.uber.org/zap"
 )
 
 type HealthChecker struct {
-	serverChan         chan *domain.Backend
-	healthyFrequency   time.Duration
-	unhealthyFrequency time.Duration
-	registry           domain.BackendRegistry
-	healthySet         sync.Map   // Map for lookups
-	mu                 sync.Mutex // To protect healthySet during notifications
-	httpClient         *http.Client
-	logger             *zap.Logger
+	serverChan          chan *domain.Backend
+	healthyFrequency    time.Duration
+	unhealthyFrequency  time.Duration
+	registry            domain.BackendRegistry
+	healthySet          sync.Map   // Map for lookups
+	mu                  sync.Mutex // To protect healthySet during notifications
+	backends            []*domain.Backend
+	httpClient          *http.Client
+	proxyProtocolClient *http.Client // for backends that expect a PROXY header
+	logger              *zap.Logger
 }
 
 func NewHealthChecker(healthyFreq time.Duration, unhealthyFreq time.Duration, registry domain.BackendRegistry, httpClient *http.Client, logger *zap.Logger) *HealthChecker {
 	return &HealthChecker{
-		serverChan:         make(chan *domain.Backend, 1000),
-		healthyFrequency:   healthyFreq,
-		unhealthyFrequency: unhealthyFreq,
-		registry:           registry,
-		httpClient:         httpClient,
-		logger:             logger,
+		serverChan:          make(chan *domain.Backend, 1000),
+		healthyFrequency:    healthyFreq,
+		unhealthyFrequency:  unhealthyFreq,
+		registry:            registry,
+		httpClient:          httpClient,
+		proxyProtocolClient: newProxyProtocolClient(httpClient),
+		logger:              logger,
 	}
 }
 
-// Start launches the health check workers
-func (hc *HealthChecker) Start() {
+// newProxyProtocolClient copies the client with connections that start with a PROXY v2 LOCAL header, which
+// tells backends the connection is the load balancer's own rather than a client's
+func newProxyProtocolClient(client *http.Client) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(proxyprotocol.AppendV2(nil, netip.AddrPort{}, netip.AddrPort{})); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
+
+// Start launches the health check workers, they stop when ctx is done
+func (hc *HealthChecker) Start(ctx context.Context) {
 	numWorkers := 3
 	for i := 0; i < numWorkers; i++ {
-		go hc.worker(i)
+		go hc.worker(ctx, i)
 	}
 }
 
@@ -43,21 +77,70 @@ func (hc *HealthChecker) Start() {
 func (hc *HealthChecker) AddBackend(backend *domain.Backend) {
 	// Assume new servers are initially added to the unhealthy queue
 	hc.logger.Debug("Added backend", zap.String("backend_url", backend.URL))
+	hc.mu.Lock()
+	hc.backends = append(hc.backends, backend)
+	hc.mu.Unlock()
 	hc.serverChan <- backend
 }
 
-func (hc *HealthChecker) worker(id int) {
+// Restore marks the added backends with the URLs healthy ahead of their first check, with the health a
+// previous process handed over, so they take traffic right away. Call it once the load balancers subscribed.
+func (hc *HealthChecker) Restore(urls []string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, backend := range hc.backends {
+		if !slices.Contains(urls, backend.URL) {
+			continue
+		}
+		hc.healthySet.Store(backend.URL, backend)
+		hc.registry.UpdateHealth(domain.BackendStatus{Id: backend.Id, IsHealthy: true})
+		hc.logger.Info("Backend restored healthy", zap.String("backend_url", backend.URL))
+	}
+}
+
+// HealthyBackends returns the URLs of the backends currently healthy
+func (hc *HealthChecker) HealthyBackends() []string {
+	var urls []string
+	hc.healthySet.Range(func(url, _ any) bool {
+		urls = append(urls, url.(string))
+		return true
+	})
+	return urls
+}
+
+func (hc *HealthChecker) worker(ctx context.Context, id int) {
 	hc.logger.Info("Starting worker", zap.Int("worker_id", id))
-	for backend := range hc.serverChan {
-		hc.checkBackend(backend)
+	for {
+		select {
+		case backend := <-hc.serverChan:
+			hc.checkBackend(ctx, backend)
+		case <-ctx.Done():
+			hc.logger.Info("Stopped worker", zap.Int("worker_id", id))
+			return
+		}
 	}
 }
 
 // Worker for checking servers' health status
-func (hc *HealthChecker) checkBackend(backend *domain.Backend) {
+func (hc *HealthChecker) checkBackend(ctx context.Context, backend *domain.Backend) {
 	var healthy bool
 	// Pereform health check
-	resp, err := hc.httpClient.Get(backend.URL + backend.Health)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL+backend.Health, nil)
+	if err != nil {
+		hc.logger.Error("Invalid health check URL", zap.String("backend_url", backend.URL), zap.Error(err))
+		return
+	}
+	client := hc.httpClient
+	if backend.ProxyProtocol {
+		client = hc.proxyProtocolClient
+	}
+	resp, err := client.Do(req)
+	if ctx.Err() != nil {
+		return // stopped, the outcome of a canceled check says nothing about the backend
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
 	if err == nil && resp.StatusCode == http.StatusOK {
 		hc.logger.Debug("Backend responded healthy", zap.String("backend_url", backend.URL))
 		healthy = true
@@ -71,8 +154,15 @@ func (hc *HealthChecker) checkBackend(backend *domain.Backend) {
 	if !healthy {
 		checkFrequency = hc.unhealthyFrequency
 	}
-	time.Sleep(checkFrequency)
-	hc.serverChan <- backend
+	select {
+	case <-time.After(checkFrequency):
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case hc.serverChan <- backend:
+	case <-ctx.Done():
+	}
 }
 
 // Updates Backend status and moves backend to approriate
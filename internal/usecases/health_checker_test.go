@@ -1,13 +1,18 @@
 package usecases
 
 import (
+	"context"
+	"expvar"
 	"net/http"
 	"net/http/httptest"
 
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure/proxyprotocol"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -76,7 +81,7 @@ func TestHealthChecker_BackendBecomesAlive(t *testing.T) {
 	mockRegistry, hc, server, testBackend := setupTest(t, true, false)
 	defer server.Close()
 
-	go hc.Start()
+	go hc.Start(context.Background())
 	hc.AddBackend(testBackend)
 
 	// Wait for 2 health check cycles to ensure the health check has run
@@ -98,7 +103,7 @@ func TestHealthChecker_BackendAliveInitially(t *testing.T) {
 	mockRegistry, hc, server, testBackend := setupTest(t, true, true)
 	defer server.Close()
 	// Start the health checker.
-	go hc.Start()
+	go hc.Start(context.Background())
 
 	// Add the test backend.
 	hc.AddBackend(testBackend)
@@ -116,7 +121,7 @@ func TestHealthChecker_BackendDownInitially(t *testing.T) {
 	mockRegistry, hc, server, testBackend := setupTest(t, false, false)
 	defer server.Close()
 
-	go hc.Start()
+	go hc.Start(context.Background())
 	hc.serverChan <- testBackend
 
 	// Wait for 2 health check cycles to ensure the health check has run
@@ -132,7 +137,7 @@ func TestHealthChecker_BackendBecomesUnhealthy(t *testing.T) {
 	mockRegistry, hc, server, testBackend := setupTest(t, false, true)
 	defer server.Close()
 
-	go hc.Start()
+	go hc.Start(context.Background())
 	hc.serverChan <- testBackend
 
 	// Wait for 2 health check cycles.
@@ -183,3 +188,78 @@ func TestHealthChecker_AddBackend(t *testing.T) {
 		t.Errorf("Timeout waiting for backend on server channel")
 	}
 }
+
+func TestHealthChecker_StopsWithContext(t *testing.T) {
+	var checks atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+	}))
+	defer server.Close()
+	hc := NewHealthChecker(20*time.Millisecond, 20*time.Millisecond, &MockBackendRegistry{}, &http.Client{}, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	hc.Start(ctx)
+	hc.AddBackend(&domain.Backend{Id: 11, URL: server.URL, Health: "/health"})
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond) // a check in flight when canceled
+	stopped := checks.Load()
+	if stopped == 0 {
+		t.Fatalf("Expected the backend to be checked before the health checker stopped")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if checks.Load() != stopped {
+		t.Errorf("Expected no checks after the context was canceled, got %d more", checks.Load()-stopped)
+	}
+}
+
+func TestHealthChecker_Restore(t *testing.T) {
+	mockRegistry := &MockBackendRegistry{}
+	hc := NewHealthChecker(100*time.Millisecond, 1*time.Second, mockRegistry, &http.Client{}, zap.NewNop())
+	hc.AddBackend(&domain.Backend{Id: 11, URL: "http://backend-1"})
+	hc.AddBackend(&domain.Backend{Id: 12, URL: "http://backend-2"})
+
+	// Handed over healthy, without a check
+	hc.Restore([]string{"http://backend-2", "http://removed-backend"})
+
+	expectedStatus := domain.BackendStatus{Id: 12, IsHealthy: true}
+	if mockRegistry.updatedStatus != expectedStatus {
+		t.Errorf("Expected UpdateHealth to be called with %+v, but got %+v", expectedStatus, mockRegistry.updatedStatus)
+	}
+	healthy := hc.HealthyBackends()
+	if len(healthy) != 1 || healthy[0] != "http://backend-2" {
+		t.Errorf("Expected only http://backend-2 to be healthy, got %v", healthy)
+	}
+}
+
+func TestHealthChecker_ProxyProtocolBackend(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	listener, err := proxyprotocol.NewListener(server.Listener, proxyprotocol.ModeRequired, []string{"127.0.0.1"}, new(expvar.Map))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	// Without a header the backend refuses the connection, with a LOCAL header it answers. The checks
+	// return once their context is done instead of waiting to requeue the backend.
+	check := func(hc *HealthChecker, backend *domain.Backend) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		hc.checkBackend(ctx, backend)
+	}
+	mockRegistry := &MockBackendRegistry{}
+	hc := NewHealthChecker(time.Second, time.Second, mockRegistry, &http.Client{}, zap.NewNop())
+	hc.healthySet.Store(server.URL, &domain.Backend{})
+	check(hc, &domain.Backend{Id: 11, URL: server.URL, Health: "/health"})
+	expectedStatus := domain.BackendStatus{Id: 11, IsHealthy: false}
+	if mockRegistry.updatedStatus != expectedStatus {
+		t.Errorf("Expected UpdateHealth to be called with %+v, but got %+v", expectedStatus, mockRegistry.updatedStatus)
+	}
+	check(hc, &domain.Backend{Id: 11, URL: server.URL, Health: "/health", ProxyProtocol: true})
+	expectedStatus = domain.BackendStatus{Id: 11, IsHealthy: true}
+	if mockRegistry.updatedStatus != expectedStatus {
+		t.Errorf("Expected UpdateHealth to be called with %+v, but got %+v", expectedStatus, mockRegistry.updatedStatus)
+	}
+}
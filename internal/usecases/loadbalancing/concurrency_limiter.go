@@ -0,0 +1,252 @@
+package loadbalancing
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+const (
+	defaultQueueTimeout     = time.Second
+	defaultInitialLimit     = 20 // of adaptive limiters without max_in_flight
+	defaultMinLimit         = 1
+	defaultMaxLimit         = 1000
+	aimdBackoffRatio        = 0.9
+	gradientTolerance       = 1.5 // latency may grow this much over the long term average before backing off
+	gradientSmoothing       = 0.2
+	gradientShortWindow     = 10  // samples averaged into the current latency
+	gradientLongWindow      = 600 // samples averaged into the long term latency
+	gradientMinGradient     = 0.5
+	gradientLongDriftFactor = 2 // long term latency is pulled down when it exceeds the current one by this factor
+)
+
+var ErrConcurrencyLimited = errors.New("too many requests in flight")
+
+// Adaptive concurrency limit algorithms
+const (
+	AdaptiveAIMD     = "aimd"
+	AdaptiveGradient = "gradient"
+)
+
+// limitAlgorithm tunes the concurrency limit from the requests that finished
+type limitAlgorithm interface {
+	// update returns the new limit after a request with the given upstream latency finished, dropped
+	// requests failed in a way that hints at overload
+	update(limit, inFlight int, rtt time.Duration, dropped bool) int
+}
+
+// ConcurrencyLimiter caps the requests a load balancer has in flight. Requests beyond the limit wait in a
+// bounded queue for a slot, and are shed once the queue is full or their wait times out.
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	limit        int
+	inFlight     int
+	waiters      *list.List // chan struct{} closed when the waiter is handed a slot, oldest first
+	maxQueue     int
+	queueTimeout time.Duration
+	algorithm    limitAlgorithm // nil for a fixed limit
+
+	metrics  *expvar.Map
+	limitVar *expvar.Int // current limit, published in metrics
+}
+
+func NewConcurrencyLimiter(config *infrastructure.Concurrency, metrics *expvar.Map) (*ConcurrencyLimiter, error) {
+	cl := &ConcurrencyLimiter{
+		limit:        config.MaxInFlight,
+		waiters:      list.New(),
+		maxQueue:     config.MaxQueue,
+		queueTimeout: defaultQueueTimeout,
+		metrics:      metrics,
+		limitVar:     new(expvar.Int),
+	}
+	if config.MaxInFlight < 0 || config.MaxQueue < 0 {
+		return nil, fmt.Errorf("max in flight and max queue must not be negative, got %d and %d", config.MaxInFlight, config.MaxQueue)
+	}
+	if config.QueueTimeout != "" {
+		queueTimeout, err := time.ParseDuration(config.QueueTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue timeout: %w", err)
+		}
+		cl.queueTimeout = queueTimeout
+	}
+	minLimit, maxLimit := defaultMinLimit, defaultMaxLimit
+	if config.MinLimit > 0 {
+		minLimit = config.MinLimit
+	}
+	if config.MaxLimit > 0 {
+		maxLimit = config.MaxLimit
+	}
+	if minLimit > maxLimit {
+		return nil, fmt.Errorf("min limit %d exceeds max limit %d", minLimit, maxLimit)
+	}
+	switch config.Adaptive {
+	case "":
+		if config.MaxInFlight == 0 {
+			return nil, errors.New("max in flight must be positive without an adaptive limit")
+		}
+	case AdaptiveAIMD:
+		aimd := &aimdLimit{minLimit: minLimit, maxLimit: maxLimit}
+		if config.LatencyThreshold != "" {
+			threshold, err := time.ParseDuration(config.LatencyThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("invalid latency threshold: %w", err)
+			}
+			aimd.latencyThreshold = threshold
+		}
+		cl.algorithm = aimd
+	case AdaptiveGradient:
+		cl.algorithm = &gradientLimit{minLimit: minLimit, maxLimit: maxLimit}
+	default:
+		return nil, fmt.Errorf("invalid adaptive concurrency limit: %s", config.Adaptive)
+	}
+	if cl.algorithm != nil {
+		if cl.limit == 0 {
+			cl.limit = defaultInitialLimit
+		}
+		cl.limit = max(min(cl.limit, maxLimit), minLimit)
+	}
+	cl.limitVar.Set(int64(cl.limit))
+	cl.metrics.Set("limit", cl.limitVar)
+	return cl, nil
+}
+
+// acquire takes a slot, waiting in the queue while the limit is reached. It fails with
+// ErrConcurrencyLimited when the request is shed, or the context's error when the client went away.
+func (cl *ConcurrencyLimiter) acquire(ctx context.Context) error {
+	cl.mu.Lock()
+	if cl.inFlight < cl.limit {
+		cl.inFlight++
+		cl.mu.Unlock()
+		return nil
+	}
+	if cl.waiters.Len() >= cl.maxQueue {
+		cl.mu.Unlock()
+		cl.metrics.Add("rejected", 1)
+		return ErrConcurrencyLimited
+	}
+	ready := make(chan struct{})
+	waiter := cl.waiters.PushBack(ready)
+	cl.mu.Unlock()
+	cl.metrics.Add("queued", 1)
+
+	timer := time.NewTimer(cl.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = ErrConcurrencyLimited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	select {
+	case <-ready:
+		return nil // handed a slot while giving up, take it rather than leak it
+	default:
+	}
+	cl.waiters.Remove(waiter)
+	if errors.Is(err, ErrConcurrencyLimited) {
+		cl.metrics.Add("queue_timeouts", 1)
+	}
+	return err
+}
+
+// release frees the slot taken by acquire and tunes the limit from the request. A zero rtt means the
+// request says nothing about upstream health, e.g. the client went away.
+func (cl *ConcurrencyLimiter) release(rtt time.Duration, dropped bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.algorithm != nil && rtt > 0 {
+		cl.limit = cl.algorithm.update(cl.limit, cl.inFlight, rtt, dropped)
+		cl.limitVar.Set(int64(cl.limit))
+	}
+	cl.inFlight--
+	// Hand free slots to the oldest waiters
+	for cl.inFlight < cl.limit && cl.waiters.Len() > 0 {
+		close(cl.waiters.Remove(cl.waiters.Front()).(chan struct{}))
+		cl.inFlight++
+	}
+}
+
+// retryAfter is the Retry-After of shed requests, in seconds
+func (cl *ConcurrencyLimiter) retryAfter() int {
+	return max(int(math.Ceil(cl.queueTimeout.Seconds())), 1)
+}
+
+// droppedResponse reports whether the outcome of a backend request hints at upstream overload
+func droppedResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// aimdLimit grows the limit by one while requests succeed and the limit is in use, and cuts it by 10%
+// when a request fails or takes longer than the latency threshold
+type aimdLimit struct {
+	minLimit, maxLimit int
+	latencyThreshold   time.Duration // zero to only back off on failures
+}
+
+func (a *aimdLimit) update(limit, inFlight int, rtt time.Duration, dropped bool) int {
+	if dropped || (a.latencyThreshold > 0 && rtt > a.latencyThreshold) {
+		return max(int(float64(limit)*aimdBackoffRatio), a.minLimit)
+	}
+	if inFlight*2 >= limit { // only grow a limit that is actually used
+		return min(limit+1, a.maxLimit)
+	}
+	return limit
+}
+
+// gradientLimit compares the current latency with its long term average, in the manner of Netflix's
+// gradient2 limit. While latency holds steady the limit grows by a queue of sqrt(limit), as latency grows
+// the limit shrinks in proportion.
+type gradientLimit struct {
+	minLimit, maxLimit int
+	estimate           float64 // unrounded limit
+	shortRTT, longRTT  float64 // exponential moving averages of latency in nanoseconds
+	samples            int
+}
+
+func (g *gradientLimit) update(limit, inFlight int, rtt time.Duration, _ bool) int {
+	if g.estimate == 0 {
+		g.estimate = float64(limit)
+	}
+	sample := float64(rtt)
+	g.samples++
+	g.shortRTT = movingAverage(g.shortRTT, sample, min(g.samples, gradientShortWindow))
+	g.longRTT = movingAverage(g.longRTT, sample, min(g.samples, gradientLongWindow))
+	// A long term latency far above the current one is a past incident, recover from it quickly
+	if g.longRTT/g.shortRTT > gradientLongDriftFactor {
+		g.longRTT *= 0.95
+	}
+	if float64(inFlight) < g.estimate/2 {
+		return limit // an idle limit says nothing about how much load the backends take
+	}
+
+	gradient := max(gradientMinGradient, min(1, gradientTolerance*g.longRTT/g.shortRTT))
+	next := g.estimate*gradient + math.Sqrt(g.estimate)
+	g.estimate = g.estimate*(1-gradientSmoothing) + next*gradientSmoothing
+	g.estimate = max(min(g.estimate, float64(g.maxLimit)), float64(g.minLimit))
+	return int(g.estimate)
+}
+
+func movingAverage(average, sample float64, window int) float64 {
+	if window <= 1 {
+		return sample
+	}
+	return average + (sample-average)/float64(window)
+}
@@ -0,0 +1,202 @@
+package loadbalancing
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestConcurrencyLimiter(t *testing.T, config infrastructure.Concurrency) *ConcurrencyLimiter {
+	t.Helper()
+	cl, err := NewConcurrencyLimiter(&config, new(expvar.Map))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	return cl
+}
+
+func TestConcurrencyLimiter_RejectsBeyondLimit(t *testing.T) {
+	cl := newTestConcurrencyLimiter(t, infrastructure.Concurrency{MaxInFlight: 2})
+	for i := 0; i < 2; i++ {
+		if err := cl.acquire(context.Background()); err != nil {
+			t.Fatalf("Expected request %d within the limit to be admitted, got %v", i+1, err)
+		}
+	}
+	if err := cl.acquire(context.Background()); !errors.Is(err, ErrConcurrencyLimited) {
+		t.Errorf("Expected the request beyond the limit to be shed, got %v", err)
+	}
+	cl.release(time.Millisecond, false)
+	if err := cl.acquire(context.Background()); err != nil {
+		t.Errorf("Expected a released slot to be reused, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiter_Queue(t *testing.T) {
+	cl := newTestConcurrencyLimiter(t, infrastructure.Concurrency{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: "1s"})
+	if err := cl.acquire(context.Background()); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+
+	admitted := make(chan error)
+	go func() { admitted <- cl.acquire(context.Background()) }()
+	// Wait for the second request to be queued
+	for deadline := time.Now().Add(time.Second); ; {
+		cl.mu.Lock()
+		queued := cl.waiters.Len()
+		cl.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the request to be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := cl.acquire(context.Background()); !errors.Is(err, ErrConcurrencyLimited) {
+		t.Errorf("Expected a request beyond a full queue to be shed, got %v", err)
+	}
+
+	cl.release(time.Millisecond, false)
+	if err := <-admitted; err != nil {
+		t.Errorf("Expected the queued request to take the released slot, got %v", err)
+	}
+	if cl.inFlight != 1 {
+		t.Errorf("Expected the slot to be handed over, got %d in flight", cl.inFlight)
+	}
+}
+
+func TestConcurrencyLimiter_QueueTimeout(t *testing.T) {
+	cl := newTestConcurrencyLimiter(t, infrastructure.Concurrency{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: "20ms"})
+	cl.acquire(context.Background())
+
+	if err := cl.acquire(context.Background()); !errors.Is(err, ErrConcurrencyLimited) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cl.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a client that went away to stop waiting, got %v", err)
+	}
+	if cl.waiters.Len() != 0 {
+		t.Errorf("Expected requests that gave up to leave the queue, %d left", cl.waiters.Len())
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	aimd := &aimdLimit{minLimit: 1, maxLimit: 12, latencyThreshold: 100 * time.Millisecond}
+	if got := aimd.update(10, 10, 10*time.Millisecond, false); got != 11 {
+		t.Errorf("Expected a used limit to grow by one, got %d", got)
+	}
+	if got := aimd.update(10, 2, 10*time.Millisecond, false); got != 10 {
+		t.Errorf("Expected a mostly idle limit to hold, got %d", got)
+	}
+	if got := aimd.update(12, 12, 10*time.Millisecond, false); got != 12 {
+		t.Errorf("Expected the limit to stay within the max, got %d", got)
+	}
+	if got := aimd.update(10, 10, 10*time.Millisecond, true); got != 9 {
+		t.Errorf("Expected a dropped request to cut the limit, got %d", got)
+	}
+	if got := aimd.update(10, 10, time.Second, false); got != 9 {
+		t.Errorf("Expected a slow request to cut the limit, got %d", got)
+	}
+	if got := aimd.update(1, 1, time.Second, true); got != 1 {
+		t.Errorf("Expected the limit to stay within the min, got %d", got)
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	gradient := &gradientLimit{minLimit: 1, maxLimit: 1000}
+	limit := 20
+	for i := 0; i < 100; i++ {
+		limit = gradient.update(limit, limit, 10*time.Millisecond, false)
+	}
+	if limit <= 20 {
+		t.Errorf("Expected the limit to grow while latency holds steady, got %d", limit)
+	}
+
+	grown := limit
+	for i := 0; i < 20; i++ {
+		limit = gradient.update(limit, limit, 100*time.Millisecond, false)
+	}
+	if limit >= grown {
+		t.Errorf("Expected the limit to shrink once latency grows, got %d from %d", limit, grown)
+	}
+}
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	cl := newTestConcurrencyLimiter(t, infrastructure.Concurrency{Adaptive: AdaptiveGradient, MaxLimit: 10})
+	if cl.limit != 10 {
+		t.Errorf("Expected the initial limit to be capped by the max limit, got %d", cl.limit)
+	}
+	invalid := []infrastructure.Concurrency{
+		{},
+		{MaxInFlight: -1},
+		{MaxInFlight: 10, QueueTimeout: "a while"},
+		{Adaptive: "vegas"},
+		{Adaptive: AdaptiveAIMD, MinLimit: 10, MaxLimit: 5},
+		{Adaptive: AdaptiveAIMD, LatencyThreshold: "slow"},
+	}
+	for _, config := range invalid {
+		if _, err := NewConcurrencyLimiter(&config, new(expvar.Map)); err == nil {
+			t.Errorf("Expected config %+v to be rejected", config)
+		}
+	}
+}
+
+func TestLoadBalancer_ShedsBeyondConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	slow := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer slow.Close()
+	lb := &LoadBalancer{
+		strategy:           NewRoundRobinStrategy(),
+		logger:             zaptest.NewLogger(t),
+		healthyBackends:    []*domain.Backend{{Id: 1, URL: slow.URL}},
+		concurrencyLimiter: newTestConcurrencyLimiter(t, infrastructure.Concurrency{MaxInFlight: 1, QueueTimeout: "2s"}),
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.RouteRequest(w, httptest.NewRequest("GET", "http://localhost/api", nil))
+		done <- w.Code
+	}()
+	for deadline := time.Now().Add(time.Second); ; {
+		lb.concurrencyLimiter.mu.Lock()
+		inFlight := lb.concurrencyLimiter.inFlight
+		lb.concurrencyLimiter.mu.Unlock()
+		if inFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the first request to be in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	lb.RouteRequest(w, httptest.NewRequest("GET", "http://localhost/api", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d beyond the concurrency limit, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After of the queue timeout, got %q", got)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the admitted request to succeed, got %d", code)
+	}
+	if lb.concurrencyLimiter.inFlight != 0 {
+		t.Errorf("Expected the slot to be released, got %d in flight", lb.concurrencyLimiter.inFlight)
+	}
+}
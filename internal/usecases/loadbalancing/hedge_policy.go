@@ -0,0 +1,139 @@
+package loadbalancing
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+const (
+	defaultHedgeDelay      = 100 * time.Millisecond
+	defaultMaxHedgePercent = 10
+	latencySampleSize      = 1000 // latencies kept to learn the hedge delay from
+	minLatencySamples      = 100  // latencies observed before the learned delay replaces the configured one
+	hedgeBurst             = 10   // hedges that can be sent back to back once enough tokens are saved up
+)
+
+// HedgePolicy decides when a second attempt is raced against a slow first attempt
+type HedgePolicy struct {
+	delay      time.Duration // used until enough latencies are learned, or always without a percentile
+	percentile float64       // latency percentile of previous attempts used as delay, e.g. 0.95
+	maxPercent float64       // hedged requests allowed as a percentage of requests
+	latencies  *latencyTracker
+	learned    atomic.Int64 // learned delay in nanoseconds, zero until enough samples are observed
+
+	mu     sync.Mutex
+	tokens float64 // every request earns maxPercent/100 tokens, a hedge spends one
+
+	metrics *expvar.Map
+}
+
+func NewHedgePolicy(config *infrastructure.Hedge, metrics *expvar.Map) (*HedgePolicy, error) {
+	policy := &HedgePolicy{
+		delay:      defaultHedgeDelay,
+		percentile: config.Percentile,
+		maxPercent: defaultMaxHedgePercent,
+		latencies:  newLatencyTracker(latencySampleSize),
+		metrics:    metrics,
+	}
+	if config.Delay != "" {
+		delay, err := time.ParseDuration(config.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hedge delay: %w", err)
+		}
+		policy.delay = delay
+	}
+	if config.Percentile < 0 || config.Percentile >= 1 {
+		return nil, fmt.Errorf("hedge percentile %v is not between 0 and 1", config.Percentile)
+	}
+	if config.MaxHedgePercent < 0 || config.MaxHedgePercent > 100 {
+		return nil, fmt.Errorf("max hedge percent %v is not between 0 and 100", config.MaxHedgePercent)
+	}
+	if config.MaxHedgePercent > 0 {
+		policy.maxPercent = config.MaxHedgePercent
+	}
+	return policy, nil
+}
+
+// hedgeDelay returns how long the first attempt may take before a hedge is sent
+func (h *HedgePolicy) hedgeDelay() time.Duration {
+	if learned := h.learned.Load(); learned > 0 {
+		return time.Duration(learned)
+	}
+	return h.delay
+}
+
+// observe records the time the backend took to return response headers
+func (h *HedgePolicy) observe(latency time.Duration) {
+	if h.percentile == 0 {
+		return
+	}
+	if count := h.latencies.add(latency); count >= minLatencySamples && count%minLatencySamples == 0 {
+		// Recompute the percentile periodically instead of sorting on every request
+		h.learned.Store(int64(h.latencies.percentile(h.percentile)))
+	}
+}
+
+// requestStarted earns the request's share of hedge tokens
+func (h *HedgePolicy) requestStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.maxPercent / 100
+	if h.tokens > hedgeBurst {
+		h.tokens = hedgeBurst
+	}
+}
+
+// acquireHedge spends a token for a hedge, it fails once hedges reach the configured share of requests
+func (h *HedgePolicy) acquireHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		h.metrics.Add("throttled", 1)
+		return false
+	}
+	h.tokens--
+	h.metrics.Add("hedged", 1)
+	return true
+}
+
+// latencyTracker keeps the most recent latencies in a ring buffer
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, size)}
+}
+
+// add records a latency and returns the number of latencies observed so far
+func (lt *latencyTracker) add(latency time.Duration) int {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.samples[lt.next] = latency
+	lt.next = (lt.next + 1) % len(lt.samples)
+	lt.count++
+	return lt.count
+}
+
+func (lt *latencyTracker) percentile(p float64) time.Duration {
+	lt.mu.Lock()
+	n := min(lt.count, len(lt.samples))
+	sorted := make([]time.Duration, n)
+	copy(sorted, lt.samples[:n])
+	lt.mu.Unlock()
+
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(n-1))]
+}
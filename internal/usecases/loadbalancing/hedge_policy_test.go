@@ -0,0 +1,82 @@
+package loadbalancing
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHedgePolicy_CapsHedges(t *testing.T) {
+	policy, err := NewHedgePolicy(&infrastructure.Hedge{MaxHedgePercent: 50}, new(expvar.Map))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	policy.requestStarted()
+	if policy.acquireHedge() {
+		t.Error("Expected a single request to not earn a whole hedge at 50%")
+	}
+	policy.requestStarted()
+	if !policy.acquireHedge() {
+		t.Error("Expected two requests to earn one hedge at 50%")
+	}
+	if policy.acquireHedge() {
+		t.Error("Expected the hedge budget to be spent")
+	}
+}
+
+func TestHedgePolicy_LearnsDelayFromPercentile(t *testing.T) {
+	policy, _ := NewHedgePolicy(&infrastructure.Hedge{Delay: "1s", Percentile: 0.9}, new(expvar.Map))
+	if policy.hedgeDelay() != time.Second {
+		t.Fatalf("Expected configured delay before latencies are learned, got %v", policy.hedgeDelay())
+	}
+	for i := 1; i <= minLatencySamples; i++ {
+		policy.observe(time.Duration(i) * time.Millisecond)
+	}
+	if delay := policy.hedgeDelay(); delay != 90*time.Millisecond {
+		t.Errorf("Expected the learned p90 delay of 90ms, got %v", delay)
+	}
+}
+
+func TestLoadBalancer_HedgesSlowRequest(t *testing.T) {
+	slow := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	})
+	defer slow.Close()
+	fast := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	})
+	defer fast.Close()
+
+	metrics := new(expvar.Map)
+	policy, _ := NewHedgePolicy(&infrastructure.Hedge{Delay: "20ms", MaxHedgePercent: 100}, metrics)
+	lb := &LoadBalancer{
+		strategy:        NewRoundRobinStrategy(),
+		logger:          zaptest.NewLogger(t),
+		healthyBackends: []*domain.Backend{{Id: 1, URL: slow.URL}, {Id: 2, URL: fast.URL}},
+		hedgePolicy:     policy,
+	}
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	lb.RouteRequest(w, httptest.NewRequest("GET", "http://localhost/api", nil))
+
+	if w.Body.String() != "fast" {
+		t.Errorf("Expected the hedged response from the fast backend, got %q", w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hedge to cut the latency of the slow backend, took %v", elapsed)
+	}
+	if v := metrics.Get("hedge_wins"); v == nil || v.String() != "1" {
+		t.Errorf("Expected one hedge win to be recorded, got %v", v)
+	}
+}
@@ -0,0 +1,95 @@
+package loadbalancing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"go.uber.org/zap"
+)
+
+// attemptResult is the outcome of sending the request to one backend
+type attemptResult struct {
+	resp    *http.Response
+	backend *domain.Backend
+	err     error
+	latency time.Duration // time until response headers or the error
+}
+
+// sendHedgedAttempt sends the request to the backend and, if no response headers arrive within the hedge
+// delay, races the same request against a second backend. The first response wins and the other attempt is
+// cancelled. It returns the winning result and the backend that was hedged to, if any.
+func (lb *LoadBalancer) sendHedgedAttempt(originalReq *http.Request, backend *domain.Backend, body []byte, perTryTimeout time.Duration, tried []*domain.Backend) (attemptResult, *domain.Backend) {
+	results := make(chan attemptResult, 2)
+	cancels := make(map[*domain.Backend]context.CancelFunc, 2)
+	launch := func(b *domain.Backend) {
+		ctx, cancel := context.WithCancel(originalReq.Context())
+		cancels[b] = cancel
+		go func() {
+			start := time.Now()
+			resp, err := lb.sendAttempt(originalReq.WithContext(ctx), b, body, perTryTimeout)
+			results <- attemptResult{resp: resp, backend: b, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	launch(backend)
+	pending := 1
+	var hedgeBackend *domain.Backend
+	timer := time.NewTimer(lb.hedgePolicy.hedgeDelay())
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-results:
+			pending--
+			// A failed attempt only settles the request when there is nothing else in flight
+			if result.err != nil && pending > 0 {
+				cancels[result.backend]()
+				continue
+			}
+			lb.settleHedgedAttempt(result, backend, cancels, pending, results)
+			return result, hedgeBackend
+		case <-timer.C:
+			if hedgeBackend != nil || !lb.hedgePolicy.acquireHedge() {
+				continue
+			}
+			next, err := lb.nextBackend(append(tried, backend))
+			if err != nil || next == backend {
+				continue
+			}
+			lb.logger.Debug("Hedging slow request", zap.String("backend_url", backend.URL), zap.String("hedge_backend_url", next.URL))
+			hedgeBackend = next
+			launch(next)
+			pending++
+		}
+	}
+}
+
+// settleHedgedAttempt keeps the winner's attempt alive until its body is closed and cancels the losing attempts
+func (lb *LoadBalancer) settleHedgedAttempt(winner attemptResult, original *domain.Backend, cancels map[*domain.Backend]context.CancelFunc, pending int, results <-chan attemptResult) {
+	if winner.err == nil {
+		lb.hedgePolicy.observe(winner.latency)
+		if len(cancels) > 1 && winner.backend == original {
+			lb.hedgePolicy.metrics.Add("original_wins", 1)
+		} else if len(cancels) > 1 {
+			lb.hedgePolicy.metrics.Add("hedge_wins", 1)
+		}
+		winner.resp.Body = &cancelOnCloseBody{ReadCloser: winner.resp.Body, cancel: cancels[winner.backend]}
+	} else {
+		cancels[winner.backend]()
+	}
+	for b, cancel := range cancels {
+		if b != winner.backend {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func() {
+			for i := 0; i < pending; i++ {
+				if loser := <-results; loser.resp != nil {
+					loser.resp.Body.Close()
+				}
+			}
+		}()
+	}
+}
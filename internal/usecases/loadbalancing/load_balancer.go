@@ -2,12 +2,13 @@ package loadbalancing
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -16,8 +17,6 @@ import (
 	"github.com/krispingal/l7lb/internal/domain"
 	"github.com/krispingal/l7lb/internal/infrastructure"
 	"go.uber.org/zap"
-	"golang.org/x/exp/rand"
-	"golang.org/x/net/http2"
 )
 
 type LoadBalancer struct {
@@ -27,9 +26,17 @@ type LoadBalancer struct {
 	healthUpdateChannels []<-chan domain.BackendStatus
 	healthyBackends      []*domain.Backend
 	mu                   sync.RWMutex // mutex to protect healthy backend list
+	retryPolicy          *RetryPolicy
+	retryBudget          *RetryBudget          // optional, caps concurrent retries
+	hedgePolicy          *HedgePolicy          // optional, races slow attempts against a second backend
+	timeouts             *Timeouts             // optional, overall and client supplied deadlines
+	client               *http.Client          // backend client, enforces the route's connect, request and idle timeouts
+	concurrencyLimiter   *ConcurrencyLimiter   // optional, sheds requests beyond the in-flight limit
+	proxyProtocol        *ProxyProtocolClients // optional, sends the original connection's addresses to backends
 }
 
-func NewLoadBalancer(registry *infrastructure.BackendRegistry, strategy LoadBalancingStrategy, healthChannels []<-chan domain.BackendStatus, logger *zap.Logger) *LoadBalancer {
+// NewLoadBalancer creates the load balancer and listens for health updates of its backends until ctx is done
+func NewLoadBalancer(ctx context.Context, registry *infrastructure.BackendRegistry, strategy LoadBalancingStrategy, healthChannels []<-chan domain.BackendStatus, logger *zap.Logger) *LoadBalancer {
 	lb := &LoadBalancer{
 		backendRegistry:      registry,
 		strategy:             strategy,
@@ -37,7 +44,7 @@ func NewLoadBalancer(registry *infrastructure.BackendRegistry, strategy LoadBala
 		logger:               logger,
 	}
 
-	go lb.listenToHealthUpdates()
+	go lb.listenToHealthUpdates(ctx)
 	return lb
 }
 
@@ -45,8 +52,8 @@ func (lb *LoadBalancer) Strategy() LoadBalancingStrategy {
 	return lb.strategy
 }
 
-func (lb *LoadBalancer) listenToHealthUpdates() {
-	cases := make([]reflect.SelectCase, len(lb.healthUpdateChannels))
+func (lb *LoadBalancer) listenToHealthUpdates(ctx context.Context) {
+	cases := make([]reflect.SelectCase, len(lb.healthUpdateChannels), len(lb.healthUpdateChannels)+1)
 	lb.logger.Info("Listening for health updates in loadbalancer")
 
 	for i, ch := range lb.healthUpdateChannels {
@@ -55,16 +62,23 @@ func (lb *LoadBalancer) listenToHealthUpdates() {
 			Chan: reflect.ValueOf(ch),
 		}
 	}
+	done := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
 
 	for {
 		// Wait for any of the channels to receive a value
 		chosen, value, ok := reflect.Select(cases)
+		if chosen == done {
+			lb.logger.Info("Stopped listening for health updates in loadbalancer")
+			return
+		}
 		if ok {
 			update := value.Interface().(domain.BackendStatus)
 			lb.logger.Debug("Received backend health update", zap.Uint64("backend_id", update.Id))
 			lb.updateProcessDispatcher(update)
 		} else {
 			lb.logger.Warn("BackendHealthUpdateChannel was closed", zap.Int("update_channel", chosen))
+			cases[chosen].Chan = reflect.Value{} // a closed channel is always ready, stop selecting it
 		}
 	}
 }
@@ -112,17 +126,8 @@ func (lb *LoadBalancer) getHealthyBackends() []*domain.Backend {
 	return lb.healthyBackends
 }
 
-var h2Transport = &http2.Transport{
-	AllowHTTP: true, // Enable HTTP/2 over clear text (H2C)
-	DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-		return net.Dial(network, addr) // Use plain TCP instead of TLS
-	},
-}
-
-var client = &http.Client{
-	Transport: h2Transport,
-	Timeout:   10 * time.Second, // Set a timeout for the overall backend requests
-}
+// client is used by load balancers without route specific timeouts
+var client = (&Timeouts{Request: defaultRequestTimeout}).NewClient()
 
 var bufferPool = sync.Pool{
 	New: func() interface{} {
@@ -134,6 +139,7 @@ var (
 	ErrNoHealthyBackends    = errors.New("no healthy backends available")
 	ErrServiceUnavailable   = errors.New("service unavailable")
 	ErrBackendRequestFailed = errors.New("backend request error")
+	ErrGatewayTimeout       = errors.New("backend request timed out")
 )
 
 // Orchestrator for routing request
@@ -142,84 +148,258 @@ func (lb *LoadBalancer) RouteRequest(w http.ResponseWriter, r *http.Request) {
 	backends := lb.getHealthyBackends()
 	if len(backends) == 0 {
 		http.Error(w, ErrNoHealthyBackends.Error(), http.StatusServiceUnavailable)
-		lb.logger.Error(ErrServiceUnavailable.Error(), zap.Any("request_url", r.URL))
+		lb.logger.Error(ErrServiceUnavailable.Error(), zap.Any("request_url", r.URL), clientIPField(r))
 		return
 	}
-	backend, err := lb.strategy.GetNextBackend(backends)
+	var upstreamLatency time.Duration // zero unless the backends answered, so the limit does not learn from clients going away
+	dropped := false
+	if lb.concurrencyLimiter != nil {
+		if err := lb.concurrencyLimiter.acquire(r.Context()); err != nil {
+			lb.shed(w, r, err)
+			return
+		}
+		defer func() { lb.concurrencyLimiter.release(upstreamLatency, dropped) }()
+	}
+	if lb.retryBudget != nil {
+		lb.retryBudget.requestStarted()
+		defer lb.retryBudget.requestFinished()
+	}
+	if lb.hedges(r) {
+		lb.hedgePolicy.requestStarted()
+	}
+	if lb.timeouts != nil {
+		var cancel context.CancelFunc
+		r, cancel = lb.timeouts.withDeadline(r)
+		defer cancel()
+	}
 
-	if err != nil {
-		http.Error(w, ErrServiceUnavailable.Error(), http.StatusServiceUnavailable)
-		lb.logger.Error("Load balancer did not receive a next backend")
+	sendStart := time.Now()
+	resp, backend, err := lb.sendRequestWithRetries(r)
+	if r.Context().Err() == nil || !errors.Is(err, context.Canceled) {
+		upstreamLatency, dropped = time.Since(sendStart), droppedResponse(resp, err)
+	}
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		lb.logger.Debug("Client went away before the backend responded", zap.String("url", backendURL(backend)), zap.Duration("duration", time.Since(startTime)), clientIPField(r))
 		return
 	}
-	// Use strings.Builder to build the target URL efficiently
-	var targetURL strings.Builder
-	targetURL.WriteString(backend.URL)
-	targetURL.WriteString(r.URL.Path)
-	if r.URL.RawQuery != "" {
-		targetURL.WriteString("?")
-		targetURL.WriteString(r.URL.RawQuery)
+	if errors.Is(err, context.DeadlineExceeded) || (err != nil && isTimeout(err)) {
+		http.Error(w, ErrGatewayTimeout.Error(), http.StatusGatewayTimeout)
+		lb.logger.Error(ErrGatewayTimeout.Error(), zap.String("url", backendURL(backend)), zap.Duration("duration", time.Since(startTime)), clientIPField(r))
+		return
+	}
+	if errors.Is(err, ErrServiceUnavailable) {
+		http.Error(w, ErrServiceUnavailable.Error(), http.StatusServiceUnavailable)
+		lb.logger.Error("Load balancer did not receive a next backend", zap.Error(err), clientIPField(r))
+		return
 	}
-	resp, err := lb.sendRequestWithRetries(r, targetURL.String())
 	if err != nil {
 		http.Error(w, ErrBackendRequestFailed.Error(), http.StatusInternalServerError)
-		lb.logger.Error(ErrBackendRequestFailed.Error(), zap.String("url", backend.URL), zap.Int("status", http.StatusServiceUnavailable), zap.Duration("duration", time.Since(startTime)))
+		lb.logger.Error(ErrBackendRequestFailed.Error(), zap.String("url", backendURL(backend)), zap.Int("status", http.StatusServiceUnavailable), zap.Duration("duration", time.Since(startTime)), zap.Error(err), clientIPField(r))
 		return
 	}
 
 	defer resp.Body.Close()
 
 	lb.writeResponse(w, resp)
-	lb.logger.Debug("Request routed successfully", zap.String("backend_url", backend.URL), zap.Int("status", resp.StatusCode), zap.Duration("duration", time.Since(startTime)))
+	lb.logger.Debug("Request routed successfully", zap.String("backend_url", backend.URL), zap.Int("status", resp.StatusCode), zap.Duration("duration", time.Since(startTime)), clientIPField(r))
 }
 
-func (lb *LoadBalancer) sendRequestWithRetries(originalReq *http.Request, targetURL string) (*http.Response, error) {
-	// Create a new request
-	originalBody, err := io.ReadAll(originalReq.Body) // Read and clone the body
-	if err != nil {
-		return nil, err
+// shed rejects a request beyond the concurrency limit with 503 and when to retry
+func (lb *LoadBalancer) shed(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, ErrConcurrencyLimited) {
+		lb.logger.Debug("Client went away while waiting for a slot", zap.Any("request_url", r.URL), clientIPField(r))
+		return
 	}
-	originalReq.Body.Close() // close the original body
+	w.Header().Set("Retry-After", strconv.Itoa(lb.concurrencyLimiter.retryAfter()))
+	http.Error(w, ErrConcurrencyLimited.Error(), http.StatusServiceUnavailable)
+	lb.logger.Warn("Shed request beyond the concurrency limit", zap.Any("request_url", r.URL), clientIPField(r))
+}
+
+// clientIPField logs the client IP resolved from trusted proxies, which the connection's peer may not be
+func clientIPField(r *http.Request) zap.Field {
+	ip, _ := domain.ClientIP(r.Context())
+	return zap.String("client_ip", ip)
+}
+
+func backendURL(backend *domain.Backend) string {
+	if backend == nil {
+		return ""
+	}
+	return backend.URL
+}
 
-	req, err := http.NewRequest(originalReq.Method, targetURL, io.NopCloser(bytes.NewReader(originalBody)))
+// nextBackend picks a healthy backend, preferring backends that were not tried yet for this request
+func (lb *LoadBalancer) nextBackend(tried []*domain.Backend) (*domain.Backend, error) {
+	backends := lb.getHealthyBackends()
+	if len(backends) == 0 {
+		return nil, ErrNoHealthyBackends
+	}
+	candidates := backends
+	if len(tried) > 0 {
+		candidates = make([]*domain.Backend, 0, len(backends))
+		for _, backend := range backends {
+			if !containsBackend(tried, backend) {
+				candidates = append(candidates, backend)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = backends // every healthy backend was tried, retry one of them again
+		}
+	}
+	return lb.strategy.GetNextBackend(candidates)
+}
+
+func containsBackend(backends []*domain.Backend, backend *domain.Backend) bool {
+	for _, b := range backends {
+		if b.Id == backend.Id && b.URL == backend.URL {
+			return true
+		}
+	}
+	return false
+}
+
+func (lb *LoadBalancer) sendRequestWithRetries(originalReq *http.Request) (*http.Response, *domain.Backend, error) {
+	originalBody, err := io.ReadAll(originalReq.Body) // Read and clone the body
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	originalReq.Body.Close() // close the original body
 
-	req.Header = originalReq.Header // Clone the header once
-	return lb.retryWithJitter(req, originalBody, 3)
+	return lb.retryWithJitter(originalReq, originalBody)
 }
 
-func (lb *LoadBalancer) retryWithJitter(req *http.Request, originalBody []byte, maxRetries int) (*http.Response, error) {
-	var resp *http.Response
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		// Clone the body for each retry
-		req.Body = io.NopCloser(bytes.NewReader(originalBody))
+// retryWithJitter sends the request to backends picked by the strategy until an attempt is not retriable
+// under the retry policy, the policy's attempts are exhausted or the retry budget is spent.
+func (lb *LoadBalancer) retryWithJitter(originalReq *http.Request, originalBody []byte) (*http.Response, *domain.Backend, error) {
+	policy := lb.retryPolicy
+	if policy == nil {
+		policy = defaultRetryPolicy
+	}
+	var tried []*domain.Backend
+	retrying := false
+	for attempt := 0; ; attempt++ {
+		backend, err := lb.nextBackend(tried)
+		if err != nil {
+			if retrying {
+				lb.retryBudget.releaseRetry()
+			}
+			return nil, nil, fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+		}
+		tried = append(tried, backend)
 
-		resp, err = client.Do(req)
+		var resp *http.Response
+		if lb.hedges(originalReq) {
+			var result attemptResult
+			var hedgeBackend *domain.Backend
+			result, hedgeBackend = lb.sendHedgedAttempt(originalReq, backend, originalBody, policy.PerTryTimeout, tried)
+			if hedgeBackend != nil {
+				tried = append(tried, hedgeBackend)
+			}
+			resp, backend, err = result.resp, result.backend, result.err
+		} else {
+			resp, err = lb.sendAttempt(originalReq, backend, originalBody, policy.PerTryTimeout)
+		}
+		if retrying {
+			lb.retryBudget.releaseRetry()
+		}
 		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			return resp, nil
+			return resp, backend, nil
 		}
-		// It is a Client-side (4xx) - do not retry
-		if resp != nil && (resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 429) {
-			break
+		if !policy.Methods[originalReq.Method] || !policy.shouldRetry(resp, err) {
+			lb.logFailedAttempt("Non-retryable response from backend", backend, resp, err)
+			return resp, backend, err
 		}
-		if err != nil || resp.StatusCode >= 500 || resp.StatusCode == 429 {
-			time.Sleep(time.Duration(i)*time.Second + time.Duration(rand.Intn(100))*time.Millisecond) // Add jitter to backoff
-		} else {
-			// For other errors - non transient, break the loop
-			break
+		if attempt+1 >= policy.MaxAttempts {
+			lb.logFailedAttempt("Failed to make request to backend after retries", backend, resp, err)
+			return resp, backend, err
+		}
+		if lb.retryBudget != nil && !lb.retryBudget.acquireRetry() {
+			lb.logFailedAttempt("Retry budget exhausted, not retrying request", backend, resp, err)
+			return resp, backend, err
+		}
+		retrying = lb.retryBudget != nil
+		if resp != nil {
+			resp.Body.Close()
+		}
+		// Stop backing off as soon as the client goes away or the deadline passes
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-originalReq.Context().Done():
+			if retrying {
+				lb.retryBudget.releaseRetry()
+			}
+			return nil, backend, originalReq.Context().Err()
 		}
 	}
-	if err != nil { // checks only the last error
-		lb.logger.Error("Failed to make request to backend after retries",
-			zap.String("url", req.URL.String()), zap.Error(err))
+}
+
+// hedges reports whether attempts of the request may be hedged, only idempotent requests are
+func (lb *LoadBalancer) hedges(r *http.Request) bool {
+	return lb.hedgePolicy != nil && idempotent[r.Method]
+}
+
+// sendAttempt sends one attempt of the request to the backend, bounded by the per try timeout if set
+func (lb *LoadBalancer) sendAttempt(originalReq *http.Request, backend *domain.Backend, body []byte, perTryTimeout time.Duration) (*http.Response, error) {
+	// Use strings.Builder to build the target URL efficiently
+	var targetURL strings.Builder
+	targetURL.WriteString(backend.URL)
+	targetURL.WriteString(originalReq.URL.Path)
+	if originalReq.URL.RawQuery != "" {
+		targetURL.WriteString("?")
+		targetURL.WriteString(originalReq.URL.RawQuery)
+	}
+
+	ctx := originalReq.Context()
+	cancel := func() {}
+	if perTryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, perTryTimeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, originalReq.Method, targetURL.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = originalReq.Header
+
+	resp, err := lb.httpClient(originalReq).Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The per try timeout also covers reading the body, release it once the body is closed
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// httpClient returns the backend client of the request, with PROXY protocol it is the client of the original connection
+func (lb *LoadBalancer) httpClient(r *http.Request) *http.Client {
+	if lb.proxyProtocol != nil {
+		return lb.proxyProtocol.client(r)
+	}
+	if lb.client != nil {
+		return lb.client
+	}
+	return client
+}
+
+func (lb *LoadBalancer) logFailedAttempt(msg string, backend *domain.Backend, resp *http.Response, err error) {
+	if err != nil {
+		lb.logger.Error(msg, zap.String("url", backend.URL), zap.Error(err))
 	} else if resp != nil {
-		lb.logger.Error("Non-retryable response from backend",
-			zap.String("url", req.URL.String()), zap.Int("status", resp.StatusCode))
+		lb.logger.Error(msg, zap.String("url", backend.URL), zap.Int("status", resp.StatusCode))
 	}
-	return resp, err
+}
+
+// cancelOnCloseBody cancels the attempt's context once the response body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 func (lb *LoadBalancer) writeResponse(w http.ResponseWriter, resp *http.Response) {
@@ -1,15 +1,25 @@
 package loadbalancing
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/krispingal/l7lb/internal/domain"
 	"github.com/krispingal/l7lb/internal/infrastructure"
 	"go.uber.org/zap"
 )
 
 type LoadBalancerBuilder struct {
+	ctx            context.Context
 	registry       *infrastructure.BackendRegistry
 	updateChannels []<-chan domain.BackendStatus
 	strategy       LoadBalancingStrategy
+	retryPolicy    *RetryPolicy
+	hedgePolicy    *HedgePolicy
+	timeouts       *Timeouts
+	client         *http.Client
+	concurrency    *ConcurrencyLimiter
+	proxyProtocol  *ProxyProtocolClients
 	logger         *zap.Logger
 }
 
@@ -36,6 +46,43 @@ func (b *LoadBalancerBuilder) WithBackendRegistry(registry *infrastructure.Backe
 	return b
 }
 
+// WithRetryPolicy sets the retry policy and the budget that caps its retries
+func (b *LoadBalancerBuilder) WithRetryPolicy(policy *RetryPolicy) *LoadBalancerBuilder {
+	b.retryPolicy = policy
+	return b
+}
+
+// WithHedgePolicy enables hedging of slow requests
+func (b *LoadBalancerBuilder) WithHedgePolicy(policy *HedgePolicy) *LoadBalancerBuilder {
+	b.hedgePolicy = policy
+	return b
+}
+
+// WithTimeouts sets the route deadlines and the backend client enforcing the connection timeouts
+func (b *LoadBalancerBuilder) WithTimeouts(timeouts *Timeouts, client *http.Client) *LoadBalancerBuilder {
+	b.timeouts = timeouts
+	b.client = client
+	return b
+}
+
+// WithConcurrencyLimiter caps the requests in flight
+func (b *LoadBalancerBuilder) WithConcurrencyLimiter(limiter *ConcurrencyLimiter) *LoadBalancerBuilder {
+	b.concurrency = limiter
+	return b
+}
+
+// WithProxyProtocol sends a PROXY v2 header on every backend connection
+func (b *LoadBalancerBuilder) WithProxyProtocol(clients *ProxyProtocolClients) *LoadBalancerBuilder {
+	b.proxyProtocol = clients
+	return b
+}
+
+// WithContext stops the load balancer's health update listener when ctx is done
+func (b *LoadBalancerBuilder) WithContext(ctx context.Context) *LoadBalancerBuilder {
+	b.ctx = ctx
+	return b
+}
+
 // WithLogger sets the logger
 func (b *LoadBalancerBuilder) WithLogger(logger *zap.Logger) *LoadBalancerBuilder {
 	b.logger = logger
@@ -44,5 +91,19 @@ func (b *LoadBalancerBuilder) WithLogger(logger *zap.Logger) *LoadBalancerBuilde
 
 // Build creates the final LoadBalancer object
 func (b *LoadBalancerBuilder) Build() *LoadBalancer {
-	return NewLoadBalancer(b.registry, b.strategy, b.updateChannels, b.logger)
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	lb := NewLoadBalancer(ctx, b.registry, b.strategy, b.updateChannels, b.logger)
+	if b.retryPolicy != nil {
+		lb.retryPolicy = b.retryPolicy
+		lb.retryBudget = NewRetryBudget(b.retryPolicy.BudgetPercent, b.retryPolicy.MinRetryConcurrency)
+	}
+	lb.hedgePolicy = b.hedgePolicy
+	lb.timeouts = b.timeouts
+	lb.client = b.client
+	lb.concurrencyLimiter = b.concurrency
+	lb.proxyProtocol = b.proxyProtocol
+	return lb
 }
@@ -1,34 +1,141 @@
 package loadbalancing
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/krispingal/l7lb/internal/domain"
 	"github.com/krispingal/l7lb/internal/infrastructure"
 	"github.com/krispingal/l7lb/internal/usecases"
 	"go.uber.org/zap"
 )
 
-func CreateLoadBalancers(config *infrastructure.Config, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker, logger *zap.Logger) map[string]*LoadBalancer {
-	lbMap := make(map[string]*LoadBalancer)
+// CreateRoutes creates the load balancers of every route, their health update listeners stop when ctx is done
+func CreateRoutes(ctx context.Context, config *infrastructure.Config, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker, logger *zap.Logger) (map[string]*Route, error) {
+	routeMap := make(map[string]*Route)
+
+	for _, routeConfig := range config.Routes {
+		retryPolicy, err := NewRetryPolicy(routeConfig.Retry)
+		if err != nil {
+			return nil, fmt.Errorf("route %s retry policy: %w", routeConfig.Path, err)
+		}
+		timeouts, err := NewTimeouts(routeConfig.Timeouts)
+		if err != nil {
+			return nil, fmt.Errorf("route %s timeouts: %w", routeConfig.Path, err)
+		}
+		backendClient := timeouts.NewClient() // shared by the pools of the route
+		var proxyProtocol *ProxyProtocolClients
+		if routeConfig.SendProxyProtocol {
+			proxyProtocol = NewProxyProtocolClients(ctx, timeouts)
+		}
+		var hedgePolicy *HedgePolicy
+		if routeConfig.Hedge != nil {
+			metrics := infrastructure.SubMetricsMap(infrastructure.MetricsMap("hedge"), routeConfig.Path)
+			if hedgePolicy, err = NewHedgePolicy(routeConfig.Hedge, metrics); err != nil {
+				return nil, fmt.Errorf("route %s hedge policy: %w", routeConfig.Path, err)
+			}
+		}
+		var pools []*Pool
+		for _, poolConfig := range routeConfig.BackendPools() {
+			strategy, err := NewStrategy(poolConfig.Strategy)
+			if err != nil {
+				return nil, fmt.Errorf("route %s pool %s: %w", routeConfig.Path, poolConfig.Name, err)
+			}
+			var concurrencyLimiter *ConcurrencyLimiter
+			if routeConfig.Concurrency != nil {
+				metrics := infrastructure.SubMetricsMap(infrastructure.MetricsMap("concurrency"), routeConfig.Path+"/"+poolConfig.Name)
+				if concurrencyLimiter, err = NewConcurrencyLimiter(routeConfig.Concurrency, metrics); err != nil {
+					return nil, fmt.Errorf("route %s concurrency: %w", routeConfig.Path, err)
+				}
+			}
+			healthUpdateChannels := setupHealthAndRegister(poolConfig.Backends, routeConfig.SendProxyProtocol, registry, healthChecker)
+			builder := NewLoadBalancerBuilder().
+				WithContext(ctx).
+				WithBackendRegistry(registry).
+				WithStrategy(strategy).
+				WithRetryPolicy(retryPolicy).
+				WithHedgePolicy(hedgePolicy).
+				WithTimeouts(timeouts, backendClient).
+				WithConcurrencyLimiter(concurrencyLimiter).
+				WithProxyProtocol(proxyProtocol).
+				WithHealthUpdateChannels(healthUpdateChannels).
+				WithLogger(logger.With(zap.String("route", routeConfig.Path), zap.String("pool", poolConfig.Name)))
+
+			pools = append(pools, NewPool(poolConfig.Name, poolConfig.Weight, builder.Build()))
+		}
+		route := NewRoute(pools, routeConfig.OverrideHeader, routeConfig.OverrideCookie, logger)
+		if routeConfig.Mirror != nil {
+			mirror, err := createMirror(ctx, routeConfig.Path, routeConfig.Mirror, registry, healthChecker, logger)
+			if err != nil {
+				return nil, fmt.Errorf("route %s mirror: %w", routeConfig.Path, err)
+			}
+			route.WithMirror(mirror)
+		}
+		if err := route.SetWeights(poolWeights(routeConfig)); err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeConfig.Path, err)
+		}
+		routeMap[routeConfig.Path] = route
+	}
+	logger.Debug("Created routes")
+	return routeMap, nil
+}
+
+func createMirror(ctx context.Context, path string, mirrorConfig *infrastructure.Mirror, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker, logger *zap.Logger) (*Mirror, error) {
+	if mirrorConfig.SampleRate < 0 || mirrorConfig.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not between 0 and 1", mirrorConfig.SampleRate)
+	}
+	if mirrorConfig.MaxConcurrent <= 0 {
+		return nil, fmt.Errorf("max concurrent must be positive, got %d", mirrorConfig.MaxConcurrent)
+	}
+	strategy, err := NewStrategy(mirrorConfig.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	mirrorLogger := logger.With(zap.String("route", path), zap.String("pool", "mirror"))
+	// Mirrored requests are never retried, a copy must not add more load than the original
+	retryPolicy := DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = 1
+	lb := NewLoadBalancerBuilder().
+		WithContext(ctx).
+		WithBackendRegistry(registry).
+		WithStrategy(strategy).
+		WithRetryPolicy(retryPolicy).
+		WithHealthUpdateChannels(setupHealthAndRegister(mirrorConfig.Backends, false, registry, healthChecker)).
+		WithLogger(mirrorLogger).
+		Build()
+	metrics := infrastructure.SubMetricsMap(infrastructure.MetricsMap("mirror"), path)
+	return NewMirror(lb, mirrorConfig.SampleRate, mirrorConfig.MaxConcurrent, metrics, mirrorLogger), nil
+}
 
-	for _, route := range config.Routes {
-		healthUpdateChannels := setupHealthAndRegister(route.Backends, registry, healthChecker)
-		builder := NewLoadBalancerBuilder().
-			WithBackendRegistry(registry).
-			WithStrategy(NewRoundRobinStrategy()).
-			WithHealthUpdateChannels(healthUpdateChannels).
-			WithLogger(logger)
+// UpdatePoolWeights applies the pool weights of an updated config to the running routes
+func UpdatePoolWeights(routes map[string]*Route, config *infrastructure.Config, logger *zap.Logger) {
+	for _, routeConfig := range config.Routes {
+		route, ok := routes[routeConfig.Path]
+		if !ok {
+			logger.Warn("Ignoring weights for route that requires a restart", zap.String("route", routeConfig.Path))
+			continue
+		}
+		if err := route.SetWeights(poolWeights(routeConfig)); err != nil {
+			logger.Error("Failed to update pool weights", zap.String("route", routeConfig.Path), zap.Error(err))
+			continue
+		}
+		logger.Info("Updated pool weights", zap.String("route", routeConfig.Path), zap.Any("weights", poolWeights(routeConfig)))
+	}
+}
 
-		lbMap[route.Path] = builder.Build()
+func poolWeights(routeConfig infrastructure.Route) map[string]int {
+	weights := make(map[string]int)
+	for _, poolConfig := range routeConfig.BackendPools() {
+		weights[poolConfig.Name] = poolConfig.Weight
 	}
-	logger.Debug("Created load balancers")
-	return lbMap
+	return weights
 }
 
-func setupHealthAndRegister(backends []infrastructure.Backend, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker) []<-chan domain.BackendStatus {
+func setupHealthAndRegister(backends []infrastructure.Backend, proxyProtocol bool, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker) []<-chan domain.BackendStatus {
 	var healthUpdateChannels []<-chan domain.BackendStatus
 	for _, backendConfig := range backends {
 		// Register the backend with health checker and registry
-		backend := registerBackend(backendConfig, registry, healthChecker)
+		backend := registerBackend(backendConfig, proxyProtocol, registry, healthChecker)
 		// Subscribe for health updates
 		channel := registry.Subscribe(backend.Id)
 		healthUpdateChannels = append(healthUpdateChannels, channel)
@@ -36,8 +143,9 @@ func setupHealthAndRegister(backends []infrastructure.Backend, registry *infrast
 	return healthUpdateChannels
 }
 
-func registerBackend(backendConfig infrastructure.Backend, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker) *domain.Backend {
+func registerBackend(backendConfig infrastructure.Backend, proxyProtocol bool, registry *infrastructure.BackendRegistry, healthChecker *usecases.HealthChecker) *domain.Backend {
 	backend := domain.NewBackend(backendConfig.URL, backendConfig.Health)
+	backend.ProxyProtocol = proxyProtocol
 	healthChecker.AddBackend(backend)
 	registry.AddBackendToRegistry(*backend)
 	return backend
@@ -1,6 +1,7 @@
 package loadbalancing
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -154,3 +155,22 @@ func BenchmarkRouteRequest(b *testing.B) {
 		b.Logf("Request completed in %v with status %d", duration, recorder.Result().StatusCode)
 	}
 }
+
+func TestLoadBalancerStopsListeningWithContext(t *testing.T) {
+	updates := make(chan domain.BackendStatus)
+	ctx, cancel := context.WithCancel(context.Background())
+	NewLoadBalancerBuilder().
+		WithContext(ctx).
+		WithStrategy(&MockStrategy{}).
+		WithHealthUpdateChannels([]<-chan domain.BackendStatus{updates}).
+		WithLogger(zap.NewNop()).
+		Build()
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case updates <- domain.BackendStatus{Id: 1, IsHealthy: false}:
+		t.Errorf("Expected no health updates to be received after the context was canceled")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,7 +1,21 @@
 package loadbalancing
 
-import "github.com/krispingal/l7lb/internal/domain"
+import (
+	"fmt"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
 
 type LoadBalancingStrategy interface {
 	GetNextBackend([]*domain.Backend) (*domain.Backend, error)
 }
+
+// NewStrategy creates the load balancing strategy with the given config name
+func NewStrategy(name string) (LoadBalancingStrategy, error) {
+	switch name {
+	case "", "round_robin":
+		return NewRoundRobinStrategy(), nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", name)
+	}
+}
@@ -0,0 +1,122 @@
+package loadbalancing
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/rand"
+)
+
+// Mirror sends a sampled copy of a route's requests to a secondary pool and discards the responses
+type Mirror struct {
+	lb         *LoadBalancer
+	sampleRate float64
+	inFlight   chan struct{} // semaphore capping concurrent mirrored requests
+	metrics    *expvar.Map
+	logger     *zap.Logger
+}
+
+// mirrorResult is the outcome of a primary or mirrored request
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+}
+
+func NewMirror(lb *LoadBalancer, sampleRate float64, maxConcurrent int, metrics *expvar.Map, logger *zap.Logger) *Mirror {
+	return &Mirror{
+		lb:         lb,
+		sampleRate: sampleRate,
+		inFlight:   make(chan struct{}, maxConcurrent),
+		metrics:    metrics,
+		logger:     logger,
+	}
+}
+
+func (m *Mirror) sample() bool {
+	return m.sampleRate > 0 && rand.Float64() < m.sampleRate
+}
+
+// acquire reserves a slot for a mirrored request, it never blocks the primary request
+func (m *Mirror) acquire() bool {
+	select {
+	case m.inFlight <- struct{}{}:
+		return true
+	default:
+		m.metrics.Add("dropped", 1)
+		return false
+	}
+}
+
+// send replays the request with the given body against the mirror pool and compares
+// the outcome with the primary result once it is available. It must run after acquire.
+func (m *Mirror) send(req *http.Request, body []byte, primary <-chan mirrorResult) {
+	defer func() { <-m.inFlight }()
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	recorder := &statusRecorder{ResponseWriter: discardResponseWriter{header: make(http.Header)}}
+	start := time.Now()
+	m.lb.RouteRequest(recorder, req)
+	mirrored := mirrorResult{status: recorder.Status(), latency: time.Since(start)}
+
+	m.metrics.Add("requests", 1)
+	m.metrics.Add("mirror_status_"+strconv.Itoa(mirrored.status), 1)
+	m.metrics.Add("mirror_latency_us", mirrored.latency.Microseconds())
+
+	primaryResult := <-primary
+	m.metrics.Add("primary_status_"+strconv.Itoa(primaryResult.status), 1)
+	m.metrics.Add("primary_latency_us", primaryResult.latency.Microseconds())
+	if primaryResult.status == mirrored.status {
+		m.metrics.Add("status_match", 1)
+	} else {
+		m.metrics.Add("status_mismatch", 1)
+		m.logger.Debug("Mirrored response status differs from primary",
+			zap.String("url", req.URL.Path), zap.Int("primary_status", primaryResult.status), zap.Int("mirror_status", mirrored.status))
+	}
+}
+
+// mirrorRequest clones the request for the mirror pool, detached from the client request's lifetime
+func mirrorRequest(r *http.Request) *http.Request {
+	return r.Clone(context.Background())
+}
+
+// statusRecorder captures the status code written through a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// discardResponseWriter drops everything written to it
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d discardResponseWriter) Header() http.Header         { return d.header }
+func (d discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponseWriter) WriteHeader(int)             {}
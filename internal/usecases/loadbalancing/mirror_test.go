@@ -0,0 +1,82 @@
+package loadbalancing
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CServer starts a cleartext HTTP/2 server that the backend client can reach
+func newH2CServer(handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestRoute_MirrorsRequestWithBody(t *testing.T) {
+	primaryServer := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("primary"))
+	})
+	defer primaryServer.Close()
+	mirroredBody := make(chan string, 1)
+	mirrorServer := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirroredBody <- string(body)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer mirrorServer.Close()
+
+	logger := zaptest.NewLogger(t)
+	primary := &LoadBalancer{strategy: NewRoundRobinStrategy(), logger: logger, healthyBackends: []*domain.Backend{{URL: primaryServer.URL}}}
+	mirrorLB := &LoadBalancer{strategy: NewRoundRobinStrategy(), logger: logger, healthyBackends: []*domain.Backend{{URL: mirrorServer.URL}}}
+	metrics := new(expvar.Map)
+	route := NewRoute([]*Pool{NewPool("default", 100, primary)}, "", "", logger).
+		WithMirror(NewMirror(mirrorLB, 1, 1, metrics, logger))
+
+	req := httptest.NewRequest("POST", "http://localhost/apiA", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	route.RouteRequest(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "primary" {
+		t.Errorf("Expected client to receive the primary response, got %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case body := <-mirroredBody:
+		if body != "payload" {
+			t.Errorf("Expected mirrored request body %q, got %q", "payload", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for mirrored request")
+	}
+	// The mirror records its metrics once the mirrored response has been discarded
+	deadline := time.Now().Add(2 * time.Second)
+	for metrics.Get("status_mismatch") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := metrics.Get("status_mismatch"); v == nil || v.String() != "1" {
+		t.Errorf("Expected a status mismatch between primary and mirror to be recorded, got %v", v)
+	}
+}
+
+func TestMirror_DropsWhenConcurrencyCapReached(t *testing.T) {
+	metrics := new(expvar.Map)
+	mirror := NewMirror(&LoadBalancer{}, 1, 1, metrics, zaptest.NewLogger(t))
+
+	if !mirror.acquire() {
+		t.Fatal("Expected the first mirrored request to acquire a slot")
+	}
+	if mirror.acquire() {
+		t.Error("Expected the second mirrored request to be dropped")
+	}
+	if v := metrics.Get("dropped"); v == nil || v.String() != "1" {
+		t.Errorf("Expected one dropped mirror request, got %v", v)
+	}
+}
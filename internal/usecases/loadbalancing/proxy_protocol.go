@@ -0,0 +1,133 @@
+package loadbalancing
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure/proxyprotocol"
+)
+
+const (
+	defaultProxyProtocolIdle    = 90 * time.Second
+	defaultProxyProtocolClients = 10_000 // beyond it the least recently used client is closed
+)
+
+// proxyProtocolKey identifies the original connection a backend connection is opened for
+type proxyProtocolKey struct {
+	source, destination netip.AddrPort
+}
+
+type proxyProtocolClient struct {
+	key      proxyProtocolKey
+	client   *http.Client
+	lastUsed time.Time
+}
+
+// ProxyProtocolClients sends a PROXY v2 header on every backend connection. A header describes a whole
+// connection while HTTP/2 multiplexes requests, so every original connection gets its own backend client
+// and requests of different clients never share a backend connection. Clients are closed once idle, or
+// when the least recently used one makes room beyond the cap.
+type ProxyProtocolClients struct {
+	timeouts   *Timeouts
+	idle       time.Duration // clients unused for this long are closed
+	maxClients int
+
+	mu      sync.Mutex
+	clients map[proxyProtocolKey]*list.Element
+	lru     *list.List // most recently used clients at the front
+}
+
+// NewProxyProtocolClients creates the clients of a route, idle clients are closed until ctx is done
+func NewProxyProtocolClients(ctx context.Context, timeouts *Timeouts) *ProxyProtocolClients {
+	pc := &ProxyProtocolClients{
+		timeouts:   timeouts,
+		idle:       defaultProxyProtocolIdle,
+		maxClients: defaultProxyProtocolClients,
+		clients:    make(map[proxyProtocolKey]*list.Element),
+		lru:        list.New(),
+	}
+	if timeouts.Idle > 0 {
+		pc.idle = timeouts.Idle
+	}
+	go pc.closeIdle(ctx)
+	return pc
+}
+
+// client returns the backend client of the request's original connection
+func (pc *ProxyProtocolClients) client(r *http.Request) *http.Client {
+	key := proxyProtocolKeyOf(r)
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if element, ok := pc.clients[key]; ok {
+		pc.lru.MoveToFront(element)
+		entry := element.Value.(*proxyProtocolClient)
+		entry.lastUsed = time.Now()
+		return entry.client
+	}
+	dialer := &net.Dialer{Timeout: pc.timeouts.Connect}
+	entry := &proxyProtocolClient{key: key, lastUsed: time.Now()}
+	entry.client = pc.timeouts.newClient(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(proxyprotocol.AppendV2(nil, key.source, key.destination)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+	pc.clients[key] = pc.lru.PushFront(entry)
+	if pc.lru.Len() > pc.maxClients {
+		pc.remove(pc.lru.Back())
+	}
+	return entry.client
+}
+
+// proxyProtocolKeyOf returns the addresses of the request's original connection. The source is the resolved
+// client IP, with the peer's port when the client is the peer.
+func proxyProtocolKeyOf(r *http.Request) proxyProtocolKey {
+	var key proxyProtocolKey
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	key.source = peer
+	if ip, ok := domain.ClientIP(r.Context()); ok {
+		if addr, err := netip.ParseAddr(ip); err == nil && addr != peer.Addr().Unmap() {
+			key.source = netip.AddrPortFrom(addr, 0)
+		}
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		key.destination, _ = netip.ParseAddrPort(local.String())
+	}
+	return key
+}
+
+// closeIdle closes the clients unused for the idle timeout until ctx is done
+func (pc *ProxyProtocolClients) closeIdle(ctx context.Context) {
+	ticker := time.NewTicker(pc.idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			pc.mu.Lock()
+			for element := pc.lru.Back(); element != nil && now.Sub(element.Value.(*proxyProtocolClient).lastUsed) >= pc.idle; element = pc.lru.Back() {
+				pc.remove(element)
+			}
+			pc.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// remove closes the client of the element, with pc.mu held
+func (pc *ProxyProtocolClients) remove(element *list.Element) {
+	entry := pc.lru.Remove(element).(*proxyProtocolClient)
+	delete(pc.clients, entry.key)
+	entry.client.CloseIdleConnections()
+}
@@ -0,0 +1,108 @@
+package loadbalancing
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure/proxyprotocol"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestLoadBalancer_SendsProxyProtocol(t *testing.T) {
+	remoteAddrs := make(chan string, 2)
+	server := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	}), &http2.Server{}))
+	listener, err := proxyprotocol.NewListener(server.Listener, proxyprotocol.ModeRequired, []string{"127.0.0.1"}, new(expvar.Map))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	timeouts := &Timeouts{Request: defaultRequestTimeout}
+	lb := NewLoadBalancerBuilder().
+		WithStrategy(NewRoundRobinStrategy()).
+		WithTimeouts(timeouts, timeouts.NewClient()).
+		WithProxyProtocol(NewProxyProtocolClients(context.Background(), timeouts)).
+		WithLogger(zaptest.NewLogger(t)).
+		Build()
+	lb.healthyBackends = []*domain.Backend{{URL: server.URL}}
+
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	for _, tt := range []struct {
+		remoteAddr, clientIP, want string
+	}{
+		{"192.0.2.1:56324", "", "192.0.2.1:56324"},
+		{"10.0.0.2:1234", "203.0.113.7", "203.0.113.7:0"}, // behind a trusted proxy the client's port is unknown
+	} {
+		req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+		req.RemoteAddr = tt.remoteAddr
+		ctx := context.WithValue(req.Context(), http.LocalAddrContextKey, net.Addr(local))
+		if tt.clientIP != "" {
+			ctx = domain.WithClientIP(ctx, tt.clientIP)
+		}
+		rr := httptest.NewRecorder()
+		lb.RouteRequest(rr, req.WithContext(ctx))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+		if got := <-remoteAddrs; got != tt.want {
+			t.Errorf("Expected the backend to see %s, got %s", tt.want, got)
+		}
+	}
+	if n := len(lb.proxyProtocol.clients); n != 2 {
+		t.Errorf("Expected a backend client per original connection, got %d", n)
+	}
+}
+
+func TestProxyProtocolClients_Evicts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pc := NewProxyProtocolClients(ctx, &Timeouts{Request: defaultRequestTimeout, Idle: 50 * time.Millisecond})
+	pc.maxClients = 2
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+	first := pc.client(request("192.0.2.1:1"))
+	pc.client(request("192.0.2.2:1"))
+	if pc.client(request("192.0.2.1:1")) != first {
+		t.Fatalf("Expected the client of a connection to be reused")
+	}
+
+	// Beyond the cap the least recently used client goes
+	pc.client(request("192.0.2.3:1"))
+	pc.mu.Lock()
+	_, kept := pc.clients[proxyProtocolKeyOf(request("192.0.2.1:1"))]
+	_, evicted := pc.clients[proxyProtocolKeyOf(request("192.0.2.2:1"))]
+	pc.mu.Unlock()
+	if !kept || evicted {
+		t.Errorf("Expected the least recently used client to be evicted")
+	}
+
+	// Unused clients are closed after the idle timeout
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pc.mu.Lock()
+		remaining := pc.lru.Len()
+		pc.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected idle clients to be closed, %d remain", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,209 @@
+package loadbalancing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"golang.org/x/exp/rand"
+)
+
+// Conditions a retry policy can retry on
+const (
+	RetryOnConnectFailure       = "connect-failure"        // backend could not be dialed
+	RetryOnReset                = "reset"                  // connection failed after it was established
+	RetryOnTimeout              = "timeout"                // attempt exceeded the per try timeout
+	RetryOn5xx                  = "5xx"                    // backend responded with any 5xx status
+	RetryOn429                  = "429"                    // backend responded with too many requests
+	RetryOnRetriableStatusCodes = "retriable-status-codes" // backend responded with one of the configured codes
+)
+
+// RetryPolicy decides whether and when a failed backend attempt is retried
+type RetryPolicy struct {
+	MaxAttempts          int // total attempts, including the first one
+	RetryOn              map[string]bool
+	RetriableStatusCodes map[int]bool
+	Methods              map[string]bool // methods that are safe to retry
+	PerTryTimeout        time.Duration   // zero means only the client timeout applies
+	BaseInterval         time.Duration   // base of the exponential backoff between attempts
+	MaxInterval          time.Duration   // cap of the exponential backoff between attempts
+	BudgetPercent        float64         // retries allowed as a percentage of active requests
+	MinRetryConcurrency  int             // retries always allowed regardless of the budget
+}
+
+// DefaultRetryPolicy retries idempotent requests on connection failures, timeouts, 5xx and 429 responses
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          3,
+		RetryOn:              map[string]bool{RetryOnConnectFailure: true, RetryOnReset: true, RetryOnTimeout: true, RetryOn5xx: true, RetryOn429: true},
+		RetriableStatusCodes: map[int]bool{},
+		Methods:              idempotentMethods(),
+		BaseInterval:         100 * time.Millisecond,
+		MaxInterval:          time.Second,
+		BudgetPercent:        20,
+		MinRetryConcurrency:  3,
+	}
+}
+
+var defaultRetryPolicy = DefaultRetryPolicy()
+
+var idempotent = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+	http.MethodTrace: true, http.MethodPut: true, http.MethodDelete: true,
+}
+
+func idempotentMethods() map[string]bool {
+	methods := make(map[string]bool, len(idempotent))
+	for method := range idempotent {
+		methods[method] = true
+	}
+	return methods
+}
+
+// NewRetryPolicy creates a retry policy from config, unset fields keep their default value
+func NewRetryPolicy(config *infrastructure.RetryPolicy) (*RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+	if config == nil {
+		return policy, nil
+	}
+	if config.MaxAttempts < 0 {
+		return nil, fmt.Errorf("max attempts must not be negative, got %d", config.MaxAttempts)
+	}
+	if config.MaxAttempts > 0 {
+		policy.MaxAttempts = config.MaxAttempts
+	}
+	if len(config.RetryOn) > 0 {
+		policy.RetryOn = make(map[string]bool)
+		for _, condition := range config.RetryOn {
+			switch condition {
+			case RetryOnConnectFailure, RetryOnReset, RetryOnTimeout, RetryOn5xx, RetryOn429, RetryOnRetriableStatusCodes:
+				policy.RetryOn[condition] = true
+			default:
+				return nil, fmt.Errorf("unknown retry condition: %s", condition)
+			}
+		}
+	}
+	for _, code := range config.RetriableStatusCodes {
+		policy.RetriableStatusCodes[code] = true
+	}
+	if len(config.Methods) > 0 {
+		policy.Methods = make(map[string]bool)
+		for _, method := range config.Methods {
+			policy.Methods[method] = true
+		}
+	}
+	durations := []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{config.PerTryTimeout, &policy.PerTryTimeout, "per try timeout"},
+		{config.BaseInterval, &policy.BaseInterval, "base interval"},
+		{config.MaxInterval, &policy.MaxInterval, "max interval"},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+		*d.target = parsed
+	}
+	if config.BudgetPercent != nil {
+		if *config.BudgetPercent < 0 {
+			return nil, fmt.Errorf("invalid budget percent: %v", *config.BudgetPercent)
+		}
+		policy.BudgetPercent = *config.BudgetPercent
+	}
+	if config.MinRetryConcurrency > 0 {
+		policy.MinRetryConcurrency = config.MinRetryConcurrency
+	}
+	return policy, nil
+}
+
+// shouldRetry reports whether the outcome of an attempt is retriable under the policy
+func (p *RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		switch {
+		case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+			return p.RetryOn[RetryOnTimeout]
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			return p.RetryOn[RetryOnConnectFailure]
+		default:
+			return p.RetryOn[RetryOnReset]
+		}
+	}
+	switch {
+	case p.RetryOn[RetryOnRetriableStatusCodes] && p.RetriableStatusCodes[resp.StatusCode]:
+		return true
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return p.RetryOn[RetryOn429]
+	case resp.StatusCode >= 500:
+		return p.RetryOn[RetryOn5xx]
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backoff returns the delay before the retry following the given attempt, using exponential backoff with full jitter
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxInterval
+	if attempt < 32 {
+		if exp := p.BaseInterval << attempt; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// RetryBudget caps concurrent retries to a percentage of active requests so retries can't amplify an outage
+type RetryBudget struct {
+	percent        float64
+	minConcurrency int64
+	activeRequests atomic.Int64
+	activeRetries  atomic.Int64
+}
+
+func NewRetryBudget(percent float64, minConcurrency int) *RetryBudget {
+	return &RetryBudget{percent: percent, minConcurrency: int64(minConcurrency)}
+}
+
+func (b *RetryBudget) requestStarted() {
+	b.activeRequests.Add(1)
+}
+
+func (b *RetryBudget) requestFinished() {
+	b.activeRequests.Add(-1)
+}
+
+// acquireRetry reserves a retry if the budget allows it, it must be followed by releaseRetry
+func (b *RetryBudget) acquireRetry() bool {
+	allowed := int64(b.percent / 100 * float64(b.activeRequests.Load()))
+	if allowed < b.minConcurrency {
+		allowed = b.minConcurrency
+	}
+	if b.activeRetries.Add(1) > allowed {
+		b.activeRetries.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *RetryBudget) releaseRetry() {
+	b.activeRetries.Add(-1)
+}
@@ -0,0 +1,178 @@
+package loadbalancing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	policy, err := NewRetryPolicy(&infrastructure.RetryPolicy{
+		MaxAttempts:          5,
+		RetryOn:              []string{RetryOnConnectFailure, RetryOnRetriableStatusCodes},
+		RetriableStatusCodes: []int{409},
+		Methods:              []string{"GET", "POST"},
+		PerTryTimeout:        "2s",
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if policy.MaxAttempts != 5 || policy.PerTryTimeout != 2*time.Second {
+		t.Errorf("Expected 5 attempts with a 2s per try timeout, got %d and %v", policy.MaxAttempts, policy.PerTryTimeout)
+	}
+	if !policy.Methods["POST"] || policy.Methods["PUT"] {
+		t.Errorf("Expected only configured methods to be retriable, got %v", policy.Methods)
+	}
+	if policy.BudgetPercent != 20 {
+		t.Errorf("Expected unset budget to keep its default of 20%%, got %v", policy.BudgetPercent)
+	}
+
+	// An explicit budget of 0 leaves only the minimum retry concurrency
+	noBudget := 0.0
+	policy, err = NewRetryPolicy(&infrastructure.RetryPolicy{BudgetPercent: &noBudget})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if policy.BudgetPercent != 0 {
+		t.Errorf("Expected a budget of 0%% to be kept, got %v", policy.BudgetPercent)
+	}
+	negative := -5.0
+	if _, err := NewRetryPolicy(&infrastructure.RetryPolicy{BudgetPercent: &negative}); err == nil {
+		t.Errorf("Expected a negative budget to be rejected")
+	}
+
+	if _, err := NewRetryPolicy(&infrastructure.RetryPolicy{RetryOn: []string{"sometimes"}}); err == nil {
+		t.Errorf("Expected unknown retry condition to be rejected")
+	}
+}
+
+func TestRetryPolicy_ShouldRetry(t *testing.T) {
+	policy, _ := NewRetryPolicy(&infrastructure.RetryPolicy{
+		RetryOn:              []string{RetryOnConnectFailure, RetryOn5xx, RetryOnRetriableStatusCodes},
+		RetriableStatusCodes: []int{409},
+	})
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{"5xx", http.StatusBadGateway, nil, true},
+		{"429 not configured", http.StatusTooManyRequests, nil, false},
+		{"4xx", http.StatusBadRequest, nil, false},
+		{"retriable status code", http.StatusConflict, nil, true},
+		{"connect failure", 0, &net.OpError{Op: "dial", Err: context.Canceled}, true},
+		{"timeout not configured", 0, context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := policy.shouldRetry(resp, tt.err); got != tt.want {
+			t.Errorf("%s: expected shouldRetry to be %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.BaseInterval = 10 * time.Millisecond
+	policy.MaxInterval = 50 * time.Millisecond
+	for attempt := 0; attempt < 40; attempt++ {
+		ceiling := policy.MaxInterval
+		if attempt < 3 {
+			ceiling = policy.BaseInterval << attempt
+		}
+		if delay := policy.backoff(attempt); delay < 0 || delay >= ceiling {
+			t.Errorf("Expected backoff for attempt %d within [0, %v), got %v", attempt, ceiling, delay)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(20, 1)
+	for i := 0; i < 10; i++ {
+		budget.requestStarted()
+	}
+	// 20% of 10 active requests allows 2 concurrent retries
+	if !budget.acquireRetry() || !budget.acquireRetry() {
+		t.Fatal("Expected two retries to fit in the budget")
+	}
+	if budget.acquireRetry() {
+		t.Error("Expected the third concurrent retry to exceed the budget")
+	}
+	budget.releaseRetry()
+	if !budget.acquireRetry() {
+		t.Error("Expected a released retry to free up the budget")
+	}
+}
+
+func TestLoadBalancer_RetriesOnDifferentBackend(t *testing.T) {
+	var failingHits, healthyHits atomic.Int32
+	failing := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer failing.Close()
+	healthy := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	})
+	defer healthy.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.BaseInterval = time.Millisecond
+	lb := &LoadBalancer{
+		strategy:        NewRoundRobinStrategy(),
+		logger:          zaptest.NewLogger(t),
+		healthyBackends: []*domain.Backend{{Id: 1, URL: failing.URL}, {Id: 2, URL: healthy.URL}},
+		retryPolicy:     policy,
+		retryBudget:     NewRetryBudget(policy.BudgetPercent, policy.MinRetryConcurrency),
+	}
+
+	w := httptest.NewRecorder()
+	lb.RouteRequest(w, httptest.NewRequest("GET", "http://localhost/api", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected retry on the healthy backend to succeed, got %d", w.Code)
+	}
+	if failingHits.Load() != 1 || healthyHits.Load() != 1 {
+		t.Errorf("Expected one attempt on each backend, got %d failing and %d healthy", failingHits.Load(), healthyHits.Load())
+	}
+}
+
+func TestLoadBalancer_DoesNotRetryNonIdempotentMethods(t *testing.T) {
+	var hits atomic.Int32
+	failing := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer failing.Close()
+
+	lb := &LoadBalancer{
+		strategy:        NewRoundRobinStrategy(),
+		logger:          zaptest.NewLogger(t),
+		healthyBackends: []*domain.Backend{{Id: 1, URL: failing.URL}},
+		retryPolicy:     DefaultRetryPolicy(),
+	}
+
+	w := httptest.NewRecorder()
+	lb.RouteRequest(w, httptest.NewRequest("POST", "http://localhost/api", strings.NewReader("order")))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected backend status to be passed through, got %d", w.Code)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected POST to be attempted once, got %d attempts", hits.Load())
+	}
+}
@@ -0,0 +1,191 @@
+package loadbalancing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/rand"
+)
+
+// Pool is a named group of backends with its own load balancer and a share of the route's traffic
+type Pool struct {
+	name   string
+	lb     *LoadBalancer
+	weight atomic.Int64 // percentage of route traffic, updated without restart
+}
+
+func NewPool(name string, weight int, lb *LoadBalancer) *Pool {
+	p := &Pool{name: name, lb: lb}
+	p.weight.Store(int64(weight))
+	return p
+}
+
+func (p *Pool) Name() string {
+	return p.name
+}
+
+func (p *Pool) Weight() int {
+	return int(p.weight.Load())
+}
+
+func (p *Pool) LoadBalancer() *LoadBalancer {
+	return p.lb
+}
+
+var ErrInvalidPoolWeights = errors.New("invalid pool weights")
+
+// Route splits the traffic of a path across weighted backend pools
+type Route struct {
+	pools          []*Pool
+	overrideHeader string
+	overrideCookie string
+	mirror         *Mirror // optional, receives a sampled copy of the traffic
+	logger         *zap.Logger
+}
+
+func NewRoute(pools []*Pool, overrideHeader string, overrideCookie string, logger *zap.Logger) *Route {
+	return &Route{
+		pools:          pools,
+		overrideHeader: overrideHeader,
+		overrideCookie: overrideCookie,
+		logger:         logger,
+	}
+}
+
+func (rt *Route) Pools() []*Pool {
+	return rt.pools
+}
+
+// WithMirror sets the mirror that receives a sampled copy of the route's traffic
+func (rt *Route) WithMirror(mirror *Mirror) *Route {
+	rt.mirror = mirror
+	return rt
+}
+
+// RouteRequest picks a pool for the request and hands it over to the pool's load balancer
+func (rt *Route) RouteRequest(w http.ResponseWriter, r *http.Request) {
+	pool := rt.selectPool(r)
+	if pool == nil {
+		http.Error(w, ErrServiceUnavailable.Error(), http.StatusServiceUnavailable)
+		rt.logger.Error("No pool available for route", zap.Any("request_url", r.URL))
+		return
+	}
+	if rt.mirror == nil || !rt.mirror.sample() {
+		pool.lb.RouteRequest(w, r)
+		return
+	}
+	rt.routeMirroredRequest(w, r, pool)
+}
+
+// routeMirroredRequest serves the request from the pool while a copy is replayed against the mirror
+func (rt *Route) routeMirroredRequest(w http.ResponseWriter, r *http.Request, pool *Pool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, ErrBackendRequestFailed.Error(), http.StatusBadRequest)
+		rt.logger.Error("Failed to read request body", zap.Error(err))
+		return
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !rt.mirror.acquire() {
+		pool.lb.RouteRequest(w, r)
+		return
+	}
+
+	primary := make(chan mirrorResult, 1)
+	go rt.mirror.send(mirrorRequest(r), body, primary)
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	pool.lb.RouteRequest(recorder, r)
+	primary <- mirrorResult{status: recorder.Status(), latency: time.Since(start)}
+}
+
+// SetWeights updates pool weights, weights of pools not present are left unchanged
+func (rt *Route) SetWeights(weights map[string]int) error {
+	total := 0
+	for _, pool := range rt.pools {
+		weight, ok := weights[pool.name]
+		if !ok {
+			weight = pool.Weight()
+		}
+		if weight < 0 {
+			return fmt.Errorf("%w: pool %s has negative weight %d", ErrInvalidPoolWeights, pool.name, weight)
+		}
+		total += weight
+	}
+	if total != 100 {
+		return fmt.Errorf("%w: weights add up to %d, expected 100", ErrInvalidPoolWeights, total)
+	}
+	for _, pool := range rt.pools {
+		if weight, ok := weights[pool.name]; ok {
+			pool.weight.Store(int64(weight))
+		}
+	}
+	return nil
+}
+
+func (rt *Route) selectPool(r *http.Request) *Pool {
+	if pool := rt.pinnedPool(r); pool != nil {
+		return pool
+	}
+	// Prefer pools that can serve the request, fall back to all pools when none of them are healthy
+	if pool := rt.weightedPool(true); pool != nil {
+		return pool
+	}
+	return rt.weightedPool(false)
+}
+
+// pinnedPool returns the pool requested through the override header or cookie
+func (rt *Route) pinnedPool(r *http.Request) *Pool {
+	var name string
+	if rt.overrideHeader != "" {
+		name = r.Header.Get(rt.overrideHeader)
+	}
+	if name == "" && rt.overrideCookie != "" {
+		if cookie, err := r.Cookie(rt.overrideCookie); err == nil {
+			name = cookie.Value
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	for _, pool := range rt.pools {
+		if pool.name == name {
+			return pool
+		}
+	}
+	rt.logger.Debug("Requested pool override does not exist", zap.String("pool", name))
+	return nil
+}
+
+// weightedPool picks a pool by weight from a snapshot of the weights and health, so concurrent weight updates
+// and health changes cannot make the pick miss
+func (rt *Route) weightedPool(healthyOnly bool) *Pool {
+	weights := make([]int, len(rt.pools))
+	total := 0
+	for i, pool := range rt.pools {
+		if healthyOnly && len(pool.lb.getHealthyBackends()) == 0 {
+			continue
+		}
+		weights[i] = pool.Weight()
+		total += weights[i]
+	}
+	if total <= 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for i, pool := range rt.pools {
+		n -= weights[i]
+		if n < 0 {
+			return pool
+		}
+	}
+	return nil
+}
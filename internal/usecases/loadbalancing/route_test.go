@@ -0,0 +1,142 @@
+package loadbalancing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupRoute(t *testing.T, stableWeight int, canaryWeight int) *Route {
+	stable := &LoadBalancer{healthyBackends: []*domain.Backend{{URL: "http://stable"}}}
+	canary := &LoadBalancer{healthyBackends: []*domain.Backend{{URL: "http://canary"}}}
+	pools := []*Pool{
+		NewPool("stable", stableWeight, stable),
+		NewPool("canary", canaryWeight, canary),
+	}
+	return NewRoute(pools, "X-Pool", "pool", zaptest.NewLogger(t))
+}
+
+func TestRoute_WeightedSelection(t *testing.T) {
+	route := setupRoute(t, 100, 0)
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+
+	for i := 0; i < 100; i++ {
+		if pool := route.selectPool(req); pool.Name() != "stable" {
+			t.Fatalf("Expected stable pool with 100%% weight, got %s", pool.Name())
+		}
+	}
+}
+
+func TestRoute_WeightedSelectionDistribution(t *testing.T) {
+	route := setupRoute(t, 80, 20)
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+
+	canaryCount := 0
+	for i := 0; i < 10000; i++ {
+		if route.selectPool(req).Name() == "canary" {
+			canaryCount++
+		}
+	}
+	if canaryCount < 1500 || canaryCount > 2500 {
+		t.Errorf("Expected roughly 20%% of requests on canary, got %d out of 10000", canaryCount)
+	}
+}
+
+func TestRoute_SkipsPoolWithoutHealthyBackends(t *testing.T) {
+	route := setupRoute(t, 50, 50)
+	route.pools[1].lb.healthyBackends = nil
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+
+	for i := 0; i < 100; i++ {
+		if pool := route.selectPool(req); pool.Name() != "stable" {
+			t.Fatalf("Expected only the healthy stable pool to be selected, got %s", pool.Name())
+		}
+	}
+}
+
+func TestRoute_OverrideHeader(t *testing.T) {
+	route := setupRoute(t, 100, 0)
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.Header.Set("X-Pool", "canary")
+
+	if pool := route.selectPool(req); pool.Name() != "canary" {
+		t.Errorf("Expected override header to pin canary pool, got %s", pool.Name())
+	}
+}
+
+func TestRoute_OverrideCookie(t *testing.T) {
+	route := setupRoute(t, 100, 0)
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.AddCookie(&http.Cookie{Name: "pool", Value: "canary"})
+
+	if pool := route.selectPool(req); pool.Name() != "canary" {
+		t.Errorf("Expected override cookie to pin canary pool, got %s", pool.Name())
+	}
+}
+
+func TestRoute_UnknownOverrideFallsBackToWeights(t *testing.T) {
+	route := setupRoute(t, 100, 0)
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+	req.Header.Set("X-Pool", "missing")
+
+	if pool := route.selectPool(req); pool.Name() != "stable" {
+		t.Errorf("Expected unknown override to fall back to weighted selection, got %s", pool.Name())
+	}
+}
+
+func TestRoute_HealthChangesNeverPickUnhealthyPool(t *testing.T) {
+	route := setupRoute(t, 50, 40)
+	down := NewPool("down", 10, &LoadBalancer{})
+	route.pools = append(route.pools, down)
+	canary := route.pools[1].lb
+	canaryBackends := canary.getHealthyBackends()
+	req := httptest.NewRequest("GET", "http://localhost/apiA", nil)
+
+	// The canary pool goes up and down while requests are routed, the stable pool stays healthy
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			canary.mu.Lock()
+			if i%2 == 0 {
+				canary.healthyBackends = nil
+			} else {
+				canary.healthyBackends = canaryBackends
+			}
+			canary.mu.Unlock()
+		}
+	}()
+	for i := 0; i < 100_000; i++ {
+		if pool := route.selectPool(req); pool == down {
+			t.Fatalf("Expected a healthy pool while one is available, got %s after %d requests", pool.Name(), i)
+		}
+	}
+}
+
+func TestRoute_SetWeights(t *testing.T) {
+	route := setupRoute(t, 95, 5)
+
+	if err := route.SetWeights(map[string]int{"stable": 75, "canary": 25}); err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if route.pools[0].Weight() != 75 || route.pools[1].Weight() != 25 {
+		t.Errorf("Expected weights 75/25, got %d/%d", route.pools[0].Weight(), route.pools[1].Weight())
+	}
+
+	err := route.SetWeights(map[string]int{"canary": 50})
+	if !errors.Is(err, ErrInvalidPoolWeights) {
+		t.Errorf("Expected weights not adding up to 100 to be rejected, got %v", err)
+	}
+	if route.pools[1].Weight() != 25 {
+		t.Errorf("Expected rejected update to leave weights unchanged, got %d", route.pools[1].Weight())
+	}
+}
@@ -0,0 +1,123 @@
+package loadbalancing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"golang.org/x/net/http2"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+// Timeouts bounds the time a route's requests may spend on its backends
+type Timeouts struct {
+	Connect        time.Duration // dialing a backend
+	Request        time.Duration // a single backend request, including reading the response body
+	Idle           time.Duration // idle backend connections are closed after this
+	Overall        time.Duration // the whole request including retries and backoff, zero means no limit
+	DeadlineHeader string        // optional client header carrying a shorter deadline, e.g. "grpc-timeout"
+}
+
+func NewTimeouts(config *infrastructure.Timeouts) (*Timeouts, error) {
+	timeouts := &Timeouts{Request: defaultRequestTimeout}
+	if config == nil {
+		return timeouts, nil
+	}
+	durations := []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{config.Connect, &timeouts.Connect, "connect timeout"},
+		{config.Request, &timeouts.Request, "request timeout"},
+		{config.Idle, &timeouts.Idle, "idle timeout"},
+		{config.Overall, &timeouts.Overall, "overall timeout"},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+		*d.target = parsed
+	}
+	timeouts.DeadlineHeader = config.DeadlineHeader
+	return timeouts, nil
+}
+
+// NewClient creates a backend client that enforces the connect, request and idle timeouts
+func (t *Timeouts) NewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: t.Connect}
+	return t.newClient(dialer.DialContext)
+}
+
+func (t *Timeouts) newClient(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true, // Enable HTTP/2 over clear text (H2C)
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr) // Use plain TCP instead of TLS
+			},
+			IdleConnTimeout: t.Idle,
+		},
+		Timeout: t.Request,
+	}
+}
+
+// withDeadline bounds the request's context by the overall timeout and the client's deadline header, whichever is shorter
+func (t *Timeouts) withDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	timeout := t.Overall
+	if t.DeadlineHeader != "" {
+		if value := r.Header.Get(t.DeadlineHeader); value != "" {
+			if clientTimeout, err := parseDeadlineHeader(t.DeadlineHeader, value); err == nil && (timeout == 0 || clientTimeout < timeout) {
+				timeout = clientTimeout
+			}
+		}
+	}
+	if timeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// parseDeadlineHeader parses a grpc-timeout value such as "250m" (250 milliseconds), and the value of any
+// other header as a duration such as "1.5s" or "5m" (5 minutes). grpc-timeout values beyond the longest
+// duration, e.g. "99999999H", are clamped to it.
+func parseDeadlineHeader(header, value string) (time.Duration, error) {
+	if http.CanonicalHeaderKey(header) == "Grpc-Timeout" {
+		units := map[byte]time.Duration{
+			'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+			'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+		}
+		unit, ok := units[value[len(value)-1]]
+		if !ok {
+			return 0, fmt.Errorf("invalid grpc-timeout unit: %s", value)
+		}
+		amount, err := strconv.ParseUint(value[:len(value)-1], 10, 63)
+		if err != nil {
+			return 0, fmt.Errorf("invalid grpc-timeout: %w", err)
+		}
+		if amount > uint64(math.MaxInt64/int64(unit)) {
+			return math.MaxInt64, nil
+		}
+		return time.Duration(amount) * unit, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("negative deadline: %s", value)
+	}
+	return timeout, nil
+}
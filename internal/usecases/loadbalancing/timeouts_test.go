@@ -0,0 +1,118 @@
+package loadbalancing
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseDeadlineHeader(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          time.Duration
+	}{
+		{"grpc-timeout", "250m", 250 * time.Millisecond},
+		{"grpc-timeout", "2S", 2 * time.Second},
+		{"Grpc-Timeout", "1M", time.Minute},
+		{"grpc-timeout", "99999999H", math.MaxInt64}, // clamped instead of overflowing
+		{"grpc-timeout", "9223372036854775807n", math.MaxInt64},
+		{"grpc-timeout", "2562047H", 2562047 * time.Hour}, // the most hours that fit
+		{"X-Request-Timeout", "1.5s", 1500 * time.Millisecond},
+		{"X-Request-Timeout", "5m", 5 * time.Minute}, // minutes, not grpc's milliseconds
+	}
+	for _, tt := range tests {
+		got, err := parseDeadlineHeader(tt.header, tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("parseDeadlineHeader(%q, %q): expected %v, got %v (err %v)", tt.header, tt.value, tt.want, got, err)
+		}
+	}
+	for _, tt := range []struct{ header, value string }{
+		{"X-Request-Timeout", "soon"},
+		{"X-Request-Timeout", "-1s"},
+		{"grpc-timeout", "1.5s"},
+		{"grpc-timeout", "-1S"},
+	} {
+		if _, err := parseDeadlineHeader(tt.header, tt.value); err == nil {
+			t.Errorf("parseDeadlineHeader(%q, %q): expected an error", tt.header, tt.value)
+		}
+	}
+}
+
+func TestNewTimeouts(t *testing.T) {
+	timeouts, err := NewTimeouts(&infrastructure.Timeouts{Connect: "1s", Overall: "5s"})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	if timeouts.Connect != time.Second || timeouts.Overall != 5*time.Second || timeouts.Request != defaultRequestTimeout {
+		t.Errorf("Unexpected timeouts %+v", timeouts)
+	}
+	if _, err := NewTimeouts(&infrastructure.Timeouts{Idle: "forever"}); err == nil {
+		t.Error("Expected an invalid idle timeout to be rejected")
+	}
+}
+
+func newSlowBackendLB(t *testing.T, timeouts *Timeouts, cancelled chan<- struct{}) (*LoadBalancer, func()) {
+	slow := newH2CServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	})
+	lb := &LoadBalancer{
+		strategy:        NewRoundRobinStrategy(),
+		logger:          zaptest.NewLogger(t),
+		healthyBackends: []*domain.Backend{{Id: 1, URL: slow.URL}},
+		timeouts:        timeouts,
+		client:          timeouts.NewClient(),
+	}
+	return lb, slow.Close
+}
+
+func TestLoadBalancer_DeadlineHeaderTimesOut(t *testing.T) {
+	cancelled := make(chan struct{}, 3)
+	lb, closeServer := newSlowBackendLB(t, &Timeouts{Request: time.Minute, DeadlineHeader: "grpc-timeout"}, cancelled)
+	defer closeServer()
+
+	req := httptest.NewRequest("GET", "http://localhost/api", nil)
+	req.Header.Set("grpc-timeout", "50m")
+	w := httptest.NewRecorder()
+	lb.RouteRequest(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d once the client deadline passed, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the upstream request to be cancelled")
+	}
+}
+
+func TestLoadBalancer_ClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{}, 3)
+	lb, closeServer := newSlowBackendLB(t, &Timeouts{Request: time.Minute}, cancelled)
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://localhost/api", nil).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	lb.RouteRequest(httptest.NewRecorder(), req)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to stop once the client went away, took %v", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the upstream request to be cancelled")
+	}
+}
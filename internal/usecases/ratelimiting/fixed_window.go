@@ -1,50 +1,74 @@
 package ratelimiting
 
 import (
-	"sync"
 	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
 )
 
+// fixedWindow holds a descriptor's request count in the current window
+type fixedWindow struct {
+	windowStart time.Time
+	count       int
+}
+
 // Implements the rate limiter interface
 type FixedWindowRateLimiter struct {
-	ipRequestCount map[string]int
+	requestCount   *keyStore[fixedWindow]
 	requestLimit   int
 	windowDuration time.Duration
-	mu             sync.RWMutex // Mutex for protecting the request map
-	resetTicker    *time.Ticker // Ticker to reset requests after each window
+	cleanupTicker  *time.Ticker // Ticker to drop descriptors of past windows
+	clock          func() time.Time
+}
+
+func NewFixedWindowRateLimiter(requestLimit int, windowDuration time.Duration, opts ...StoreOption) *FixedWindowRateLimiter {
+	return newFixedWindowRateLimiter(requestLimit, windowDuration, time.Now, opts...)
 }
 
-func NewFixedWindowRateLimiter(requestLimit int, windowDuration time.Duration) *FixedWindowRateLimiter {
+// newFixedWindowRateLimiter creates the limiter on the clock, which is set before the cleanup starts reading it
+func newFixedWindowRateLimiter(requestLimit int, windowDuration time.Duration, clock func() time.Time, opts ...StoreOption) *FixedWindowRateLimiter {
 	rl := &FixedWindowRateLimiter{
-		ipRequestCount: make(map[string]int),
+		requestCount:   newKeyStore[fixedWindow](windowDuration, opts...),
 		requestLimit:   requestLimit,
 		windowDuration: windowDuration,
-		resetTicker:    time.NewTicker(windowDuration),
+		cleanupTicker:  time.NewTicker(windowDuration),
+		clock:          clock,
 	}
-	go rl.reset() // Background routine to reset counts every window
+	go rl.cleanup() // Background routine to drop counts of past windows
 	return rl
 }
 
-func (rl *FixedWindowRateLimiter) IsAllowed(ip string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+func (rl *FixedWindowRateLimiter) IsAllowed(descriptor domain.Descriptor) bool {
+	now := rl.clock()
+	allowed := false
+	rl.requestCount.update(descriptor.Key(), now, func(window *fixedWindow, _ bool) {
+		rl.advance(window, now)
+		if window.count < rl.requestLimit {
+			window.count++
+			allowed = true
+		}
+	})
+	return allowed
+}
 
-	if rl.ipRequestCount[ip] >= rl.requestLimit {
-		return false
+// advance resets the count once the window that contains now has started
+func (rl *FixedWindowRateLimiter) advance(window *fixedWindow, now time.Time) {
+	if windowStart := now.Truncate(rl.windowDuration); !window.windowStart.Equal(windowStart) {
+		window.windowStart = windowStart
+		window.count = 0
 	}
-	rl.ipRequestCount[ip]++
-	return true
 }
 
 func (rl *FixedWindowRateLimiter) GetState() map[string]int {
-	rl.mu.RLock()
-	defer rl.mu.RUnlock()
-
+	now := rl.clock()
 	//Create a copy of the current state to avoid modifying the original map
-	stateCopy := make(map[string]int, len(rl.ipRequestCount))
-	for ip, count := range rl.ipRequestCount {
-		stateCopy[ip] = count
-	}
+	stateCopy := make(map[string]int)
+	rl.requestCount.forEach(func(key string, window *fixedWindow) {
+		rl.advance(window, now)
+		if window.count > 0 {
+			stateCopy[key] = window.count
+		}
+	})
 	return stateCopy
 }
 
@@ -52,11 +76,23 @@ func (rl *FixedWindowRateLimiter) GetRateLimit() (int, time.Duration) {
 	return rl.requestLimit, rl.windowDuration
 }
 
-// reset periodically clears the rquest counts after the time window
-func (rl *FixedWindowRateLimiter) reset() {
-	for range rl.resetTicker.C {
-		rl.mu.Lock()
-		rl.ipRequestCount = make(map[string]int) // Clear the map to reset all counts
-		rl.mu.Unlock()
+func (rl *FixedWindowRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) {
+	now := rl.clock()
+	remaining := rl.requestLimit
+	rl.requestCount.get(descriptor.Key(), func(window *fixedWindow) {
+		rl.advance(window, now)
+		remaining = max(rl.requestLimit-window.count, 0)
+	})
+	return remaining, now.Truncate(rl.windowDuration).Add(rl.windowDuration).Sub(now)
+}
+
+// cleanup periodically drops the counts of past windows
+func (rl *FixedWindowRateLimiter) cleanup() {
+	for range rl.cleanupTicker.C {
+		now := rl.clock()
+		rl.requestCount.sweep(now, func(window *fixedWindow) bool {
+			rl.advance(window, now)
+			return window.count == 0
+		})
 	}
 }
@@ -1,14 +1,17 @@
 package ratelimiting
 
 import (
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
 )
 
 func TestFixedWindowRateLimiter_allow(t *testing.T) {
 	rl := NewFixedWindowRateLimiter(2, time.Second*1)
 
-	ip := "192.168.1.1"
+	ip := remoteAddress("192.168.1.1")
 	if !rl.IsAllowed(ip) {
 		t.Errorf("Expected IsAllow to return true for the first request, but got false")
 	}
@@ -23,7 +26,7 @@ func TestFixedWindowRateLimiter_allow(t *testing.T) {
 func TestFixedWindowRateLimiter_Reset(t *testing.T) {
 	rl := NewFixedWindowRateLimiter(2, time.Millisecond*500)
 
-	ip := "192.168.1.1"
+	ip := remoteAddress("192.168.1.1")
 
 	if !rl.IsAllowed(ip) || !rl.IsAllowed(ip) || rl.IsAllowed(ip) {
 		t.Errorf("Expected IsAllow behavior to match request limit before reset")
@@ -41,8 +44,8 @@ func TestFixedWindowRateLimiter_Reset(t *testing.T) {
 func TestFixedWindowRateLimiter_GetState(t *testing.T) {
 	rl := NewFixedWindowRateLimiter(3, time.Second*1)
 
-	ip1 := "192.168.1.1"
-	ip2 := "192.168.1.2"
+	ip1 := remoteAddress("192.168.1.1")
+	ip2 := remoteAddress("192.168.1.2")
 
 	// Make requests for both IPs
 	rl.IsAllowed(ip1)
@@ -52,12 +55,12 @@ func TestFixedWindowRateLimiter_GetState(t *testing.T) {
 	state := rl.GetState()
 
 	// Assert the request counts
-	if state[ip1] != 2 {
-		t.Errorf("Expected IP1 to have 2 requests, but got %d", state[ip1])
+	if state[ip1.Key()] != 2 {
+		t.Errorf("Expected IP1 to have 2 requests, but got %d", state[ip1.Key()])
 	}
 
-	if state[ip2] != 1 {
-		t.Errorf("Expected IP2 to have 1 request, but got %d", state[ip2])
+	if state[ip2.Key()] != 1 {
+		t.Errorf("Expected IP2 to have 1 request, but got %d", state[ip2.Key()])
 	}
 }
 
@@ -77,3 +80,50 @@ func TestFixedWindowRateLimiter_GetRateLimit(t *testing.T) {
 		t.Errorf("Expected window duration to be %v, but got %v", windowDuration, duration)
 	}
 }
+
+// remoteAddress returns the descriptor of a client rate limited by IP
+func remoteAddress(ip string) domain.Descriptor {
+	return domain.Descriptor{{Key: "remote_address", Value: ip}}
+}
+
+// fakeClock is a clock tests move by hand, it is also read by the limiters' cleanup goroutines
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestFixedWindowRateLimiter_GetQuota(t *testing.T) {
+	rl := NewFixedWindowRateLimiter(3, time.Minute)
+	ip := remoteAddress("192.168.1.1")
+	rl.IsAllowed(ip)
+
+	remaining, reset := rl.GetQuota(ip)
+	if remaining != 2 {
+		t.Errorf("Expected 2 remaining requests, got %d", remaining)
+	}
+	if reset <= 0 || reset > time.Minute {
+		t.Errorf("Expected the window to reset within a minute, got %v", reset)
+	}
+}
@@ -0,0 +1,187 @@
+package ratelimiting
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShards  = 64
+	defaultMaxKeys = 100_000
+	minShardKeys   = 16 // fewer shards are used for small caps, so a hash collision does not evict an active key
+)
+
+// StoreOption tunes the store that keeps a rate limiter's per descriptor state
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	shards  int
+	maxKeys int
+	keyTTL  time.Duration
+}
+
+// WithShards sets the number of independently locked shards, more shards means less lock contention
+func WithShards(shards int) StoreOption {
+	return func(o *storeOptions) {
+		if shards > 0 {
+			o.shards = shards
+		}
+	}
+}
+
+// WithMaxKeys caps the number of tracked descriptors. The cap is split across the shards and every shard
+// evicts its own least recently used descriptor once it holds its share.
+func WithMaxKeys(maxKeys int) StoreOption {
+	return func(o *storeOptions) {
+		if maxKeys > 0 {
+			o.maxKeys = maxKeys
+		}
+	}
+}
+
+// WithKeyTTL evicts descriptors that have not been seen for the given duration
+func WithKeyTTL(ttl time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		if ttl > 0 {
+			o.keyTTL = ttl
+		}
+	}
+}
+
+// keyStore is a sharded map of per descriptor state with a hard cap on the number of keys.
+// Every shard has its own lock, LRU list and share of the cap, so memory stays bounded when clients
+// rotate through keys and concurrent requests for different keys rarely contend.
+type keyStore[V any] struct {
+	shards []*storeShard[V]
+	seed   maphash.Seed
+}
+
+type storeShard[V any] struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used entries at the front
+	maxKeys int
+	ttl     time.Duration
+}
+
+type storeEntry[V any] struct {
+	key      string
+	value    V
+	lastSeen time.Time
+}
+
+// newKeyStore creates a store, idle keys are evicted after defaultTTL unless the options set another TTL
+func newKeyStore[V any](defaultTTL time.Duration, opts ...StoreOption) *keyStore[V] {
+	options := storeOptions{shards: defaultShards, maxKeys: defaultMaxKeys, keyTTL: defaultTTL}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	shards := max(1, min(options.shards, options.maxKeys/minShardKeys))
+	store := &keyStore[V]{shards: make([]*storeShard[V], shards), seed: maphash.MakeSeed()}
+	for i := range store.shards {
+		shardKeys := options.maxKeys / shards
+		if i < options.maxKeys%shards {
+			shardKeys++ // the shares add up to maxKeys
+		}
+		store.shards[i] = &storeShard[V]{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+			maxKeys: shardKeys,
+			ttl:     options.keyTTL,
+		}
+	}
+	return store
+}
+
+func (s *keyStore[V]) shard(key string) *storeShard[V] {
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+// update calls fn with the key's state under the shard lock, creating zero state for unknown keys
+func (s *keyStore[V]) update(key string, now time.Time, fn func(value *V, isNew bool)) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.evictExpired(now)
+	if elem, ok := shard.entries[key]; ok {
+		entry := elem.Value.(*storeEntry[V])
+		entry.lastSeen = now
+		shard.lru.MoveToFront(elem)
+		fn(&entry.value, false)
+		return
+	}
+	if shard.lru.Len() >= shard.maxKeys {
+		shard.remove(shard.lru.Back())
+	}
+	entry := &storeEntry[V]{key: key, lastSeen: now}
+	shard.entries[key] = shard.lru.PushFront(entry)
+	fn(&entry.value, true)
+}
+
+// get calls fn with the key's state under the shard lock, it reports false for unknown keys
+func (s *keyStore[V]) get(key string, fn func(value *V)) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	elem, ok := shard.entries[key]
+	if !ok {
+		return false
+	}
+	fn(&elem.Value.(*storeEntry[V]).value)
+	return true
+}
+
+// forEach calls fn for every key, one shard lock at a time
+func (s *keyStore[V]) forEach(fn func(key string, value *V)) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for key, elem := range shard.entries {
+			fn(key, &elem.Value.(*storeEntry[V]).value)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// sweep evicts expired keys and the keys whose state is idle, i.e. equivalent to an unseen key
+func (s *keyStore[V]) sweep(now time.Time, idle func(value *V) bool) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.evictExpired(now)
+		for _, elem := range shard.entries {
+			if idle(&elem.Value.(*storeEntry[V]).value) {
+				shard.remove(elem)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// len returns the number of tracked keys
+func (s *keyStore[V]) len() int {
+	n := 0
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		n += len(shard.entries)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// evictExpired drops the least recently used keys that were not seen within the TTL
+func (sh *storeShard[V]) evictExpired(now time.Time) {
+	for elem := sh.lru.Back(); elem != nil; elem = sh.lru.Back() {
+		if now.Sub(elem.Value.(*storeEntry[V]).lastSeen) < sh.ttl {
+			return
+		}
+		sh.remove(elem)
+	}
+}
+
+func (sh *storeShard[V]) remove(elem *list.Element) {
+	delete(sh.entries, elem.Value.(*storeEntry[V]).key)
+	sh.lru.Remove(elem)
+}
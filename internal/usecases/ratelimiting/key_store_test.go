@@ -0,0 +1,142 @@
+package ratelimiting
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+func TestKeyStore_MaxKeys(t *testing.T) {
+	store := newKeyStore[int](time.Hour, WithShards(4), WithMaxKeys(100))
+	now := time.Now()
+	for i := 0; i < 10_000; i++ {
+		store.update(fmt.Sprintf("key-%d", i), now, func(count *int, _ bool) { *count++ })
+	}
+	// Every shard fills up to its share of the cap
+	if n := store.len(); n != 100 {
+		t.Errorf("Expected 100 keys, got %d", n)
+	}
+	// The most recently used key survives the evictions
+	if !store.get("key-9999", func(*int) {}) {
+		t.Errorf("Expected the most recently used key to be kept")
+	}
+}
+
+func TestKeyStore_FillsToMaxKeys(t *testing.T) {
+	for _, maxKeys := range []int{1, 15, 100, 127, 1000, 5000} {
+		store := newKeyStore[int](time.Hour, WithMaxKeys(maxKeys))
+		now := time.Now()
+		for i := 0; i < 20*maxKeys; i++ {
+			store.update(fmt.Sprintf("key-%d", i), now, func(*int, bool) {})
+		}
+		if n := store.len(); n != maxKeys {
+			t.Errorf("Expected a store of max_keys %d to hold %d keys, got %d", maxKeys, maxKeys, n)
+		}
+		for _, shard := range store.shards {
+			if shard.maxKeys < min(maxKeys, minShardKeys) {
+				t.Errorf("Expected shards of max_keys %d to hold at least %d keys, got %d", maxKeys, minShardKeys, shard.maxKeys)
+			}
+		}
+	}
+}
+
+func TestKeyStore_LRUEviction(t *testing.T) {
+	store := newKeyStore[int](time.Hour, WithShards(1), WithMaxKeys(2))
+	now := time.Now()
+	touch := func(key string) { store.update(key, now, func(*int, bool) {}) }
+
+	touch("a")
+	touch("b")
+	touch("a") // b is now the least recently used
+	touch("c")
+	if store.get("b", func(*int) {}) {
+		t.Errorf("Expected the least recently used key to be evicted")
+	}
+	if !store.get("a", func(*int) {}) || !store.get("c", func(*int) {}) {
+		t.Errorf("Expected the recently used keys to be kept")
+	}
+}
+
+func TestKeyStore_TTL(t *testing.T) {
+	store := newKeyStore[int](time.Minute, WithShards(1))
+	now := time.Now()
+	store.update("idle", now, func(*int, bool) {})
+	store.update("active", now.Add(50*time.Second), func(*int, bool) {})
+
+	store.sweep(now.Add(90*time.Second), func(*int) bool { return false })
+	if store.get("idle", func(*int) {}) {
+		t.Errorf("Expected the key idle for longer than the TTL to be evicted")
+	}
+	if !store.get("active", func(*int) {}) {
+		t.Errorf("Expected the key seen within the TTL to be kept")
+	}
+
+	isNew := false
+	store.update("idle", now.Add(90*time.Second), func(_ *int, n bool) { isNew = n })
+	if !isNew {
+		t.Errorf("Expected an evicted key to start from fresh state")
+	}
+}
+
+func TestKeyStore_WithKeyTTL(t *testing.T) {
+	store := newKeyStore[int](time.Minute, WithShards(1), WithKeyTTL(time.Second))
+	now := time.Now()
+	store.update("key", now, func(*int, bool) {})
+	store.sweep(now.Add(2*time.Second), func(*int) bool { return false })
+	if store.len() != 0 {
+		t.Errorf("Expected the configured TTL to override the limiter default")
+	}
+}
+
+func TestFixedWindowRateLimiter_MaxKeys(t *testing.T) {
+	rl := NewFixedWindowRateLimiter(1, time.Minute, WithMaxKeys(10))
+	for i := 0; i < 1000; i++ {
+		rl.IsAllowed(remoteAddress(fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+	}
+	if n := len(rl.GetState()); n > 10 {
+		t.Errorf("Expected at most 10 tracked clients, got %d", n)
+	}
+}
+
+// benchmarkParallel spreads requests from many clients over all procs, run with -cpu 1,4,8 to compare
+// throughput as contention grows
+func benchmarkParallel(b *testing.B, rl domain.RateLimiter) {
+	const clients = 10_000
+	descriptors := make([]domain.Descriptor, clients)
+	for i := range descriptors {
+		descriptors[i] = remoteAddress(fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff))
+	}
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) * 7919
+		for pb.Next() {
+			rl.IsAllowed(descriptors[i%clients])
+			i++
+		}
+	})
+}
+
+func BenchmarkFixedWindowRateLimiter_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewFixedWindowRateLimiter(100, time.Minute))
+}
+
+func BenchmarkTokenBucketRateLimiter_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewTokenBucketRateLimiter(100, time.Minute, 0))
+}
+
+func BenchmarkSlidingWindowLogRateLimiter_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewSlidingWindowLogRateLimiter(100, time.Minute))
+}
+
+func BenchmarkSlidingWindowCounterRateLimiter_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewSlidingWindowCounterRateLimiter(100, time.Minute))
+}
+
+// BenchmarkFixedWindowRateLimiter_SingleShard is the baseline of a single lock over all clients
+func BenchmarkFixedWindowRateLimiter_SingleShard(b *testing.B) {
+	benchmarkParallel(b, NewFixedWindowRateLimiter(100, time.Minute, WithShards(1)))
+}
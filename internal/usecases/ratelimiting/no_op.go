@@ -2,12 +2,16 @@ package ratelimiting
 
 import (
 	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
 )
 
 type NoOpRateLimiter struct{}
 
-func (d NoOpRateLimiter) IsAllowed(ip string) bool { return true }
+func (d NoOpRateLimiter) IsAllowed(descriptor domain.Descriptor) bool { return true }
 
 func (d NoOpRateLimiter) GetState() map[string]int { return map[string]int{} }
 
 func (d NoOpRateLimiter) GetRateLimit() (int, time.Duration) { return 0, 0 }
+
+func (d NoOpRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) { return 0, 0 }
@@ -0,0 +1,86 @@
+package ratelimiting
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+// Where limiters keep their counts
+const (
+	StoreMemory = "memory" // per replica
+	StoreRedis  = "redis"  // shared by all replicas through a RedisStore
+)
+
+// NewRateLimiter creates the in-memory rate limiter described by the config
+func NewRateLimiter(config infrastructure.RateLimiter) (domain.RateLimiter, error) {
+	return NewStoreRateLimiter(config, nil, "")
+}
+
+// NewStoreRateLimiter creates the rate limiter described by the config. Limiters with a redis store count
+// in the given store, under keys namespaced by scope so that limiters of different routes do not share counts.
+func NewStoreRateLimiter(config infrastructure.RateLimiter, store *RedisStore, scope string) (domain.RateLimiter, error) {
+	if config.Type == "none" {
+		return NoOpRateLimiter{}, nil
+	}
+	if config.Limit <= 0 {
+		return nil, fmt.Errorf("%s rate limiter requires a positive limit, got %d", config.Type, config.Limit)
+	}
+	windowDuration, err := time.ParseDuration(config.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s rate limiter window duration: %w", config.Type, err)
+	}
+	if windowDuration <= 0 {
+		return nil, fmt.Errorf("%s rate limiter requires a positive window, got %v", config.Type, windowDuration)
+	}
+	opts, err := storeOptionsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Store {
+	case "", StoreMemory:
+	case StoreRedis:
+		if store == nil {
+			return nil, fmt.Errorf("%s rate limiter with a redis store requires a rateLimitStore address", config.Type)
+		}
+		switch config.Type {
+		case "fixed_window":
+			return NewRedisFixedWindowRateLimiter(store, scope, config.Limit, windowDuration, opts...), nil
+		case "token_bucket":
+			return NewRedisTokenBucketRateLimiter(store, scope, config.Limit, windowDuration, config.Burst, opts...), nil
+		default:
+			return nil, fmt.Errorf("rate limiter type %s does not support a redis store", config.Type)
+		}
+	default:
+		return nil, fmt.Errorf("invalid rate limiter store: %s", config.Store)
+	}
+	switch config.Type {
+	case "fixed_window":
+		return NewFixedWindowRateLimiter(config.Limit, windowDuration, opts...), nil
+	case "token_bucket":
+		return NewTokenBucketRateLimiter(config.Limit, windowDuration, config.Burst, opts...), nil
+	case "sliding_window_log":
+		return NewSlidingWindowLogRateLimiter(config.Limit, windowDuration, opts...), nil
+	case "sliding_window", "sliding_window_counter":
+		return NewSlidingWindowCounterRateLimiter(config.Limit, windowDuration, opts...), nil
+	default:
+		return nil, fmt.Errorf("invalid rate limiter type: %s", config.Type)
+	}
+}
+
+func storeOptionsFromConfig(config infrastructure.RateLimiter) ([]StoreOption, error) {
+	if config.MaxKeys < 0 {
+		return nil, fmt.Errorf("%s rate limiter requires a positive max_keys, got %d", config.Type, config.MaxKeys)
+	}
+	opts := []StoreOption{WithMaxKeys(config.MaxKeys)}
+	if config.KeyTTL != "" {
+		keyTTL, err := time.ParseDuration(config.KeyTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rate limiter key_ttl: %w", config.Type, err)
+		}
+		opts = append(opts, WithKeyTTL(keyTTL))
+	}
+	return opts, nil
+}
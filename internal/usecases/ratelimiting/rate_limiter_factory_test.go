@@ -0,0 +1,65 @@
+package ratelimiting
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	valid := map[string]interface{}{
+		"none":                   NoOpRateLimiter{},
+		"fixed_window":           &FixedWindowRateLimiter{},
+		"token_bucket":           &TokenBucketRateLimiter{},
+		"sliding_window":         &SlidingWindowCounterRateLimiter{},
+		"sliding_window_counter": &SlidingWindowCounterRateLimiter{},
+		"sliding_window_log":     &SlidingWindowLogRateLimiter{},
+	}
+	for limiterType, want := range valid {
+		rl, err := NewRateLimiter(infrastructure.RateLimiter{Type: limiterType, Limit: 10, Window: "1m"})
+		if err != nil {
+			t.Errorf("%s: did not expect an error, got %v", limiterType, err)
+			continue
+		}
+		if got, want := typeName(rl), typeName(want); got != want {
+			t.Errorf("%s: expected %s, got %s", limiterType, want, got)
+		}
+	}
+
+	invalid := []infrastructure.RateLimiter{
+		{Type: "leaky_bucket", Limit: 10, Window: "1m"},
+		{Type: "token_bucket", Limit: 0, Window: "1m"},
+		{Type: "fixed_window", Limit: 10, Window: "a while"},
+		{Type: "fixed_window", Limit: 10, Window: "1m", MaxKeys: -1},
+		{Type: "sliding_window", Limit: 10, Window: "1m", KeyTTL: "forever"},
+		{Type: "fixed_window", Limit: 10, Window: "1m", Store: "redis"},
+		{Type: "fixed_window", Limit: 10, Window: "1m", Store: "disk"},
+	}
+	for _, config := range invalid {
+		if _, err := NewRateLimiter(config); err == nil {
+			t.Errorf("Expected config %+v to be rejected", config)
+		}
+	}
+}
+
+func typeName(v interface{}) string {
+	return fmt.Sprintf("%T", v)
+}
+
+func TestNewStoreRateLimiter(t *testing.T) {
+	_, store := newTestStore(t, infrastructure.RateLimitStore{})
+	for _, limiterType := range []string{"fixed_window", "token_bucket"} {
+		rl, err := NewStoreRateLimiter(infrastructure.RateLimiter{Type: limiterType, Limit: 10, Window: "1m", Store: "redis"}, store, "global:0")
+		if err != nil {
+			t.Errorf("%s: did not expect an error, got %v", limiterType, err)
+			continue
+		}
+		if _, ok := rl.(*RedisRateLimiter); !ok {
+			t.Errorf("%s: expected a redis rate limiter, got %s", limiterType, typeName(rl))
+		}
+	}
+	if _, err := NewStoreRateLimiter(infrastructure.RateLimiter{Type: "sliding_window_log", Limit: 10, Window: "1m", Store: "redis"}, store, "global:0"); err == nil {
+		t.Errorf("Expected a sliding window log with a redis store to be rejected")
+	}
+}
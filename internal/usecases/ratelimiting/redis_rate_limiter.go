@@ -0,0 +1,195 @@
+package ratelimiting
+
+import (
+	"errors"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+var errStoreUnavailable = errors.New("rate limit store unavailable")
+
+// storeLease holds the requests a replica reserved from the store for a descriptor
+type storeLease struct {
+	granted   int       // reserved requests not used yet
+	exhausted bool      // the store had no quota left, requests are rejected until the lease expires
+	expires   time.Time // the lease is dropped after this
+	remaining int       // quota left in the store after the last reservation
+	resetAt   time.Time
+}
+
+// Implements the rate limiter interface on top of a store shared by all replicas, so the limit holds for
+// the whole fleet instead of per replica. Requests are reserved from the store in batches and counted
+// locally until the batch runs out, and rejections are cached until quota may be back, which keeps round
+// trips well below one per request.
+type RedisRateLimiter struct {
+	store          *RedisStore
+	scope          string // namespaces the store keys, limiters that count the same descriptors must not share counts
+	requestLimit   int
+	windowDuration time.Duration
+	reserve        func(key string, requested int, now time.Time) (storeReservation, error)
+	leases         *keyStore[storeLease]
+	fallback       domain.RateLimiter // counts requests locally while the store is unreachable, only for FailLocal
+	cleanupTicker  *time.Ticker       // Ticker to drop expired leases
+	clock          func() time.Time
+}
+
+// NewRedisFixedWindowRateLimiter counts requests per fixed window in the store
+func NewRedisFixedWindowRateLimiter(store *RedisStore, scope string, requestLimit int, windowDuration time.Duration, opts ...StoreOption) *RedisRateLimiter {
+	return newRedisFixedWindowRateLimiter(store, scope, requestLimit, windowDuration, time.Now, opts...)
+}
+
+func newRedisFixedWindowRateLimiter(store *RedisStore, scope string, requestLimit int, windowDuration time.Duration, clock func() time.Time, opts ...StoreOption) *RedisRateLimiter {
+	rl := newRedisRateLimiter(store, scope, requestLimit, windowDuration, clock, opts...)
+	rl.reserve = func(key string, requested int, now time.Time) (storeReservation, error) {
+		return store.reserveFixedWindow(key, requestLimit, windowDuration, requested, now)
+	}
+	if store.failureMode == FailLocal {
+		rl.fallback = newFixedWindowRateLimiter(requestLimit, windowDuration, clock, opts...)
+	}
+	return rl
+}
+
+// NewRedisTokenBucketRateLimiter keeps token buckets in the store, refilled at limit/window tokens per second
+// up to burst tokens
+func NewRedisTokenBucketRateLimiter(store *RedisStore, scope string, requestLimit int, windowDuration time.Duration, burst int, opts ...StoreOption) *RedisRateLimiter {
+	return newRedisTokenBucketRateLimiter(store, scope, requestLimit, windowDuration, burst, time.Now, opts...)
+}
+
+func newRedisTokenBucketRateLimiter(store *RedisStore, scope string, requestLimit int, windowDuration time.Duration, burst int, clock func() time.Time, opts ...StoreOption) *RedisRateLimiter {
+	if burst <= 0 {
+		burst = requestLimit
+	}
+	ratePerSecond := float64(requestLimit) / windowDuration.Seconds()
+	rl := newRedisRateLimiter(store, scope, requestLimit, windowDuration, clock, opts...)
+	rl.reserve = func(key string, requested int, now time.Time) (storeReservation, error) {
+		return store.reserveTokens(key, burst, ratePerSecond, requested, now)
+	}
+	if store.failureMode == FailLocal {
+		rl.fallback = newTokenBucketRateLimiter(requestLimit, windowDuration, burst, clock, opts...)
+	}
+	return rl
+}
+
+// newRedisRateLimiter creates the limiter on the clock, which is set before the cleanup starts reading it
+func newRedisRateLimiter(store *RedisStore, scope string, requestLimit int, windowDuration time.Duration, clock func() time.Time, opts ...StoreOption) *RedisRateLimiter {
+	rl := &RedisRateLimiter{
+		store:          store,
+		scope:          scope,
+		requestLimit:   requestLimit,
+		windowDuration: windowDuration,
+		leases:         newKeyStore[storeLease](store.batchTTL, opts...),
+		cleanupTicker:  time.NewTicker(store.batchTTL),
+		clock:          clock,
+	}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *RedisRateLimiter) IsAllowed(descriptor domain.Descriptor) bool {
+	now := rl.clock()
+	key := descriptor.Key()
+	allowed, leased := false, false
+	rl.leases.update(key, now, func(lease *storeLease, _ bool) {
+		if now.Before(lease.expires) && (lease.granted > 0 || lease.exhausted) {
+			leased = true
+			allowed = rl.take(lease)
+		}
+	})
+	if leased {
+		return allowed
+	}
+
+	// The round trip happens outside the shard lock, concurrent misses for a key may reserve a batch each
+	reservation, err := rl.reserve(rl.scope+":"+key, rl.store.batchSize, now)
+	if err != nil {
+		return rl.unavailable(descriptor)
+	}
+	rl.leases.update(key, now, func(lease *storeLease, _ bool) {
+		if !now.Before(lease.expires) {
+			*lease = storeLease{}
+		}
+		lease.granted += reservation.granted
+		lease.exhausted = lease.granted == 0
+		lease.remaining = reservation.remaining
+		lease.resetAt = now.Add(reservation.reset)
+		ttl := min(rl.store.batchTTL, reservation.validFor)
+		if lease.exhausted {
+			ttl = min(ttl, reservation.reset) // no point asking the store again before quota is back
+		}
+		lease.expires = now.Add(ttl)
+		allowed = rl.take(lease)
+	})
+	return allowed
+}
+
+func (rl *RedisRateLimiter) take(lease *storeLease) bool {
+	if lease.granted == 0 {
+		return false
+	}
+	lease.granted--
+	return true
+}
+
+// unavailable decides requests while the store cannot be reached
+func (rl *RedisRateLimiter) unavailable(descriptor domain.Descriptor) bool {
+	rl.store.metrics.Add("unavailable", 1)
+	switch {
+	case rl.fallback != nil:
+		return rl.fallback.IsAllowed(descriptor)
+	case rl.store.failureMode == FailClosed:
+		return false
+	default:
+		return true
+	}
+}
+
+// GetState returns the requests reserved from the store per descriptor that this replica has not used yet
+func (rl *RedisRateLimiter) GetState() map[string]int {
+	now := rl.clock()
+	stateCopy := make(map[string]int)
+	rl.leases.forEach(func(key string, lease *storeLease) {
+		if now.Before(lease.expires) {
+			stateCopy[key] = lease.granted
+		}
+	})
+	return stateCopy
+}
+
+func (rl *RedisRateLimiter) GetRateLimit() (int, time.Duration) {
+	return rl.requestLimit, rl.windowDuration
+}
+
+// GetQuota reports the quota as of the last round trip, plus the requests this replica reserved and did not use,
+// at most the limit so a token bucket's burst never shows more remaining requests than RateLimit-Limit
+func (rl *RedisRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) {
+	now := rl.clock()
+	remaining, reset, leased := rl.requestLimit, time.Duration(0), false
+	rl.leases.get(descriptor.Key(), func(lease *storeLease) {
+		if now.Before(lease.expires) {
+			leased = true
+			remaining = lease.remaining + lease.granted
+			reset = max(lease.resetAt.Sub(now), 0)
+		}
+	})
+	if leased || rl.store.available() {
+		return min(remaining, rl.requestLimit), reset
+	}
+	switch {
+	case rl.fallback != nil:
+		return rl.fallback.GetQuota(descriptor)
+	case rl.store.failureMode == FailClosed:
+		return 0, storeRetryInterval
+	default:
+		return remaining, reset
+	}
+}
+
+func (rl *RedisRateLimiter) cleanup() {
+	for range rl.cleanupTicker.C {
+		now := rl.clock()
+		rl.leases.sweep(now, func(lease *storeLease) bool {
+			return !now.Before(lease.expires)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package ratelimiting
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/krispingal/l7lb/internal/infrastructure"
+)
+
+func newTestStore(t *testing.T, config infrastructure.RateLimitStore) (*miniredis.Miniredis, *RedisStore) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	config.Address = server.Addr()
+	store, err := NewRedisStore(config)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return server, store
+}
+
+func roundTrips(store *RedisStore) int64 {
+	if v, ok := store.metrics.Get("round_trips").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRedisFixedWindowRateLimiter_SharedAcrossReplicas(t *testing.T) {
+	_, store := newTestStore(t, infrastructure.RateLimitStore{})
+	replicaA := NewRedisFixedWindowRateLimiter(store, "global:0", 5, time.Minute)
+	replicaB := NewRedisFixedWindowRateLimiter(store, "global:0", 5, time.Minute)
+
+	ip := remoteAddress("192.168.1.1")
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		for _, rl := range []*RedisRateLimiter{replicaA, replicaB} {
+			if rl.IsAllowed(ip) {
+				allowed++
+			}
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected replicas to share a limit of 5 requests, allowed %d", allowed)
+	}
+	if remaining, reset := replicaA.GetQuota(ip); remaining != 0 || reset <= 0 || reset > time.Minute {
+		t.Errorf("Expected no quota left until the window ends, got %d and %v", remaining, reset)
+	}
+
+	// Limiters of another scope count separately
+	other := NewRedisFixedWindowRateLimiter(store, "route:/apiA:0", 5, time.Minute)
+	if !other.IsAllowed(ip) {
+		t.Errorf("Expected a limiter of another scope to have its own count")
+	}
+}
+
+func TestRedisFixedWindowRateLimiter_NextWindow(t *testing.T) {
+	_, store := newTestStore(t, infrastructure.RateLimitStore{})
+	clock := newFakeClock(time.Now().Truncate(time.Minute))
+	rl := newRedisFixedWindowRateLimiter(store, "global:0", 1, time.Minute, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	if !rl.IsAllowed(ip) || rl.IsAllowed(ip) {
+		t.Fatalf("Expected exactly one request to be allowed in the window")
+	}
+	clock.Add(time.Minute)
+	if !rl.IsAllowed(ip) {
+		t.Errorf("Expected a request to be allowed in the next window")
+	}
+}
+
+func TestRedisRateLimiter_Batching(t *testing.T) {
+	_, store := newTestStore(t, infrastructure.RateLimitStore{BatchSize: 10})
+	rl := NewRedisFixedWindowRateLimiter(store, "global:0", 15, time.Minute)
+
+	ip := remoteAddress("192.168.1.1")
+	before := roundTrips(store)
+	for i := 0; i < 10; i++ {
+		if !rl.IsAllowed(ip) {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	if n := roundTrips(store) - before; n != 1 {
+		t.Errorf("Expected a batch of 10 requests to take a single round trip, took %d", n)
+	}
+
+	// The second batch is capped by the limit
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if rl.IsAllowed(ip) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 requests left in the limit, allowed %d", allowed)
+	}
+
+	// Rejections are cached until the window ends
+	before = roundTrips(store)
+	for i := 0; i < 10; i++ {
+		rl.IsAllowed(ip)
+	}
+	if n := roundTrips(store) - before; n != 0 {
+		t.Errorf("Expected cached rejections to skip the store, took %d round trips", n)
+	}
+}
+
+func TestRedisTokenBucketRateLimiter_Refill(t *testing.T) {
+	_, store := newTestStore(t, infrastructure.RateLimitStore{})
+	clock := newFakeClock(time.Now())
+	rl := newRedisTokenBucketRateLimiter(store, "global:0", 10, time.Second, 2, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	if !rl.IsAllowed(ip) || !rl.IsAllowed(ip) {
+		t.Fatalf("Expected the burst of 2 to be allowed")
+	}
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected the request beyond the burst to be rejected")
+	}
+	if remaining, reset := rl.GetQuota(ip); remaining != 0 || reset != 100*time.Millisecond {
+		t.Errorf("Expected the next token in 100ms, got %d and %v", remaining, reset)
+	}
+	// 10 tokens per second refill one token every 100ms
+	clock.Add(100 * time.Millisecond)
+	if !rl.IsAllowed(ip) {
+		t.Errorf("Expected a token to be refilled after 100ms")
+	}
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected the refilled token to be spent")
+	}
+}
+
+func TestRedisRateLimiter_StoreUnavailable(t *testing.T) {
+	cases := map[string]struct {
+		want          []bool // outcome of three requests under a limit of 2
+		wantRemaining int
+	}{
+		FailOpen:   {want: []bool{true, true, true}, wantRemaining: 2},
+		FailClosed: {want: []bool{false, false, false}, wantRemaining: 0},
+		FailLocal:  {want: []bool{true, true, false}, wantRemaining: 0},
+	}
+	for mode, tc := range cases {
+		t.Run(mode, func(t *testing.T) {
+			server, store := newTestStore(t, infrastructure.RateLimitStore{FailureMode: mode, Timeout: "20ms"})
+			server.Close()
+			rl := NewRedisFixedWindowRateLimiter(store, "global:0", 2, time.Minute)
+
+			ip := remoteAddress("192.168.1.1")
+			for i, want := range tc.want {
+				if got := rl.IsAllowed(ip); got != want {
+					t.Errorf("Request %d: expected allowed=%v, got %v", i+1, want, got)
+				}
+			}
+			if remaining, _ := rl.GetQuota(ip); remaining != tc.wantRemaining {
+				t.Errorf("Expected %d remaining, got %d", tc.wantRemaining, remaining)
+			}
+		})
+	}
+}
+
+func TestNewRedisStore(t *testing.T) {
+	if store, err := NewRedisStore(infrastructure.RateLimitStore{}); store != nil || err != nil {
+		t.Errorf("Expected no store without an address, got %v and %v", store, err)
+	}
+	invalid := []infrastructure.RateLimitStore{
+		{Address: "localhost:6379", FailureMode: "sometimes"},
+		{Address: "localhost:6379", BatchSize: -1},
+		{Address: "localhost:6379", Timeout: "soon"},
+	}
+	for _, config := range invalid {
+		if _, err := NewRedisStore(config); err == nil {
+			t.Errorf("Expected config %+v to be rejected", config)
+		}
+	}
+}
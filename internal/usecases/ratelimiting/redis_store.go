@@ -0,0 +1,225 @@
+package ratelimiting
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/infrastructure"
+	"github.com/redis/go-redis/v9"
+)
+
+// What limiters do while the store is unreachable
+const (
+	FailOpen   = "open"   // allow requests
+	FailClosed = "closed" // reject requests
+	FailLocal  = "local"  // count requests per replica
+)
+
+const (
+	defaultStoreKeyPrefix = "l7lb:ratelimit:"
+	defaultStoreTimeout   = 50 * time.Millisecond
+	defaultBatchTTL       = time.Second
+	// After a failed round trip limiters skip the store for this long, so requests do not all wait for
+	// the timeout while it is down
+	storeRetryInterval = time.Second
+)
+
+// fixedWindowScript reserves up to ARGV[2] requests of the window counted in KEYS[1], without going over
+// the limit in ARGV[1]. The counter expires with the window, ARGV[3] in milliseconds.
+// It returns the reserved requests and the count of the window.
+var fixedWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+local granted = math.max(math.min(tonumber(ARGV[2]), limit - count), 0)
+if granted > 0 then
+	count = redis.call('INCRBY', KEYS[1], granted)
+end
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {granted, count}
+`)
+
+// tokenBucketScript refills the bucket in KEYS[1] at ARGV[2] tokens per millisecond up to a capacity of
+// ARGV[1], then takes up to ARGV[3] whole tokens. ARGV[4] is the current time in milliseconds. The bucket
+// expires once it would be full again, a missing bucket is a full one.
+// It returns the tokens taken and the tokens left, as a string since Redis truncates numbers to integers.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[4])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(now - ts, 0) * rate)
+local granted = math.max(math.min(tonumber(ARGV[3]), math.floor(tokens)), 0)
+tokens = tokens - granted
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil((burst - tokens) / rate), 1))
+return {granted, tostring(tokens)}
+`)
+
+// RedisStore is a Redis-protocol store shared by the limiters of all replicas
+type RedisStore struct {
+	client      redis.UniversalClient
+	keyPrefix   string
+	timeout     time.Duration
+	failureMode string
+	batchSize   int
+	batchTTL    time.Duration
+
+	unavailableUntil atomic.Int64 // unix nanoseconds until which the store is skipped after a failure
+	metrics          *expvar.Map
+}
+
+// NewRedisStore connects to the store described by the config, it returns nil when no address is configured
+func NewRedisStore(config infrastructure.RateLimitStore) (*RedisStore, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+	store := &RedisStore{
+		keyPrefix:   config.KeyPrefix,
+		timeout:     defaultStoreTimeout,
+		failureMode: config.FailureMode,
+		batchSize:   config.BatchSize,
+		batchTTL:    defaultBatchTTL,
+		metrics:     infrastructure.MetricsMap("ratelimit_store"),
+	}
+	if store.keyPrefix == "" {
+		store.keyPrefix = defaultStoreKeyPrefix
+	}
+	switch store.failureMode {
+	case "":
+		store.failureMode = FailOpen
+	case FailOpen, FailClosed, FailLocal:
+	default:
+		return nil, fmt.Errorf("invalid rate limit store failure_mode: %s", config.FailureMode)
+	}
+	if store.batchSize < 0 {
+		return nil, fmt.Errorf("rate limit store requires a positive batch_size, got %d", config.BatchSize)
+	}
+	if store.batchSize == 0 {
+		store.batchSize = 1
+	}
+	var err error
+	if config.Timeout != "" {
+		if store.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid rate limit store timeout: %w", err)
+		}
+	}
+	if config.BatchTTL != "" {
+		if store.batchTTL, err = time.ParseDuration(config.BatchTTL); err != nil {
+			return nil, fmt.Errorf("invalid rate limit store batch_ttl: %w", err)
+		}
+	}
+	store.client = redis.NewClient(&redis.Options{
+		Addr:         config.Address,
+		Username:     config.Username,
+		Password:     config.Password,
+		DB:           config.DB,
+		DialTimeout:  store.timeout,
+		ReadTimeout:  store.timeout,
+		WriteTimeout: store.timeout,
+	})
+	return store, nil
+}
+
+// Close closes the connections to the store
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// storeReservation is the outcome of a round trip, requests reserved for the caller and the quota left
+type storeReservation struct {
+	granted   int
+	remaining int
+	reset     time.Duration // until the quota is back, or until the next request is allowed when none is left
+	validFor  time.Duration // reserved requests lapse after this, e.g. at the end of their window
+}
+
+// reserveFixedWindow reserves requests of the fixed window that contains now
+func (s *RedisStore) reserveFixedWindow(key string, limit int, window time.Duration, requested int, now time.Time) (storeReservation, error) {
+	windowStart := now.Truncate(window)
+	key = s.keyPrefix + key + ":" + strconv.FormatInt(windowStart.UnixMilli(), 10)
+	result, err := s.run(fixedWindowScript, key, limit, requested, window.Milliseconds())
+	if err != nil {
+		return storeReservation{}, err
+	}
+	granted, count, err := scriptResult(result)
+	if err != nil {
+		return storeReservation{}, err
+	}
+	return storeReservation{
+		granted:   int(granted),
+		remaining: max(limit-int(count), 0),
+		reset:     windowStart.Add(window).Sub(now),
+		validFor:  windowStart.Add(window).Sub(now),
+	}, nil
+}
+
+// reserveTokens takes tokens from the bucket
+func (s *RedisStore) reserveTokens(key string, burst int, ratePerSecond float64, requested int, now time.Time) (storeReservation, error) {
+	ratePerMs := ratePerSecond / 1000
+	result, err := s.run(tokenBucketScript, s.keyPrefix+key, burst, strconv.FormatFloat(ratePerMs, 'g', -1, 64), requested, now.UnixMilli())
+	if err != nil {
+		return storeReservation{}, err
+	}
+	granted, tokens, err := scriptResult(result)
+	if err != nil {
+		return storeReservation{}, err
+	}
+	reservation := storeReservation{granted: int(granted), remaining: int(tokens), validFor: s.batchTTL}
+	missing := float64(burst) - tokens // tokens until the bucket is full
+	if reservation.remaining == 0 {
+		missing = 1 - tokens // tokens until the next request is allowed
+	}
+	reservation.reset = time.Duration(missing / ratePerMs * float64(time.Millisecond))
+	return reservation, nil
+}
+
+// available reports whether limiters currently ask the store, they skip it for a while after a failure
+func (s *RedisStore) available() bool {
+	return time.Now().UnixNano() >= s.unavailableUntil.Load()
+}
+
+// run evaluates the script with a timeout, skipping the store for a while after it failed
+func (s *RedisStore) run(script *redis.Script, key string, args ...interface{}) (interface{}, error) {
+	if !s.available() {
+		return nil, errStoreUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	s.metrics.Add("round_trips", 1)
+	result, err := script.Run(ctx, s.client, []string{key}, args...).Result()
+	if err != nil {
+		s.metrics.Add("errors", 1)
+		s.unavailableUntil.Store(time.Now().Add(storeRetryInterval).UnixNano())
+		return nil, fmt.Errorf("rate limit store: %w", err)
+	}
+	return result, nil
+}
+
+// scriptResult parses the {granted, count} pair the scripts return, the count may be a string
+func scriptResult(result interface{}) (int64, float64, error) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("rate limit store: unexpected script result %v", result)
+	}
+	granted, ok := values[0].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("rate limit store: unexpected script result %v", result)
+	}
+	switch count := values[1].(type) {
+	case int64:
+		return granted, float64(count), nil
+	case string:
+		f, err := strconv.ParseFloat(count, 64)
+		return granted, f, err
+	default:
+		return 0, 0, fmt.Errorf("rate limit store: unexpected script result %v", result)
+	}
+}
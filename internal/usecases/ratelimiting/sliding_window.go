@@ -0,0 +1,215 @@
+package ratelimiting
+
+import (
+	"math"
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+// Implements the rate limiter interface by keeping the timestamps of each descriptor's requests within the window.
+// It is exact, at the cost of memory proportional to the request limit per descriptor.
+type SlidingWindowLogRateLimiter struct {
+	requestLog     *keyStore[[]time.Time]
+	requestLimit   int
+	windowDuration time.Duration
+	cleanupTicker  *time.Ticker // Ticker to drop descriptors without requests in the window
+	clock          func() time.Time
+}
+
+func NewSlidingWindowLogRateLimiter(requestLimit int, windowDuration time.Duration, opts ...StoreOption) *SlidingWindowLogRateLimiter {
+	return newSlidingWindowLogRateLimiter(requestLimit, windowDuration, time.Now, opts...)
+}
+
+// newSlidingWindowLogRateLimiter creates the limiter on the clock, which is set before the cleanup starts reading it
+func newSlidingWindowLogRateLimiter(requestLimit int, windowDuration time.Duration, clock func() time.Time, opts ...StoreOption) *SlidingWindowLogRateLimiter {
+	rl := &SlidingWindowLogRateLimiter{
+		requestLog:     newKeyStore[[]time.Time](windowDuration, opts...),
+		requestLimit:   requestLimit,
+		windowDuration: windowDuration,
+		cleanupTicker:  time.NewTicker(windowDuration),
+		clock:          clock,
+	}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *SlidingWindowLogRateLimiter) IsAllowed(descriptor domain.Descriptor) bool {
+	now := rl.clock()
+	allowed := false
+	rl.requestLog.update(descriptor.Key(), now, func(requests *[]time.Time, _ bool) {
+		*requests = rl.prune(*requests, now)
+		if len(*requests) < rl.requestLimit {
+			*requests = append(*requests, now)
+			allowed = true
+		}
+	})
+	return allowed
+}
+
+// prune drops the timestamps that fell out of the window, timestamps are kept in order
+func (rl *SlidingWindowLogRateLimiter) prune(requests []time.Time, now time.Time) []time.Time {
+	windowStart := now.Add(-rl.windowDuration)
+	i := 0
+	for i < len(requests) && !requests[i].After(windowStart) {
+		i++
+	}
+	return requests[i:]
+}
+
+func (rl *SlidingWindowLogRateLimiter) GetState() map[string]int {
+	now := rl.clock()
+	stateCopy := make(map[string]int)
+	rl.requestLog.forEach(func(key string, requests *[]time.Time) {
+		stateCopy[key] = len(rl.prune(*requests, now))
+	})
+	return stateCopy
+}
+
+func (rl *SlidingWindowLogRateLimiter) GetRateLimit() (int, time.Duration) {
+	return rl.requestLimit, rl.windowDuration
+}
+
+func (rl *SlidingWindowLogRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) {
+	now := rl.clock()
+	remaining, reset := rl.requestLimit, time.Duration(0)
+	rl.requestLog.get(descriptor.Key(), func(requests *[]time.Time) {
+		*requests = rl.prune(*requests, now)
+		if len(*requests) == 0 {
+			return
+		}
+		remaining = max(rl.requestLimit-len(*requests), 0)
+		// Once no requests are left, the next one is allowed when the oldest request leaves the window,
+		// the whole quota is back when the newest one does
+		resetAt := (*requests)[len(*requests)-1].Add(rl.windowDuration)
+		if remaining == 0 {
+			resetAt = (*requests)[len(*requests)-rl.requestLimit].Add(rl.windowDuration)
+		}
+		reset = resetAt.Sub(now)
+	})
+	return remaining, reset
+}
+
+func (rl *SlidingWindowLogRateLimiter) cleanup() {
+	for range rl.cleanupTicker.C {
+		now := rl.clock()
+		rl.requestLog.sweep(now, func(requests *[]time.Time) bool {
+			return len(rl.prune(*requests, now)) == 0
+		})
+	}
+}
+
+// windowCounter holds a descriptor's request counts for the current and the previous fixed window
+type windowCounter struct {
+	windowStart   time.Time
+	currentCount  int
+	previousCount int
+}
+
+// Implements the rate limiter interface by weighting the previous fixed window's count by its overlap with
+// the sliding window. It approximates the sliding window log with two counters per descriptor, and avoids the
+// 2x bursts a fixed window allows at window boundaries.
+type SlidingWindowCounterRateLimiter struct {
+	counters       *keyStore[windowCounter]
+	requestLimit   int
+	windowDuration time.Duration
+	cleanupTicker  *time.Ticker // Ticker to drop descriptors without requests in the last two windows
+	clock          func() time.Time
+}
+
+func NewSlidingWindowCounterRateLimiter(requestLimit int, windowDuration time.Duration, opts ...StoreOption) *SlidingWindowCounterRateLimiter {
+	return newSlidingWindowCounterRateLimiter(requestLimit, windowDuration, time.Now, opts...)
+}
+
+// newSlidingWindowCounterRateLimiter creates the limiter on the clock, which is set before the cleanup starts reading it
+func newSlidingWindowCounterRateLimiter(requestLimit int, windowDuration time.Duration, clock func() time.Time, opts ...StoreOption) *SlidingWindowCounterRateLimiter {
+	rl := &SlidingWindowCounterRateLimiter{
+		counters:       newKeyStore[windowCounter](2*windowDuration, opts...),
+		requestLimit:   requestLimit,
+		windowDuration: windowDuration,
+		cleanupTicker:  time.NewTicker(windowDuration),
+		clock:          clock,
+	}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *SlidingWindowCounterRateLimiter) IsAllowed(descriptor domain.Descriptor) bool {
+	now := rl.clock()
+	allowed := false
+	rl.counters.update(descriptor.Key(), now, func(counter *windowCounter, isNew bool) {
+		if isNew {
+			counter.windowStart = now.Truncate(rl.windowDuration)
+		}
+		if rl.estimate(counter, now) < float64(rl.requestLimit) {
+			counter.currentCount++
+			allowed = true
+		}
+	})
+	return allowed
+}
+
+// advance moves the counter to the fixed window that contains now
+func (rl *SlidingWindowCounterRateLimiter) advance(counter *windowCounter, now time.Time) {
+	windowStart := now.Truncate(rl.windowDuration)
+	switch elapsed := windowStart.Sub(counter.windowStart); {
+	case elapsed <= 0:
+		return
+	case elapsed == rl.windowDuration:
+		counter.previousCount = counter.currentCount
+	default:
+		counter.previousCount = 0
+	}
+	counter.currentCount = 0
+	counter.windowStart = windowStart
+}
+
+// estimate returns the number of requests in the sliding window ending now
+func (rl *SlidingWindowCounterRateLimiter) estimate(counter *windowCounter, now time.Time) float64 {
+	rl.advance(counter, now)
+	previousWeight := 1 - float64(now.Sub(counter.windowStart))/float64(rl.windowDuration)
+	return float64(counter.previousCount)*previousWeight + float64(counter.currentCount)
+}
+
+func (rl *SlidingWindowCounterRateLimiter) GetState() map[string]int {
+	now := rl.clock()
+	stateCopy := make(map[string]int)
+	rl.counters.forEach(func(key string, counter *windowCounter) {
+		stateCopy[key] = int(rl.estimate(counter, now))
+	})
+	return stateCopy
+}
+
+func (rl *SlidingWindowCounterRateLimiter) GetRateLimit() (int, time.Duration) {
+	return rl.requestLimit, rl.windowDuration
+}
+
+func (rl *SlidingWindowCounterRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) {
+	now := rl.clock()
+	remaining, reset := rl.requestLimit, time.Duration(0)
+	rl.counters.get(descriptor.Key(), func(counter *windowCounter) {
+		estimate := rl.estimate(counter, now)
+		remaining = max(int(math.Ceil(float64(rl.requestLimit)-estimate)), 0)
+		elapsed := now.Sub(counter.windowStart)
+		untilNextWindow := rl.windowDuration - elapsed
+		if remaining > 0 || counter.currentCount >= rl.requestLimit || counter.previousCount == 0 {
+			reset = untilNextWindow
+			return
+		}
+		// The previous window's weight has to drop until the estimate falls below the limit
+		weight := float64(rl.requestLimit-counter.currentCount) / float64(counter.previousCount)
+		untilAllowed := time.Duration((1-weight)*float64(rl.windowDuration)) - elapsed
+		reset = max(min(untilAllowed, untilNextWindow), 0)
+	})
+	return remaining, reset
+}
+
+func (rl *SlidingWindowCounterRateLimiter) cleanup() {
+	for range rl.cleanupTicker.C {
+		now := rl.clock()
+		rl.counters.sweep(now, func(counter *windowCounter) bool {
+			rl.advance(counter, now)
+			return counter.currentCount == 0 && counter.previousCount == 0
+		})
+	}
+}
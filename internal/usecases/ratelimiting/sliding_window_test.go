@@ -0,0 +1,106 @@
+package ratelimiting
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLogRateLimiter_allow(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newSlidingWindowLogRateLimiter(2, time.Second, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	if !rl.IsAllowed(ip) || !rl.IsAllowed(ip) {
+		t.Fatalf("Expected the first two requests to be allowed")
+	}
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected the third request to be rejected")
+	}
+	// The first two requests slide out of the window together
+	clock.Add(time.Second + time.Millisecond)
+	if !rl.IsAllowed(ip) {
+		t.Errorf("Expected a request to be allowed once earlier requests left the window")
+	}
+	if state := rl.GetState(); state[ip.Key()] != 1 {
+		t.Errorf("Expected one request in the window, got %d", state[ip.Key()])
+	}
+}
+
+func TestSlidingWindowLogRateLimiter_NoBoundaryBurst(t *testing.T) {
+	clock := newFakeClock(time.Now().Truncate(time.Second).Add(900 * time.Millisecond))
+	rl := newSlidingWindowLogRateLimiter(2, time.Second, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	rl.IsAllowed(ip)
+	rl.IsAllowed(ip)
+	// A fixed window would reset here and allow another 2 requests
+	clock.Add(200 * time.Millisecond)
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected the limit to hold across a window boundary")
+	}
+}
+
+func TestSlidingWindowCounterRateLimiter_WeightsPreviousWindow(t *testing.T) {
+	windowStart := time.Now().Truncate(time.Second)
+	clock := newFakeClock(windowStart)
+	rl := newSlidingWindowCounterRateLimiter(10, time.Second, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	for i := 0; i < 10; i++ {
+		if !rl.IsAllowed(ip) {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	// A quarter into the next window, 75% of the previous 10 requests still count
+	clock.Set(windowStart.Add(1250 * time.Millisecond))
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if rl.IsAllowed(ip) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("Expected 3 requests to be allowed, got %d", allowed)
+	}
+	// Two windows later the old counts no longer apply
+	clock.Set(windowStart.Add(3 * time.Second))
+	if !rl.IsAllowed(ip) {
+		t.Errorf("Expected requests to be allowed after idle windows")
+	}
+}
+
+func TestSlidingWindowLogRateLimiter_GetQuota(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newSlidingWindowLogRateLimiter(2, time.Second, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	rl.IsAllowed(ip)
+	clock.Add(400 * time.Millisecond)
+	rl.IsAllowed(ip)
+	// The first request leaves the window 600ms from now
+	if remaining, reset := rl.GetQuota(ip); remaining != 0 || reset != 600*time.Millisecond {
+		t.Errorf("Expected the next request in 600ms, got %d remaining and %v", remaining, reset)
+	}
+}
+
+func TestSlidingWindowCounterRateLimiter_GetQuota(t *testing.T) {
+	windowStart := time.Now().Truncate(time.Second)
+	clock := newFakeClock(windowStart)
+	rl := newSlidingWindowCounterRateLimiter(10, time.Second, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	for i := 0; i < 10; i++ {
+		rl.IsAllowed(ip)
+	}
+	clock.Set(windowStart.Add(1250 * time.Millisecond))
+	if remaining, _ := rl.GetQuota(ip); remaining != 3 {
+		t.Errorf("Expected 3 remaining requests, got %d", remaining)
+	}
+	for i := 0; i < 3; i++ {
+		rl.IsAllowed(ip)
+	}
+	// 3 requests in the current window allow another once the previous window weighs less than 70%
+	if remaining, reset := rl.GetQuota(ip); remaining != 0 || reset != 50*time.Millisecond {
+		t.Errorf("Expected the next request in 50ms, got %d remaining and %v", remaining, reset)
+	}
+}
@@ -0,0 +1,116 @@
+package ratelimiting
+
+import (
+	"time"
+
+	"github.com/krispingal/l7lb/internal/domain"
+)
+
+// tokenBucket holds the tokens left for a descriptor and when they were last refilled
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Implements the rate limiter interface, each descriptor gets a bucket that refills at limit/window tokens
+// per second and holds up to burst tokens
+type TokenBucketRateLimiter struct {
+	buckets        *keyStore[tokenBucket]
+	requestLimit   int
+	windowDuration time.Duration
+	burst          int
+	ratePerSecond  float64
+	cleanupTicker  *time.Ticker // Ticker to drop buckets that refilled completely
+	clock          func() time.Time
+}
+
+func NewTokenBucketRateLimiter(requestLimit int, windowDuration time.Duration, burst int, opts ...StoreOption) *TokenBucketRateLimiter {
+	return newTokenBucketRateLimiter(requestLimit, windowDuration, burst, time.Now, opts...)
+}
+
+// newTokenBucketRateLimiter creates the limiter on the clock, which is set before the cleanup starts reading it
+func newTokenBucketRateLimiter(requestLimit int, windowDuration time.Duration, burst int, clock func() time.Time, opts ...StoreOption) *TokenBucketRateLimiter {
+	if burst <= 0 {
+		burst = requestLimit
+	}
+	ratePerSecond := float64(requestLimit) / windowDuration.Seconds()
+	// An idle bucket is full again after this long, and can be forgotten
+	refillDuration := time.Duration(float64(burst) / ratePerSecond * float64(time.Second))
+	rl := &TokenBucketRateLimiter{
+		buckets:        newKeyStore[tokenBucket](refillDuration, opts...),
+		requestLimit:   requestLimit,
+		windowDuration: windowDuration,
+		burst:          burst,
+		ratePerSecond:  ratePerSecond,
+		cleanupTicker:  time.NewTicker(windowDuration),
+		clock:          clock,
+	}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *TokenBucketRateLimiter) IsAllowed(descriptor domain.Descriptor) bool {
+	now := rl.clock()
+	allowed := false
+	rl.buckets.update(descriptor.Key(), now, func(bucket *tokenBucket, isNew bool) {
+		if isNew {
+			*bucket = tokenBucket{tokens: float64(rl.burst), lastRefill: now}
+		}
+		rl.refill(bucket, now)
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			allowed = true
+		}
+	})
+	return allowed
+}
+
+func (rl *TokenBucketRateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * rl.ratePerSecond
+	if bucket.tokens > float64(rl.burst) {
+		bucket.tokens = float64(rl.burst)
+	}
+	bucket.lastRefill = now
+}
+
+// GetState returns the tokens used by each descriptor, i.e. how far their bucket is from full
+func (rl *TokenBucketRateLimiter) GetState() map[string]int {
+	now := rl.clock()
+	stateCopy := make(map[string]int)
+	rl.buckets.forEach(func(key string, bucket *tokenBucket) {
+		rl.refill(bucket, now)
+		stateCopy[key] = rl.burst - int(bucket.tokens)
+	})
+	return stateCopy
+}
+
+func (rl *TokenBucketRateLimiter) GetRateLimit() (int, time.Duration) {
+	return rl.requestLimit, rl.windowDuration
+}
+
+// GetQuota reports the tokens left, at most the limit, so a burst above the limit never shows more remaining
+// requests than RateLimit-Limit
+func (rl *TokenBucketRateLimiter) GetQuota(descriptor domain.Descriptor) (int, time.Duration) {
+	remaining, reset := rl.burst, time.Duration(0)
+	rl.buckets.get(descriptor.Key(), func(bucket *tokenBucket) {
+		rl.refill(bucket, rl.clock())
+		remaining = int(bucket.tokens)
+		missing := float64(rl.burst) - bucket.tokens // tokens until the bucket is full
+		if remaining == 0 {
+			missing = 1 - bucket.tokens // tokens until the next request is allowed
+		}
+		reset = time.Duration(missing / rl.ratePerSecond * float64(time.Second))
+	})
+	return min(remaining, rl.requestLimit), reset
+}
+
+// cleanup periodically drops full buckets, a missing bucket is equivalent to a full one
+func (rl *TokenBucketRateLimiter) cleanup() {
+	for range rl.cleanupTicker.C {
+		now := rl.clock()
+		rl.buckets.sweep(now, func(bucket *tokenBucket) bool {
+			rl.refill(bucket, now)
+			return bucket.tokens >= float64(rl.burst)
+		})
+	}
+}
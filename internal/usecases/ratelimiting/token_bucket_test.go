@@ -0,0 +1,74 @@
+package ratelimiting
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRateLimiter_Burst(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newTokenBucketRateLimiter(1, time.Second, 3, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	for i := 0; i < 3; i++ {
+		if !rl.IsAllowed(ip) {
+			t.Fatalf("Expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected request beyond the burst to be rejected")
+	}
+}
+
+func TestTokenBucketRateLimiter_Refill(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newTokenBucketRateLimiter(10, time.Second, 1, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	if !rl.IsAllowed(ip) || rl.IsAllowed(ip) {
+		t.Fatalf("Expected a bucket of one token to allow exactly one request")
+	}
+	// 10 tokens per second refill one token every 100ms
+	clock.Add(100 * time.Millisecond)
+	if !rl.IsAllowed(ip) {
+		t.Errorf("Expected a token to be refilled after 100ms")
+	}
+	if rl.IsAllowed(ip) {
+		t.Errorf("Expected the refilled token to be spent")
+	}
+}
+
+func TestTokenBucketRateLimiter_GetState(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newTokenBucketRateLimiter(5, time.Minute, 0, clock.Now)
+
+	rl.IsAllowed(remoteAddress("192.168.1.1"))
+	rl.IsAllowed(remoteAddress("192.168.1.1"))
+
+	if state := rl.GetState(); state[remoteAddress("192.168.1.1").Key()] != 2 {
+		t.Errorf("Expected 2 tokens used, got %d", state[remoteAddress("192.168.1.1").Key()])
+	}
+	if limit, window := rl.GetRateLimit(); limit != 5 || window != time.Minute {
+		t.Errorf("Expected rate limit of 5 per minute, got %d per %v", limit, window)
+	}
+}
+
+func TestTokenBucketRateLimiter_GetQuota(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	rl := newTokenBucketRateLimiter(1, time.Second, 2, clock.Now)
+
+	ip := remoteAddress("192.168.1.1")
+	// A burst of 2 above the limit of 1 is reported as 1 remaining, never more than the limit
+	if remaining, reset := rl.GetQuota(ip); remaining != 1 || reset != 0 {
+		t.Errorf("Expected a full bucket capped at the limit for an unseen client, got %d remaining and reset in %v", remaining, reset)
+	}
+	rl.IsAllowed(ip)
+	if remaining, reset := rl.GetQuota(ip); remaining != 1 || reset != time.Second {
+		t.Errorf("Expected 1 remaining and a full bucket in 1s, got %d and %v", remaining, reset)
+	}
+	rl.IsAllowed(ip)
+	clock.Add(250 * time.Millisecond)
+	if remaining, reset := rl.GetQuota(ip); remaining != 0 || reset != 750*time.Millisecond {
+		t.Errorf("Expected the next token in 750ms, got %d remaining and %v", remaining, reset)
+	}
+}